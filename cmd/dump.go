@@ -10,6 +10,7 @@ import (
 	"github.com/zestze/zest-backend/internal/reddit"
 	"github.com/zestze/zest-backend/internal/spotify"
 	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zql"
 )
 
@@ -27,14 +28,19 @@ func TransferSpotifyToken(ctx context.Context) {
 	}
 	defer sourceDB.Close()
 
-	targetStore := spotify.NewStoreV1(targetDB)
+	keyring, err := zcrypt.LoadKeyring()
+	if err != nil {
+		panic(err)
+	}
+
+	targetStore := spotify.NewStoreV1(targetDB, spotify.WithKeyring(keyring))
 	sourceStore := spotify.NewStoreV1(sourceDB)
-	userID := 1 // hard-coded for me!
-	token, err := sourceStore.GetToken(ctx, userID)
+	listener := spotify.Listener{UserID: 1, AccountID: 1} // hard-coded for me!
+	token, err := sourceStore.GetToken(ctx, listener)
 	if err != nil {
 		panic(err)
 	}
-	err = targetStore.PersistToken(ctx, token, userID)
+	err = targetStore.PersistToken(ctx, token, listener)
 	if err != nil {
 		panic(err)
 	}
@@ -49,13 +55,13 @@ func TransferSpotifySongs(ctx context.Context) {
 
 	storeV1 := spotify.NewStoreV1(db)
 	storeV2 := spotify.NewStoreV2(db)
-	userID := 1 // hard-coded for me!
-	songs, err := storeV1.GetAll(ctx, userID)
+	listener := spotify.Listener{UserID: 1, AccountID: 1} // hard-coded for me!
+	songs, err := storeV1.GetAll(ctx, listener.UserID)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = storeV2.PersistRecentlyPlayed(ctx, songs, userID)
+	_, err = storeV2.PersistRecentlyPlayed(ctx, songs, listener)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/zestze/zest-backend/internal/lastfm"
+	"github.com/zestze/zest-backend/internal/spotify"
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+type ImportCmd struct {
+	LastFM ImportLastFMCmd `cmd:"" name:"lastfm" help:"import a last.fm scrobble export (csv or json)"`
+}
+
+type ImportLastFMCmd struct {
+	File     string `arg:"" type:"existingfile" help:"path to the export"`
+	Username string `short:"u" env:"ZEST_USERNAME" required:"" help:"user to import plays for"`
+	Host     string `default:"postgres" help:"postgres host"`
+}
+
+func (r *ImportLastFMCmd) Run() error {
+	ctx := context.Background()
+	logger := slog.Default().With("file", r.File, "username", r.Username)
+
+	f, err := os.Open(r.File)
+	if err != nil {
+		return fmt.Errorf("error opening export: %w", err)
+	}
+	defer f.Close()
+
+	scrobbles, err := lastfm.Parse(f)
+	if err != nil {
+		return fmt.Errorf("error parsing export: %w", err)
+	}
+	logger.Info("parsed export", "num_scrobbles", len(scrobbles))
+
+	db, err := zql.PostgresWithOptions(zql.WithHost(r.Host))
+	if err != nil {
+		return fmt.Errorf("error opening db: %w", err)
+	}
+	defer db.Close()
+
+	u, err := user.NewStore(db).GetUser(ctx, r.Username)
+	if err != nil {
+		return fmt.Errorf("error loading user: %w", err)
+	}
+
+	result, err := spotify.NewImportStore(db).
+		ImportScrobbles(ctx, u.ID, spotify.SourceLastFM, scrobbles)
+	if err != nil {
+		return fmt.Errorf("error importing scrobbles: %w", err)
+	}
+
+	logger.Info("successfully imported scrobbles",
+		"matched", result.Matched, "num_persisted", result.Persisted,
+		"duplicates", result.Duplicates, "unmatched", result.Unmatched)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/zestze/zest-backend/internal/reddit"
+	"github.com/zestze/zest-backend/internal/spotify"
+	"github.com/zestze/zest-backend/internal/zcrypt"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+// master keys encrypt the spotify and reddit tokens at rest, and the server won't start without one.
+// setting up the first key is done by:
+//  1. running `go run ./cmd keys generate` to print a new key
+//  2. saving it to secrets/master_keys.json as `{"current": "1", "keys": {"1": "<key>"}}`,
+//     or exporting ZEST_MASTER_KEYS=1=<key> and ZEST_MASTER_KEY_ID=1 instead
+//
+// rotating a master key is done by:
+//  1. generating a new key, and adding it to the keyring as current while keeping the old key
+//  2. restarting the server, so new tokens are sealed with the new key
+//  3. running `zest keys rotate` to reseal everything else
+//  4. removing the old key from the keyring
+type KeysCmd struct {
+	Generate KeysGenerateCmd `cmd:"" help:"print a new random master key"`
+	Rotate   KeysRotateCmd   `cmd:"" help:"re-encrypt stored credentials under the current master key"`
+}
+
+type KeysGenerateCmd struct{}
+
+func (r *KeysGenerateCmd) Run() error {
+	key, err := zcrypt.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+type KeysRotateCmd struct {
+	Host string `default:"postgres" help:"postgres host"`
+}
+
+func (r *KeysRotateCmd) Run() error {
+	ctx := context.Background()
+	logger := slog.Default()
+
+	keyring, err := zcrypt.LoadKeyring()
+	if err != nil {
+		return fmt.Errorf("error loading master keys: %w", err)
+	}
+
+	db, err := zql.PostgresWithOptions(zql.WithHost(r.Host))
+	if err != nil {
+		return fmt.Errorf("error opening db: %w", err)
+	}
+	defer db.Close()
+
+	logger.Info("rotating spotify tokens", "key_id", keyring.CurrentID())
+	store := spotify.NewTokenStore(db, spotify.WithKeyring(keyring))
+	n, err := store.Rotate(ctx)
+	if err != nil {
+		return fmt.Errorf("error rotating spotify tokens: %w", err)
+	}
+	logger.Info("successfully rotated spotify tokens", "num_rotated", n)
+
+	logger.Info("rotating reddit tokens", "key_id", keyring.CurrentID())
+	n, err = reddit.NewTokenStore(db, keyring).Rotate(ctx)
+	if err != nil {
+		return fmt.Errorf("error rotating reddit tokens: %w", err)
+	}
+	logger.Info("successfully rotated reddit tokens", "num_rotated", n)
+
+	return nil
+}
@@ -21,11 +21,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	cors "github.com/rs/cors/wrapper/gin"
+	"github.com/zestze/zest-backend/internal/listenbrainz"
 	"github.com/zestze/zest-backend/internal/metacritic"
 	"github.com/zestze/zest-backend/internal/publisher"
 	"github.com/zestze/zest-backend/internal/reddit"
 	"github.com/zestze/zest-backend/internal/spotify"
 	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zql"
 	"golang.org/x/sync/errgroup"
 
@@ -50,6 +52,8 @@ var cli struct {
 	Scrape   ScrapeCmd   `cmd:"" help:"scrape the internet"`
 	Dump     DumpCmd     `cmd:"" help:"dump from sqlite to postgres"`
 	Backfill BackfillCmd `cmd:"" help:"hit the server"`
+	Keys     KeysCmd     `cmd:"" help:"manage master keys for stored credentials"`
+	Import   ImportCmd   `cmd:"" help:"import listening history from other services"`
 }
 
 type ServerCmd struct {
@@ -133,6 +137,9 @@ func (r *ServerCmd) Run() error {
 	uService := user.New(session, db)
 	uService.Register(router)
 
+	lService := listenbrainz.New(db)
+	lService.Register(router)
+
 	rt := http.DefaultTransport
 	if r.EnableTracing {
 		rt = httptrace.WrapRoundTripper(rt)
@@ -140,11 +147,19 @@ func (r *ServerCmd) Run() error {
 	{
 		v1 := router.Group("v1")
 		auth := user.Auth(session)
+		uService.RegisterSettings(v1, auth)
+		lService.RegisterTokens(v1, auth)
 
 		mService := metacritic.New(db, rt)
 		mService.Register(v1, auth)
 
-		rService, err := reddit.New(db, rt)
+		keyring, err := zcrypt.LoadKeyring()
+		if err != nil {
+			logger.Error("error loading master keys", "error", err)
+			return err
+		}
+
+		rService, err := reddit.New(db, rt, keyring)
 		if err != nil {
 			logger.Error("error setting up reddit service", "error", err)
 			return err
@@ -156,12 +171,14 @@ func (r *ServerCmd) Run() error {
 			logger.Error("error making publisher", "error", err)
 			return err
 		}
-		sService, err := spotify.New(ctx, db, publisher, rt)
+		sService, err := spotify.New(ctx, db, session.UniversalClient, keyring, publisher, rt)
 		if err != nil {
 			logger.Error("error setting up spotify service", "error", err)
 			return err
 		}
 		sService.Register(v1, auth)
+		sService.RegisterImages(v1)
+		sService.RegisterPublic(router)
 	}
 
 	{
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"os"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/zestze/zest-backend/internal/metacritic"
 	"github.com/zestze/zest-backend/internal/reddit"
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zql"
 )
 
@@ -20,7 +22,11 @@ func scrapeReddit(ctx context.Context, persistToFile, reset bool) {
 		panic(err)
 	}
 	defer db.Close()
-	svc, err := reddit.New(db, http.DefaultTransport)
+	keyring, err := zcrypt.LoadKeyring()
+	if err != nil {
+		panic(err)
+	}
+	svc, err := reddit.New(db, http.DefaultTransport, keyring)
 	if err != nil {
 		panic(err)
 	}
@@ -30,7 +36,18 @@ func scrapeReddit(ctx context.Context, persistToFile, reset bool) {
 		}
 	}
 
-	savedPosts, err := svc.Client.Fetch(ctx, reset)
+	// TODO(zeke): hardcoding userID 1 for now
+	const HARDCODE_ZEKE_ID = 1
+	creds, err := svc.Tokens.GetCredentials(ctx, HARDCODE_ZEKE_ID)
+	if errors.Is(err, reddit.ErrNoAccount) {
+		slog.Error("no reddit account linked, link your reddit account via /v1/reddit/authorize",
+			slog.Int("user_id", HARDCODE_ZEKE_ID))
+		os.Exit(1)
+	} else if err != nil {
+		panic(err)
+	}
+
+	savedPosts, err := svc.Client.Fetch(ctx, creds, reset)
 	if err != nil {
 		panic(err)
 	}
@@ -49,14 +66,12 @@ func scrapeReddit(ctx context.Context, persistToFile, reset bool) {
 		}
 	}
 
-	// TODO(zeke): hardcoding userID 1 for now
-	const HARDCODE_ZEKE_ID = 1
-	ids, err := svc.Store.PersistPosts(ctx, savedPosts, HARDCODE_ZEKE_ID)
+	names, err := svc.Store.PersistPosts(ctx, savedPosts, HARDCODE_ZEKE_ID)
 	if err != nil {
 		panic(err)
 	}
 
-	slog.Info("successfully persisted posts", slog.Int("num_persisted", len(ids)))
+	slog.Info("successfully persisted posts", slog.Int("num_persisted", len(names)))
 }
 
 func scrapeMetacritic(medium metacritic.Medium, startYear int, numPages int) {
@@ -0,0 +1,186 @@
+// Package graph builds weighted, undirected co-occurrence graphs,
+// and encodes them as GraphML or Graphviz DOT for tools such as Gephi.
+package graph
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+type Node struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	// Weight is how many times the node occurred
+	Weight int `json:"weight"`
+}
+
+type Edge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Weight is how many groups both nodes occurred in
+	Weight int `json:"weight"`
+}
+
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// Builder counts how often nodes occur together in groups
+type Builder struct {
+	nodes map[string]Node
+	edges map[[2]string]int
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		nodes: make(map[string]Node),
+		edges: make(map[[2]string]int),
+	}
+}
+
+// AddNode records an occurrence of a node
+func (b *Builder) AddNode(id, label string) {
+	node := b.nodes[id]
+	node.ID = id
+	node.Label = label
+	node.Weight++
+	b.nodes[id] = node
+}
+
+// AddGroup links every pair of distinct nodes in ids. nodes should already have been added.
+func (b *Builder) AddGroup(ids []string) {
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	for i := range ids {
+		for j := i + 1; j < len(ids); j++ {
+			b.edges[[2]string{ids[i], ids[j]}]++
+		}
+	}
+}
+
+// Graph returns the edges with at least minWeight, and the nodes they connect.
+// nodes and edges are sorted by weight, heaviest first.
+func (b *Builder) Graph(minWeight int) Graph {
+	g := Graph{
+		Nodes: make([]Node, 0),
+		Edges: make([]Edge, 0),
+	}
+	connected := make(map[string]bool)
+	for pair, weight := range b.edges {
+		if weight < minWeight {
+			continue
+		}
+		g.Edges = append(g.Edges, Edge{Source: pair[0], Target: pair[1], Weight: weight})
+		connected[pair[0]] = true
+		connected[pair[1]] = true
+	}
+	for id := range connected {
+		g.Nodes = append(g.Nodes, b.nodes[id])
+	}
+
+	slices.SortFunc(g.Nodes, func(a, b Node) int {
+		return cmp.Or(cmp.Compare(b.Weight, a.Weight), cmp.Compare(a.ID, b.ID))
+	})
+	slices.SortFunc(g.Edges, func(a, b Edge) int {
+		return cmp.Or(cmp.Compare(b.Weight, a.Weight),
+			cmp.Compare(a.Source, b.Source), cmp.Compare(a.Target, b.Target))
+	})
+	return g
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+// WriteGraphML writes g as GraphML, with label and weight attributes
+func (g Graph) WriteGraphML(w io.Writer) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "label", For: "node", AttrName: "label", AttrType: "string"},
+			{ID: "weight", For: "node", AttrName: "weight", AttrType: "int"},
+			{ID: "edge_weight", For: "edge", AttrName: "weight", AttrType: "int"},
+		},
+	}
+	doc.Graph.EdgeDefault = "undirected"
+	for _, n := range g.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{
+			ID: n.ID,
+			Data: []graphMLData{
+				{Key: "label", Value: n.Label},
+				{Key: "weight", Value: fmt.Sprint(n.Weight)},
+			},
+		})
+	}
+	for _, e := range g.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			Source: e.Source,
+			Target: e.Target,
+			Data:   []graphMLData{{Key: "edge_weight", Value: fmt.Sprint(e.Weight)}},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// WriteDOT writes g as an undirected Graphviz graph
+func (g Graph) WriteDOT(w io.Writer, name string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "graph %v {\n", quoteDOT(name))
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&sb, "  %v [label=%v, weight=%v];\n", quoteDOT(n.ID), quoteDOT(n.Label), n.Weight)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&sb, "  %v -- %v [weight=%v];\n", quoteDOT(e.Source), quoteDOT(e.Target), e.Weight)
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteDOT(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
@@ -0,0 +1,76 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testGraph() Graph {
+	b := NewBuilder()
+	for _, group := range [][]string{{"a", "b"}, {"a", "b", "c"}, {"c", "c"}} {
+		for _, id := range group {
+			b.AddNode(id, "artist "+id)
+		}
+		b.AddGroup(group)
+	}
+	return b.Graph(1)
+}
+
+func TestBuilder(t *testing.T) {
+	assert := assert.New(t)
+
+	g := testGraph()
+	assert.Equal([]Edge{
+		{Source: "a", Target: "b", Weight: 2},
+		{Source: "a", Target: "c", Weight: 1},
+		{Source: "b", Target: "c", Weight: 1},
+	}, g.Edges)
+	if assert.Len(g.Nodes, 3) {
+		assert.Equal(Node{ID: "c", Label: "artist c", Weight: 3}, g.Nodes[0])
+	}
+
+	// c is only connected by light edges
+	b := NewBuilder()
+	b.AddNode("a", "a")
+	b.AddNode("b", "b")
+	b.AddGroup([]string{"a", "b"})
+	b.AddGroup([]string{"a", "b"})
+	b.AddNode("c", "c")
+	b.AddGroup([]string{"a", "c"})
+	g = b.Graph(2)
+	assert.Len(g.Edges, 1)
+	assert.Len(g.Nodes, 2)
+}
+
+func TestWriteGraphML(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	assert.NoError(testGraph().WriteGraphML(&buf))
+
+	var doc graphML
+	assert.NoError(xml.Unmarshal(buf.Bytes(), &doc))
+	assert.Len(doc.Graph.Nodes, 3)
+	assert.Len(doc.Graph.Edges, 3)
+	assert.Equal("undirected", doc.Graph.EdgeDefault)
+}
+
+func TestWriteDOT(t *testing.T) {
+	assert := assert.New(t)
+
+	g := Graph{
+		Nodes: []Node{{ID: "a", Label: `say "hi"`, Weight: 1}, {ID: "b", Label: "b", Weight: 1}},
+		Edges: []Edge{{Source: "a", Target: "b", Weight: 1}},
+	}
+	var buf bytes.Buffer
+	assert.NoError(g.WriteDOT(&buf, "zeke"))
+	assert.Equal(`graph "zeke" {
+  "a" [label="say \"hi\"", weight=1];
+  "b" [label="b", weight=1];
+  "a" -- "b" [weight=1];
+}
+`, buf.String())
+}
@@ -0,0 +1,255 @@
+// Package lastfm parses exports of a user's Last.fm scrobble history.
+//
+// there's no official export, so this handles the shapes the popular export tools produce:
+// CSV with or without a header row, and JSON that's either the raw `user.getRecentTracks`
+// api response, a list of those pages, or a flat list of tracks.
+package lastfm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var ErrUnknownFormat = errors.New("unknown scrobble export format")
+
+type Scrobble struct {
+	Artist   string    `json:"artist"`
+	Album    string    `json:"album"`
+	Track    string    `json:"track"`
+	PlayedAt time.Time `json:"played_at"`
+}
+
+// Parse sniffs whether r is a JSON or CSV export and parses it accordingly
+func Parse(r io.Reader) ([]Scrobble, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("error reading export: %w", err)
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = br.ReadByte()
+			continue
+		case '[', '{':
+			return ParseJSON(br)
+		default:
+			return ParseCSV(br)
+		}
+	}
+}
+
+// layouts seen in exports, all of which are in UTC
+var dateLayouts = []string{
+	time.RFC3339,
+	"02 Jan 2006 15:04",
+	"2 Jan 2006, 15:04",
+	"02 Jan 2006, 15:04",
+	time.DateTime,
+}
+
+func parseDate(raw string) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if uts, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(uts, 0).UTC(), nil
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date: %v", raw)
+}
+
+// ParseCSV parses a CSV export. If there's a header row columns are found by name,
+// otherwise they are assumed to be artist, album, track, date.
+func ParseCSV(r io.Reader) ([]Scrobble, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv: %w", err)
+	} else if len(records) == 0 {
+		return nil, nil
+	}
+
+	cols := map[string]int{"artist": 0, "album": 1, "track": 2, "date": 3}
+	if header, ok := parseHeader(records[0]); ok {
+		cols = header
+		records = records[1:]
+	}
+
+	scrobbles := make([]Scrobble, 0, len(records))
+	for i, record := range records {
+		field := func(name string) string {
+			if idx, ok := cols[name]; ok && idx < len(record) {
+				return strings.TrimSpace(record[idx])
+			}
+			return ""
+		}
+		playedAt, err := parseDate(field("date"))
+		if err != nil {
+			return nil, fmt.Errorf("row %v: %w", i+1, err)
+		}
+		scrobbles = append(scrobbles, Scrobble{
+			Artist:   field("artist"),
+			Album:    field("album"),
+			Track:    field("track"),
+			PlayedAt: playedAt,
+		})
+	}
+	return scrobbles, nil
+}
+
+// header names used by various export tools, mapped to the column they represent
+var headerAliases = map[string]string{
+	"artist":    "artist",
+	"album":     "album",
+	"track":     "track",
+	"name":      "track",
+	"title":     "track",
+	"uts":       "date",
+	"date":      "date",
+	"timestamp": "date",
+	"utc_time":  "date",
+}
+
+func parseHeader(record []string) (map[string]int, bool) {
+	cols := make(map[string]int)
+	for i, h := range record {
+		col, ok := headerAliases[strings.ToLower(strings.TrimSpace(h))]
+		if _, seen := cols[col]; ok && !seen {
+			cols[col] = i
+		}
+	}
+	_, hasArtist := cols["artist"]
+	_, hasTrack := cols["track"]
+	_, hasDate := cols["date"]
+	return cols, hasArtist && hasTrack && hasDate
+}
+
+// textField handles the api representing names as either strings or objects
+type textField string
+
+func (t *textField) UnmarshalJSON(bs []byte) error {
+	if len(bs) > 0 && bs[0] == '"' {
+		var s string
+		if err := jsoniter.Unmarshal(bs, &s); err != nil {
+			return err
+		}
+		*t = textField(s)
+		return nil
+	}
+
+	var obj struct {
+		Text string `json:"#text"`
+		Name string `json:"name"`
+	}
+	if err := jsoniter.Unmarshal(bs, &obj); err != nil {
+		return err
+	}
+	if obj.Text != "" {
+		*t = textField(obj.Text)
+	} else {
+		*t = textField(obj.Name)
+	}
+	return nil
+}
+
+type jsonTrack struct {
+	Artist textField `json:"artist"`
+	Album  textField `json:"album"`
+	Name   string    `json:"name"`
+	Date   struct {
+		UTS string `json:"uts"`
+	} `json:"date"`
+	Attr struct {
+		NowPlaying string `json:"nowplaying"`
+	} `json:"@attr"`
+}
+
+type jsonPage struct {
+	Track        []jsonTrack `json:"track"`
+	RecentTracks *jsonPage   `json:"recenttracks"`
+}
+
+func (p jsonPage) tracks() []jsonTrack {
+	if p.RecentTracks != nil {
+		return p.RecentTracks.tracks()
+	}
+	return p.Track
+}
+
+// ParseJSON parses a JSON export
+func ParseJSON(r io.Reader) ([]Scrobble, error) {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	bs = bytes.TrimSpace(bs)
+	if len(bs) == 0 {
+		return nil, ErrUnknownFormat
+	}
+
+	var tracks []jsonTrack
+	switch bs[0] {
+	case '{':
+		var page jsonPage
+		if err = jsoniter.Unmarshal(bs, &page); err != nil {
+			return nil, fmt.Errorf("error decoding json: %w", err)
+		}
+		tracks = page.tracks()
+	case '[':
+		var elems []jsoniter.RawMessage
+		if err = jsoniter.Unmarshal(bs, &elems); err != nil {
+			return nil, fmt.Errorf("error decoding json: %w", err)
+		}
+		for _, elem := range elems {
+			// each element is either a page of tracks, or a track
+			var page jsonPage
+			if err = jsoniter.Unmarshal(elem, &page); err != nil {
+				return nil, fmt.Errorf("error decoding json: %w", err)
+			}
+			if pageTracks := page.tracks(); len(pageTracks) > 0 {
+				tracks = append(tracks, pageTracks...)
+				continue
+			}
+			var track jsonTrack
+			if err = jsoniter.Unmarshal(elem, &track); err != nil {
+				return nil, fmt.Errorf("error decoding json: %w", err)
+			}
+			tracks = append(tracks, track)
+		}
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	scrobbles := make([]Scrobble, 0, len(tracks))
+	for i, t := range tracks {
+		// the track currently playing shows up without a date
+		if t.Attr.NowPlaying == "true" {
+			continue
+		}
+		playedAt, err := parseDate(t.Date.UTS)
+		if err != nil {
+			return nil, fmt.Errorf("track %v: %w", i, err)
+		}
+		scrobbles = append(scrobbles, Scrobble{
+			Artist:   string(t.Artist),
+			Album:    string(t.Album),
+			Track:    t.Name,
+			PlayedAt: playedAt,
+		})
+	}
+	return scrobbles, nil
+}
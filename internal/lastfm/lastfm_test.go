@@ -0,0 +1,73 @@
+package lastfm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCSV(t *testing.T) {
+	assert := assert.New(t)
+
+	// no header, the classic artist,album,track,date export
+	scrobbles, err := Parse(strings.NewReader(
+		`Phantogram,Nightlife,Don't Move,10 Feb 2024 17:45
+"Tame Impala","Currents","Let It Happen",09 Feb 2024 08:01
+`))
+	assert.NoError(err)
+	if assert.Len(scrobbles, 2) {
+		assert.Equal("Phantogram", scrobbles[0].Artist)
+		assert.Equal("Don't Move", scrobbles[0].Track)
+		assert.Equal(time.Date(2024, 2, 10, 17, 45, 0, 0, time.UTC), scrobbles[0].PlayedAt)
+	}
+
+	// header with unix timestamps, columns in a different order
+	scrobbles, err = Parse(strings.NewReader(
+		`uts,utc_time,artist,artist_mbid,album,album_mbid,track,track_mbid
+1707587100,"10 Feb 2024, 17:45",Phantogram,,Nightlife,,Don't Move,
+`))
+	assert.NoError(err)
+	if assert.Len(scrobbles, 1) {
+		assert.Equal("Nightlife", scrobbles[0].Album)
+		assert.Equal(time.Unix(1707587100, 0).UTC(), scrobbles[0].PlayedAt)
+	}
+
+	_, err = Parse(strings.NewReader("Phantogram,Nightlife,Don't Move,yesterday\n"))
+	assert.Error(err)
+}
+
+func TestParseJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	// a list of getRecentTracks pages
+	scrobbles, err := Parse(strings.NewReader(`[{"track": [
+	{"artist": {"#text": "Phantogram"}, "album": {"#text": "Nightlife"}, "name": "Don't Move",
+	 "@attr": {"nowplaying": "true"}},
+	{"artist": {"#text": "Phantogram"}, "album": {"#text": "Nightlife"}, "name": "Don't Move",
+	 "date": {"uts": "1707587100", "#text": "10 Feb 2024, 17:45"}}
+	]}]`))
+	assert.NoError(err)
+	if assert.Len(scrobbles, 1) {
+		assert.Equal("Phantogram", scrobbles[0].Artist)
+		assert.Equal(time.Unix(1707587100, 0).UTC(), scrobbles[0].PlayedAt)
+	}
+
+	// the raw api response
+	scrobbles, err = Parse(strings.NewReader(`{"recenttracks": {"track": [
+	{"artist": {"name": "Phantogram"}, "album": {"#text": "Nightlife"}, "name": "Don't Move",
+	 "date": {"uts": "1707587100"}}
+	]}}`))
+	assert.NoError(err)
+	if assert.Len(scrobbles, 1) {
+		assert.Equal("Phantogram", scrobbles[0].Artist)
+	}
+
+	// a flat list of tracks with plain strings
+	scrobbles, err = Parse(strings.NewReader(`[
+	{"artist": "Phantogram", "album": "Nightlife", "name": "Don't Move", "date": {"uts": "1707587100"}}
+	]`))
+	assert.NoError(err)
+	assert.Len(scrobbles, 1)
+}
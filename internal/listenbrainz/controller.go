@@ -0,0 +1,169 @@
+package listenbrainz
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zestze/zest-backend/internal/spotify"
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const usernameKey = "listenbrainz.username"
+
+type Controller struct {
+	Tokens  TokenStore
+	Imports spotify.ImportStore
+}
+
+func New(db *sql.DB) Controller {
+	return Controller{
+		Tokens:  NewTokenStore(db),
+		Imports: spotify.NewImportStore(db),
+	}
+}
+
+// Register adds the listenbrainz api, which has to live at the root for plugins to find it
+func (svc Controller) Register(r gin.IRouter) {
+	g := r.Group("/1")
+	g.GET("/validate-token", svc.validateToken)
+	g.POST("/submit-listens", svc.tokenAuth, zgin.WithUser(svc.submitListens))
+}
+
+// RegisterTokens adds routes for the logged in user to get a token for their scrobblers
+func (svc Controller) RegisterTokens(r gin.IRouter, auth gin.HandlerFunc) {
+	g := r.Group("/listenbrainz")
+	g.Use(auth)
+	g.POST("/token", zgin.WithUser(svc.issueToken))
+}
+
+// errors are reported the way listenbrainz reports them, since clients may parse them
+func abortWithError(c *gin.Context, code int, message string) {
+	c.AbortWithStatusJSON(code, gin.H{
+		"code":  code,
+		"error": message,
+	})
+}
+
+// tokenFromRequest reads the token from an `Authorization: Token <token>` header
+func tokenFromRequest(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if token, ok := strings.CutPrefix(header, "Token "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func (svc Controller) tokenAuth(c *gin.Context) {
+	logger := zlog.Logger(c)
+
+	token := tokenFromRequest(c)
+	if token == "" {
+		abortWithError(c, http.StatusUnauthorized, "You need to provide an Authorization header.")
+		return
+	}
+
+	u, err := svc.Tokens.GetUser(c.Request.Context(), token)
+	if errors.Is(err, sql.ErrNoRows) {
+		abortWithError(c, http.StatusUnauthorized, "Invalid authorization token.")
+		return
+	} else if err != nil {
+		logger.Error("error looking up listen token", "error", err)
+		abortWithError(c, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	c.Set(user.UserIdKey, u.ID)
+	c.Set(usernameKey, u.Username)
+	c.Next()
+}
+
+func (svc Controller) validateToken(c *gin.Context) {
+	logger := zlog.Logger(c)
+
+	token := tokenFromRequest(c)
+	if token == "" {
+		// older clients pass the token as a query param
+		token = c.Query("token")
+	}
+	if token == "" {
+		abortWithError(c, http.StatusBadRequest, "You need to provide an Authorization token.")
+		return
+	}
+
+	u, err := svc.Tokens.GetUser(c.Request.Context(), token)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusOK, gin.H{
+			"code":    http.StatusOK,
+			"message": "Token invalid.",
+			"valid":   false,
+		})
+		return
+	} else if err != nil {
+		logger.Error("error looking up listen token", "error", err)
+		abortWithError(c, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":      http.StatusOK,
+		"message":   "Token valid.",
+		"valid":     true,
+		"user_name": u.Username,
+	})
+}
+
+func (svc Controller) submitListens(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSubmissionSize)
+
+	var submission Submission
+	if err := c.ShouldBindJSON(&submission); err != nil {
+		logger.Error("error binding listens", "error", err)
+		abortWithError(c, http.StatusBadRequest, "Invalid JSON document submitted.")
+		return
+	}
+	if err := submission.Validate(); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// we only keep history, so there's nothing to do with what's playing right now
+	if submission.ListenType == ListenTypePlayingNow {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Minute)
+	defer cancel()
+	result, err := svc.Imports.PersistListens(ctx, userID, spotify.SourceListenBrainz, submission.Listens())
+	if err != nil {
+		logger.Error("error persisting listens", "error", err)
+		abortWithError(c, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	logger.Info("successfully persisted listens",
+		"username", c.GetString(usernameKey), "matched", result.Matched,
+		"num_persisted", result.Persisted, "duplicates", result.Duplicates)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (svc Controller) issueToken(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	token, err := svc.Tokens.IssueToken(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("error issuing listen token", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, gin.H{
+		"token": token,
+	})
+}
@@ -0,0 +1,130 @@
+// Package listenbrainz implements enough of the ListenBrainz api for existing scrobbler plugins
+// to submit plays from non-spotify players to zest, authenticated with zest issued user tokens.
+//
+// see https://listenbrainz.readthedocs.io/en/latest/users/api/core.html
+package listenbrainz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zestze/zest-backend/internal/spotify"
+)
+
+// listen types a submission can have
+const (
+	ListenTypeSingle     = "single"
+	ListenTypePlayingNow = "playing_now"
+	ListenTypeImport     = "import"
+)
+
+// same limits as listenbrainz itself
+const (
+	maxListensPerRequest = 1000
+	maxSubmissionSize    = 10 << 20
+)
+
+var ErrNoListens = errors.New("no listens in payload")
+
+type Submission struct {
+	ListenType string   `json:"listen_type"`
+	Payload    []Listen `json:"payload"`
+}
+
+type Listen struct {
+	// ListenedAt is a unix timestamp, and is omitted for playing_now
+	ListenedAt    int64         `json:"listened_at"`
+	TrackMetadata TrackMetadata `json:"track_metadata"`
+}
+
+type TrackMetadata struct {
+	ArtistName     string         `json:"artist_name"`
+	TrackName      string         `json:"track_name"`
+	ReleaseName    string         `json:"release_name"`
+	AdditionalInfo AdditionalInfo `json:"additional_info"`
+}
+
+// AdditionalInfo is not exhaustive, it's just the fields we make use of
+type AdditionalInfo struct {
+	SpotifyID  string `json:"spotify_id"`
+	DurationMS int    `json:"duration_ms"`
+	Duration   int    `json:"duration"`
+}
+
+// Validate checks the submission against the rules listenbrainz enforces
+func (s Submission) Validate() error {
+	switch s.ListenType {
+	case ListenTypeSingle, ListenTypePlayingNow:
+		if len(s.Payload) != 1 {
+			return fmt.Errorf("%v listens must have exactly one listen in the payload", s.ListenType)
+		}
+	case ListenTypeImport:
+		if len(s.Payload) == 0 {
+			return ErrNoListens
+		} else if len(s.Payload) > maxListensPerRequest {
+			return fmt.Errorf("too many listens, at most %v may be submitted at once", maxListensPerRequest)
+		}
+	default:
+		return fmt.Errorf("invalid listen_type [%v]", s.ListenType)
+	}
+
+	for i, listen := range s.Payload {
+		if strings.TrimSpace(listen.TrackMetadata.ArtistName) == "" {
+			return fmt.Errorf("listen %v: artist_name is required", i)
+		} else if strings.TrimSpace(listen.TrackMetadata.TrackName) == "" {
+			return fmt.Errorf("listen %v: track_name is required", i)
+		}
+
+		if s.ListenType == ListenTypePlayingNow {
+			continue
+		}
+		if listen.ListenedAt <= 0 {
+			return fmt.Errorf("listen %v: listened_at is required", i)
+		}
+	}
+	return nil
+}
+
+// Listens converts a validated submission into plays to persist
+func (s Submission) Listens() []spotify.Listen {
+	listens := make([]spotify.Listen, 0, len(s.Payload))
+	for _, listen := range s.Payload {
+		metadata := listen.TrackMetadata
+		durationMS := metadata.AdditionalInfo.DurationMS
+		if durationMS == 0 {
+			durationMS = metadata.AdditionalInfo.Duration * 1000
+		}
+		listens = append(listens, spotify.Listen{
+			Artist:     strings.TrimSpace(metadata.ArtistName),
+			Album:      strings.TrimSpace(metadata.ReleaseName),
+			Track:      strings.TrimSpace(metadata.TrackName),
+			PlayedAt:   time.Unix(listen.ListenedAt, 0).UTC(),
+			SpotifyID:  parseSpotifyID(metadata.AdditionalInfo.SpotifyID),
+			DurationMS: durationMS,
+		})
+	}
+	return listens
+}
+
+// parseSpotifyID accepts either a bare id, a spotify uri, or an open.spotify.com url
+func parseSpotifyID(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if id, ok := strings.CutPrefix(raw, "spotify:track:"); ok {
+		return id
+	}
+	if _, path, ok := strings.Cut(raw, "open.spotify.com/"); ok {
+		// urls can have a locale prefix, such as /intl-de/track/<id>
+		_, id, ok := strings.Cut(path, "track/")
+		if !ok {
+			return ""
+		}
+		id, _, _ = strings.Cut(id, "?")
+		return strings.Trim(id, "/")
+	}
+	if strings.ContainsAny(raw, ":/") {
+		return ""
+	}
+	return raw
+}
@@ -0,0 +1,67 @@
+package listenbrainz
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmission(t *testing.T) {
+	assert := assert.New(t)
+
+	var submission Submission
+	err := jsoniter.NewDecoder(strings.NewReader(`{
+	"listen_type": "single",
+	"payload": [{
+		"listened_at": 1707587100,
+		"track_metadata": {
+			"artist_name": "Phantogram",
+			"track_name": "Don't Move",
+			"release_name": "Nightlife",
+			"additional_info": {
+				"spotify_id": "https://open.spotify.com/track/3c2UPGbIhmAuk8u9jCRgrf",
+				"duration": 262
+			}
+		}
+	}]}`)).Decode(&submission)
+	assert.NoError(err)
+	assert.NoError(submission.Validate())
+
+	listens := submission.Listens()
+	if assert.Len(listens, 1) {
+		assert.Equal("Phantogram", listens[0].Artist)
+		assert.Equal("Nightlife", listens[0].Album)
+		assert.Equal("3c2UPGbIhmAuk8u9jCRgrf", listens[0].SpotifyID)
+		assert.Equal(262000, listens[0].DurationMS)
+		assert.Equal(time.Unix(1707587100, 0).UTC(), listens[0].PlayedAt)
+	}
+
+	// playing_now doesn't need a timestamp
+	submission.ListenType = ListenTypePlayingNow
+	submission.Payload[0].ListenedAt = 0
+	assert.NoError(submission.Validate())
+
+	submission.ListenType = ListenTypeImport
+	assert.Error(submission.Validate())
+
+	submission.ListenType = ListenTypeSingle
+	submission.Payload = append(submission.Payload, submission.Payload[0])
+	assert.Error(submission.Validate())
+
+	assert.Error(Submission{ListenType: "bogus"}.Validate())
+	assert.ErrorIs(Submission{ListenType: ListenTypeImport}.Validate(), ErrNoListens)
+	assert.Error(Submission{ListenType: ListenTypeSingle, Payload: []Listen{{ListenedAt: 1}}}.Validate())
+}
+
+func TestParseSpotifyID(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("3c2UPGbIhmAuk8u9jCRgrf", parseSpotifyID("3c2UPGbIhmAuk8u9jCRgrf"))
+	assert.Equal("3c2UPGbIhmAuk8u9jCRgrf", parseSpotifyID("spotify:track:3c2UPGbIhmAuk8u9jCRgrf"))
+	assert.Equal("3c2UPGbIhmAuk8u9jCRgrf",
+		parseSpotifyID("https://open.spotify.com/intl-de/track/3c2UPGbIhmAuk8u9jCRgrf?si=abc"))
+	assert.Equal("", parseSpotifyID("https://open.spotify.com/album/3c2UPGbIhmAuk8u9jCRgrf"))
+	assert.Equal("", parseSpotifyID(""))
+}
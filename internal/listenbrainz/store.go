@@ -0,0 +1,75 @@
+package listenbrainz
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+
+	"github.com/google/uuid"
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+// TokenStore manages the tokens scrobblers authenticate with.
+// only a hash of each token is stored, so a token can only be seen when it's issued.
+type TokenStore struct {
+	db *sql.DB
+}
+
+func NewTokenStore(db *sql.DB) TokenStore {
+	return TokenStore{
+		db: db,
+	}
+}
+
+// IssueToken makes a new token for the user, replacing any they already had
+func (s TokenStore) IssueToken(ctx context.Context, userID user.ID) (string, error) {
+	logger := zlog.Logger(ctx)
+
+	token := uuid.New().String()
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO listen_tokens
+		(user_id, token_hash)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET token_hash=excluded.token_hash, created_at=CURRENT_TIMESTAMP`,
+		userID, hashToken(token)); err != nil {
+		logger.Error("error persisting listen token", "error", err)
+		return "", err
+	}
+	return token, nil
+}
+
+// GetUser returns the user the token was issued to, or sql.ErrNoRows if there is none
+func (s TokenStore) GetUser(ctx context.Context, token string) (user.User, error) {
+	var u user.User
+	err := s.db.QueryRowContext(ctx,
+		`SELECT users.id, users.username
+		FROM listen_tokens
+		JOIN users ON users.id = listen_tokens.user_id
+		WHERE listen_tokens.token_hash=$1`, hashToken(token)).
+		Scan(&u.ID, &u.Username)
+	return u, err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s TokenStore) Reset(ctx context.Context) error {
+	logger := zlog.Logger(ctx)
+
+	if _, err := s.db.Exec(`
+	DROP TABLE IF EXISTS listen_tokens;
+	CREATE TABLE IF NOT EXISTS listen_tokens (
+		user_id    INTEGER PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`); err != nil {
+		logger.Error("error running reset sql", "error", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package listenbrainz
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+func TestTokenStore(t *testing.T) {
+	assert := assert.New(t)
+	f, err := os.CreateTemp("", "listenbrainz.*.db")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	db, err := zql.Sqlite3(f.Name())
+	assert.NoError(err)
+	defer db.Close()
+
+	ctx := context.Background()
+	users := user.NewStore(db)
+	assert.NoError(users.Reset(ctx))
+	store := NewTokenStore(db)
+	assert.NoError(store.Reset(ctx))
+
+	id, err := users.PersistUser(ctx, "zeke", "reyna", 1)
+	assert.NoError(err)
+
+	token, err := store.IssueToken(ctx, int(id))
+	assert.NoError(err)
+
+	u, err := store.GetUser(ctx, token)
+	assert.NoError(err)
+	assert.Equal("zeke", u.Username)
+	assert.Equal(int(id), u.ID)
+
+	// issuing again revokes the old token
+	newToken, err := store.IssueToken(ctx, int(id))
+	assert.NoError(err)
+	assert.NotEqual(token, newToken)
+	_, err = store.GetUser(ctx, token)
+	assert.ErrorIs(err, sql.ErrNoRows)
+	_, err = store.GetUser(ctx, newToken)
+	assert.NoError(err)
+}
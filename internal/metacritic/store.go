@@ -3,6 +3,7 @@ package metacritic
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/zestze/zest-backend/internal/user"
 	"github.com/zestze/zest-backend/internal/zql"
@@ -69,13 +70,16 @@ func (s Store) PersistPosts(ctx context.Context, posts []Post) ([]int64, error)
 func (s Store) GetPosts(ctx context.Context, opts Options) ([]Post, error) {
 	logger := zlog.Logger(ctx)
 
+	// released is a calendar date, so compare against the dates of the bounds
+	// rather than instants, which postgres would shift into its own timezone.
+	// years don't depend on the user's timezone, since neither does released.
 	lowerBound, upperBound := opts.RangeAsDate()
 	rows, err := s.db.QueryContext(ctx,
 		`SELECT id, title, href, score, description, released, created_at
 		FROM metacritic_posts 
-		WHERE medium = $1 and $2 <= released and released <= $3
+		WHERE medium = $1 and $2::date <= released and released <= $3::date
 		ORDER BY released DESC`,
-		opts.Medium, lowerBound, upperBound)
+		opts.Medium, lowerBound.Format(time.DateOnly), upperBound.Format(time.DateOnly))
 	if err != nil {
 		logger.Error("error querying for rows", "error", err)
 		return nil, err
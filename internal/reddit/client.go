@@ -2,6 +2,7 @@ package reddit
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -15,11 +16,23 @@ import (
 	"github.com/zestze/zest-backend/internal/zlog"
 )
 
-const defaultSecretsPath = "secrets/reddit_config.json"
+const (
+	defaultSecretsPath = "secrets/reddit_config.json"
+	userAgent          = "simpleRedditClient/0.1 by ZestyZeke"
+	// identity is needed to learn the username, and history to read saved posts
+	defaultScopes = "identity history"
+)
+
+var errUnauthorized = errors.New("access token was rejected")
 
+// Client is safe to share across users, who also share its rate limit
 type Client struct {
 	Client  *http.Client
 	secrets Secrets
+	tokens  *tokenCache
+	limiter *limiter
+	// first wait before retrying a failed request, doubling each time
+	backoff time.Duration
 }
 
 func NewClient(options ...func(*Client)) *Client {
@@ -28,6 +41,9 @@ func NewClient(options ...func(*Client)) *Client {
 			Timeout:   60 * time.Second,
 			Transport: http.DefaultTransport,
 		},
+		tokens:  newTokenCache(),
+		limiter: &limiter{},
+		backoff: defaultBackoff,
 	}
 
 	for _, o := range options {
@@ -66,20 +82,59 @@ func NewClientWithSecrets(roundTripper http.RoundTripper, secretsPath string) (C
 			Timeout:   60 * time.Second,
 		},
 		secrets: secrets,
+		tokens:  newTokenCache(),
+		limiter: &limiter{},
+		backoff: defaultBackoff,
 	}, nil
 }
 
-func (c Client) Fetch(ctx context.Context, grabAll bool) ([]Post, error) {
-	logger := zlog.Logger(ctx)
+// AuthorizeURL is where to send the user to grant us access to their reddit account.
+// see: https://github.com/reddit-archive/reddit/wiki/OAuth2#authorization
+func (c Client) AuthorizeURL(state string) string {
+	q := url.Values{}
+	q.Add("client_id", c.secrets.ClientId)
+	q.Add("response_type", "code")
+	q.Add("state", state)
+	q.Add("redirect_uri", c.secrets.RedirectURI)
+	q.Add("duration", "permanent")
+	q.Add("scope", defaultScopes)
+	return "https://www.reddit.com/api/v1/authorize?" + q.Encode()
+}
+
+// ExchangeCode trades the code reddit redirected back with for a permanent grant,
+// identifying the account it belongs to.
+func (c Client) ExchangeCode(ctx context.Context, code string) (Credentials, error) {
+	form := url.Values{}
+	form.Add("grant_type", "authorization_code")
+	form.Add("code", code)
+	form.Add("redirect_uri", c.secrets.RedirectURI)
+
+	authData, err := c.requestToken(ctx, form)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("ExchangeCode(): %w", err)
+	}
+	if authData.RefreshToken == "" {
+		return Credentials{}, fmt.Errorf("ExchangeCode(): no refresh token granted")
+	}
 
-	authData, err := c.authorize(ctx)
+	username, err := c.getUsername(ctx, authData)
 	if err != nil {
-		return nil, fmt.Errorf("Fetch(): error during Auth: %w", err)
+		return Credentials{}, fmt.Errorf("ExchangeCode(): %w", err)
 	}
-	logger.Info("successfully authenticated")
+	return Credentials{
+		Username:     username,
+		RefreshToken: authData.RefreshToken,
+		Scope:        authData.Scope,
+	}, nil
+}
+
+// Fetch pulls the user's saved posts, newest first, or every page of them if grabAll is set.
+// if a page fails, the posts from the pages before it are returned alongside the error.
+func (c Client) Fetch(ctx context.Context, creds Credentials, grabAll bool) ([]Post, error) {
+	logger := zlog.Logger(ctx)
 
 	logger.Info("going to pull")
-	apiResponse, err := c.getSavedPosts(ctx, authData, "")
+	apiResponse, err := c.getSavedPosts(ctx, creds, "")
 	if err != nil {
 		return nil, fmt.Errorf("Fetch(): error during Get: %w", err)
 	}
@@ -89,13 +144,14 @@ func (c Client) Fetch(ctx context.Context, grabAll bool) ([]Post, error) {
 	seen := map[string]bool{}
 	lastSeenPost := apiResponse.Data.After
 
-	for grabAll && !seen[lastSeenPost] {
+	// an empty after means there are no more pages
+	for grabAll && lastSeenPost != "" && !seen[lastSeenPost] {
 		seen[lastSeenPost] = true
 
 		logger.Info("going to pull", slog.String("lastSeenPost", lastSeenPost))
-		apiResponse, err := c.getSavedPosts(ctx, authData, lastSeenPost)
+		apiResponse, err := c.getSavedPosts(ctx, creds, lastSeenPost)
 		if err != nil {
-			return nil, fmt.Errorf("Fetch(): error during Get: %w", err)
+			return savedPosts, fmt.Errorf("Fetch(): error during Get: %w", err)
 		}
 
 		savedPosts = append(savedPosts, apiResponse.Posts()...)
@@ -108,12 +164,30 @@ func (c Client) Fetch(ctx context.Context, grabAll bool) ([]Post, error) {
 	return savedPosts, nil
 }
 
-func (c Client) authorize(ctx context.Context) (AuthResponse, error) {
+// accessToken returns a cached access token for the user, or authorizes for a new one
+func (c Client) accessToken(ctx context.Context, creds Credentials) (AuthResponse, error) {
+	if authData, ok := c.tokens.get(creds.RefreshToken); ok {
+		return authData, nil
+	}
+
+	authData, err := c.authorize(ctx, creds)
+	if err != nil {
+		return AuthResponse{}, err
+	}
+	zlog.Logger(ctx).Info("successfully authenticated")
+	c.tokens.put(creds.RefreshToken, authData)
+	return authData, nil
+}
+
+func (c Client) authorize(ctx context.Context, creds Credentials) (AuthResponse, error) {
 	postForm := url.Values{}
-	postForm.Add("grant_type", "password")
-	postForm.Add("username", c.secrets.Username)
-	postForm.Add("password", c.secrets.Password)
+	postForm.Add("grant_type", "refresh_token")
+	postForm.Add("refresh_token", creds.RefreshToken)
+
+	return c.requestToken(ctx, postForm)
+}
 
+func (c Client) requestToken(ctx context.Context, postForm url.Values) (AuthResponse, error) {
 	req, err := http.NewRequestWithContext(ctx,
 		http.MethodPost,
 		"https://www.reddit.com/api/v1/access_token",
@@ -124,9 +198,10 @@ func (c Client) authorize(ctx context.Context) (AuthResponse, error) {
 	}
 
 	req.SetBasicAuth(c.secrets.ClientId, c.secrets.ClientSecret)
-	req.Header.Add("User-Agent", "simpleRedditClient/0.1 by ZestyZeke")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("User-Agent", userAgent)
 
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return AuthResponse{}, fmt.Errorf("Authorize(): error making request: %w", err)
 	}
@@ -142,8 +217,64 @@ func (c Client) authorize(ctx context.Context) (AuthResponse, error) {
 	return authResponse, nil
 }
 
-func (c Client) getSavedPosts(ctx context.Context, authData AuthResponse, lastReceived string) (ApiResponse, error) {
-	fileToRequest := "/user/" + c.secrets.Username + "/saved?raw_json=1"
+// see: https://www.reddit.com/dev/api/#GET_api_v1_me
+func (c Client) getUsername(ctx context.Context, authData AuthResponse) (string, error) {
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodGet,
+		"https://oauth.reddit.com/api/v1/me",
+		nil)
+	if err != nil {
+		return "", fmt.Errorf("GetUsername(): error constructing request: %w", err)
+	}
+	req.Header.Add("User-Agent", userAgent)
+	req.Header.Add("Authorization", authData.TokenType+" "+authData.AccessToken)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("GetUsername(): error making request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GetUsername(): status code is not 200: %v", resp.StatusCode)
+	}
+
+	var me struct {
+		Name string `json:"name"`
+	}
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&me); err != nil {
+		return "", fmt.Errorf("GetUsername(): error decoding: %w", err)
+	}
+	if me.Name == "" {
+		return "", fmt.Errorf("GetUsername(): no username in response")
+	}
+	return me.Name, nil
+}
+
+func (c Client) getSavedPosts(
+	ctx context.Context, creds Credentials, lastReceived string,
+) (ApiResponse, error) {
+	authData, err := c.accessToken(ctx, creds)
+	if err != nil {
+		return ApiResponse{}, fmt.Errorf("GetSavedPosts(): error during Auth: %w", err)
+	}
+
+	apiResponse, err := c.getSavedPostsWith(ctx, authData, creds.Username, lastReceived)
+	if !errors.Is(err, errUnauthorized) {
+		return apiResponse, err
+	}
+
+	// the token was revoked or expired early, so try again once with a new one
+	c.tokens.drop(creds.RefreshToken)
+	if authData, err = c.accessToken(ctx, creds); err != nil {
+		return ApiResponse{}, fmt.Errorf("GetSavedPosts(): error during Auth: %w", err)
+	}
+	return c.getSavedPostsWith(ctx, authData, creds.Username, lastReceived)
+}
+
+func (c Client) getSavedPostsWith(
+	ctx context.Context, authData AuthResponse, username, lastReceived string,
+) (ApiResponse, error) {
+	fileToRequest := "/user/" + url.PathEscape(username) + "/saved?raw_json=1"
 
 	req, err := http.NewRequestWithContext(ctx,
 		http.MethodGet,
@@ -152,7 +283,7 @@ func (c Client) getSavedPosts(ctx context.Context, authData AuthResponse, lastRe
 	if err != nil {
 		return ApiResponse{}, fmt.Errorf("GetSavedPosts(): error constructing request: %w", err)
 	}
-	req.Header.Add("User-Agent", "simpleRedditClient/0.1 by ZestyZeke")
+	req.Header.Add("User-Agent", userAgent)
 	req.Header.Add("Authorization", authData.TokenType+" "+authData.AccessToken)
 
 	if lastReceived != "" {
@@ -161,12 +292,14 @@ func (c Client) getSavedPosts(ctx context.Context, authData AuthResponse, lastRe
 		req.URL.RawQuery = q.Encode()
 	}
 
-	resp, err := c.Client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return ApiResponse{}, fmt.Errorf("GetSavedPosts(): error making request: %w", err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ApiResponse{}, fmt.Errorf("GetSavedPosts(): %w", errUnauthorized)
+	} else if resp.StatusCode != http.StatusOK {
 		return ApiResponse{}, fmt.Errorf("GetSavedPosts(): status code is not 200: %v", resp.StatusCode)
 	}
 
@@ -178,6 +311,53 @@ func (c Client) getSavedPosts(ctx context.Context, authData AuthResponse, lastRe
 	return apiResponse, nil
 }
 
+// do makes the request once the rate limit allows it,
+// retrying with backoff if reddit is throttling us or having trouble.
+func (c Client) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	logger := zlog.Logger(ctx)
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := c.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		c.limiter.update(resp.Header)
+		if !retryable(resp.StatusCode) || attempt == maxRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		wait := backoff
+		backoff = min(2*backoff, maxBackoff)
+		logger.Warn("retrying reddit request", "status", resp.StatusCode,
+			"attempt", attempt+1, "url", req.URL.Path)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// the limiter holds every request back until we're allowed again
+			if d, ok := retryAfter(resp.Header); ok {
+				wait = d
+			}
+			c.limiter.exhaust(wait)
+			continue
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
 func loadSecrets(fname string) (Secrets, error) {
 	f, err := os.Open(fname)
 	if err != nil {
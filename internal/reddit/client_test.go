@@ -5,6 +5,7 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -16,7 +17,8 @@ import (
 
 func TestFetchPosts(t *testing.T) {
 	client := NewClient(WithRoundTripper(mockRT(t, "mock_api_response.json")))
-	posts, err := client.Fetch(context.Background(), false)
+	creds := Credentials{Username: "user", RefreshToken: "refresh"}
+	posts, err := client.Fetch(context.Background(), creds, false)
 	assert.NoError(t, err)
 	assert.True(t, len(posts) > 0)
 }
@@ -29,13 +31,51 @@ func TestFetchPosts_Actual(t *testing.T) {
 	secrets, err := loadSecrets("../../secrets/reddit_config.json")
 	assert.NoError(t, err)
 	client := NewClient(WithSecrets(secrets))
-	assert.NoError(t, err)
 
-	posts, err := client.Fetch(context.Background(), false)
+	creds := Credentials{
+		Username:     os.Getenv("REDDIT_USERNAME"),
+		RefreshToken: os.Getenv("REDDIT_REFRESH_TOKEN"),
+	}
+	if creds.RefreshToken == "" {
+		t.Skip("skipping as no reddit refresh token is set")
+	}
+
+	posts, err := client.Fetch(context.Background(), creds, false)
 	assert.NoError(t, err)
 	assert.True(t, len(posts) > 0)
 }
 
+func TestAuthorizeURL(t *testing.T) {
+	assert := assert.New(t)
+	client := NewClient(WithSecrets(Secrets{
+		ClientId:    "id",
+		RedirectURI: "https://zest.example/v1/reddit/callback",
+	}))
+
+	u, err := url.Parse(client.AuthorizeURL("some-state"))
+	assert.NoError(err)
+	assert.Equal("www.reddit.com", u.Host)
+
+	q := u.Query()
+	assert.Equal("id", q.Get("client_id"))
+	assert.Equal("code", q.Get("response_type"))
+	assert.Equal("some-state", q.Get("state"))
+	assert.Equal("https://zest.example/v1/reddit/callback", q.Get("redirect_uri"))
+	assert.Equal("permanent", q.Get("duration"))
+	assert.Equal(defaultScopes, q.Get("scope"))
+}
+
+func TestExchangeCode(t *testing.T) {
+	assert := assert.New(t)
+	client := NewClient(WithRoundTripper(mockRT(t, "mock_api_response.json")))
+
+	creds, err := client.ExchangeCode(context.Background(), "code")
+	assert.NoError(err)
+	assert.Equal("user", creds.Username)
+	assert.Equal("refresh", creds.RefreshToken)
+	assert.Equal(defaultScopes, creds.Scope)
+}
+
 // special mock bc reddit client authenticates _and_ fetches data
 func mockRT(t *testing.T, responseFile string) httptest.RoundTripFunc {
 	return httptest.RoundTripFunc(
@@ -43,6 +83,12 @@ func mockRT(t *testing.T, responseFile string) httptest.RoundTripFunc {
 			t.Helper()
 			// oauth.reddit.com indicates we are already authenticated
 			if strings.Contains(req.URL.Host, "oauth") {
+				if req.URL.Path == "/api/v1/me" {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       io.NopCloser(strings.NewReader(`{"name": "user"}`)),
+					}, nil
+				}
 				bs, err := os.ReadFile(responseFile)
 				assert.NoError(t, err)
 				return &http.Response{
@@ -51,13 +97,14 @@ func mockRT(t *testing.T, responseFile string) httptest.RoundTripFunc {
 				}, nil
 			}
 			// otherwise we need to authenticate
-			secrets := Secrets{
-				ClientId:     "id",
-				ClientSecret: "secret",
-				Username:     "user",
-				Password:     "password",
+			authResponse := AuthResponse{
+				AccessToken:  "access",
+				TokenType:    "bearer",
+				ExpiresIn:    3600,
+				Scope:        defaultScopes,
+				RefreshToken: "refresh",
 			}
-			bs, err := jsoniter.Marshal(secrets)
+			bs, err := jsoniter.Marshal(authResponse)
 			assert.NoError(t, err)
 			return &http.Response{
 				StatusCode: http.StatusOK,
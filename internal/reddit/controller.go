@@ -3,6 +3,7 @@ package reddit
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log/slog"
 	"net/http"
 	"time"
@@ -10,15 +11,17 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zgin"
 )
 
 type Controller struct {
 	Client api
 	Store  Store
+	Tokens TokenStore
 }
 
-func New(db *sql.DB, rt http.RoundTripper) (Controller, error) {
+func New(db *sql.DB, rt http.RoundTripper, keyring zcrypt.Keyring) (Controller, error) {
 	secrets, err := loadSecrets(defaultSecretsPath)
 	if err != nil {
 		return Controller{}, err
@@ -26,22 +29,148 @@ func New(db *sql.DB, rt http.RoundTripper) (Controller, error) {
 	return Controller{
 		Client: NewClient(WithSecrets(secrets), WithRoundTripper(rt)),
 		Store:  NewStore(db),
+		Tokens: NewTokenStore(db, keyring),
 	}, nil
 }
 
 type api interface {
-	Fetch(ctx context.Context, grabAll bool) ([]Post, error)
+	AuthorizeURL(state string) string
+	ExchangeCode(ctx context.Context, code string) (Credentials, error)
+	Fetch(ctx context.Context, creds Credentials, grabAll bool) ([]Post, error)
 }
 
 func (svc Controller) Register(r gin.IRouter, auth gin.HandlerFunc) {
 	g := r.Group("/reddit")
 	g.Use(auth)
+	g.GET("/authorize", zgin.WithUser(svc.authorize))
+	g.GET("/callback", zgin.WithUser(svc.callback))
+	g.GET("/account", zgin.WithUser(svc.getAccount))
+	g.DELETE("/account", zgin.WithUser(svc.deleteAccount))
 	g.GET("/posts", zgin.WithUser(svc.getPosts))
 	g.GET("/subreddits", zgin.WithUser(svc.getSubreddits))
 	g.POST("/refresh", zgin.WithUser(svc.refresh))
 	g.POST("/backfill", zgin.WithUser(svc.backfill))
 }
 
+func (svc Controller) authorize(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	state, err := svc.Tokens.CreateState(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("error creating oauth state", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"url": svc.Client.AuthorizeURL(state),
+	})
+}
+
+func (svc Controller) callback(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	ctx := c.Request.Context()
+
+	// set if the user declined, or something was wrong with our request
+	if reason := c.Query("error"); reason != "" {
+		logger.Warn("reddit authorization was not granted", "reason", reason)
+		zgin.BadRequest(c, "reddit authorization was not granted: "+reason)
+		return
+	}
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		zgin.BadRequest(c, "please provide code and state")
+		return
+	}
+
+	stateUserID, err := svc.Tokens.ConsumeState(ctx, state)
+	if errors.Is(err, ErrInvalidState) {
+		zgin.BadRequest(c, err.Error())
+		return
+	} else if err != nil {
+		zgin.InternalError(c)
+		return
+	}
+	// otherwise anyone could link their reddit account to whoever follows a callback url they started
+	if stateUserID != userID {
+		logger.Warn("reddit authorization was started by another user",
+			"user_id", userID, "state_user_id", stateUserID)
+		c.IndentedJSON(http.StatusForbidden, gin.H{
+			"error": "reddit authorization was started by another user",
+		})
+		return
+	}
+
+	creds, err := svc.Client.ExchangeCode(ctx, code)
+	if err != nil {
+		logger.Error("error exchanging reddit code", "error", err)
+		zgin.BadRequest(c, "code couldn't be exchanged for a reddit token")
+		return
+	}
+
+	if err := svc.Tokens.PersistCredentials(ctx, userID, creds); err != nil {
+		logger.Error("error persisting reddit credentials", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	logger.Info("successfully linked reddit account", "username", creds.Username)
+	c.IndentedJSON(http.StatusCreated, gin.H{
+		"status":  "ok",
+		"account": creds,
+	})
+}
+
+func (svc Controller) getAccount(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	creds, err := svc.Tokens.GetCredentials(c.Request.Context(), userID)
+	if errors.Is(err, ErrNoAccount) {
+		accountNotFound(c)
+		return
+	} else if err != nil {
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"account": creds,
+	})
+}
+
+func (svc Controller) deleteAccount(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	ok, err := svc.Tokens.DeleteCredentials(c.Request.Context(), userID)
+	if err != nil {
+		zgin.InternalError(c)
+		return
+	} else if !ok {
+		accountNotFound(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// loadCredentials loads the user's linked reddit account.
+// If it fails, a response has already been written.
+func (svc Controller) loadCredentials(
+	c *gin.Context, userID user.ID, logger *slog.Logger,
+) (Credentials, bool) {
+	creds, err := svc.Tokens.GetCredentials(c.Request.Context(), userID)
+	if errors.Is(err, ErrNoAccount) {
+		accountNotFound(c)
+		return Credentials{}, false
+	} else if err != nil {
+		logger.Error("error loading reddit credentials", "error", err)
+		zgin.InternalError(c)
+		return Credentials{}, false
+	}
+	return creds, true
+}
+
+func accountNotFound(c *gin.Context) {
+	c.IndentedJSON(http.StatusNotFound, gin.H{
+		"error": ErrNoAccount.Error(),
+	})
+}
+
 func (svc Controller) getPosts(c *gin.Context, userID user.ID, logger *slog.Logger) {
 	var (
 		savedPosts []Post
@@ -79,8 +208,13 @@ func (svc Controller) getSubreddits(c *gin.Context, userID user.ID, logger *slog
 }
 
 func (svc Controller) refresh(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	creds, ok := svc.loadCredentials(c, userID, logger)
+	if !ok {
+		return
+	}
+
 	ctx := c.Request.Context()
-	savedPosts, err := svc.Client.Fetch(ctx, false)
+	savedPosts, err := svc.Client.Fetch(ctx, creds, false)
 	if err != nil {
 		logger.Error("error fetching posts", "error", err)
 		zgin.InternalError(c)
@@ -89,19 +223,24 @@ func (svc Controller) refresh(c *gin.Context, userID user.ID, logger *slog.Logge
 
 	logger.Info("successfully fetched posts", slog.Int("num_posts", len(savedPosts)))
 
-	ids, err := svc.Store.PersistPosts(ctx, savedPosts, userID)
+	names, err := svc.Store.PersistPosts(ctx, savedPosts, userID)
 	if err != nil {
 		logger.Error("error persisting posts", "error", err)
 		zgin.InternalError(c)
 		return
 	}
 
-	logger.Info("successfully persisted posts", slog.Int("num_persisted", len(ids)))
+	logger.Info("successfully persisted posts", slog.Int("num_persisted", len(names)))
 
-	c.IndentedJSON(http.StatusOK, gin.H{"num_refreshed": len(ids)})
+	c.IndentedJSON(http.StatusOK, gin.H{"num_refreshed": len(names)})
 }
 
 func (svc Controller) backfill(c *gin.Context, userID int, logger *slog.Logger) {
+	creds, ok := svc.loadCredentials(c, userID, logger)
+	if !ok {
+		return
+	}
+
 	// TODO(zeke): to have this, the client needs to be updated.
 	// generally need to pass a start/stop.
 	// I _think_ the way it works, is
@@ -115,21 +254,28 @@ func (svc Controller) backfill(c *gin.Context, userID int, logger *slog.Logger)
 		// TODO(zeke): create a new context?
 		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
 		defer cancel()
-		savedPosts, err := svc.Client.Fetch(ctx, true)
-		if err != nil {
+		savedPosts, err := svc.Client.Fetch(ctx, creds, true)
+		if err != nil && len(savedPosts) == 0 {
 			logger.Error("error fetching posts", "error", err)
 			return
+		} else if err != nil {
+			// keep what was fetched before failing, rather than dropping all of it
+			logger.Error("error fetching posts, persisting those fetched so far",
+				"error", err, slog.Int("num_posts", len(savedPosts)))
+		} else {
+			logger.Info("successfully fetched posts", slog.Int("num_posts", len(savedPosts)))
 		}
 
-		logger.Info("successfully fetched posts", slog.Int("num_posts", len(savedPosts)))
-
-		ids, err := svc.Store.PersistPosts(ctx, savedPosts, userID)
+		// fetching may have used up the deadline
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+		names, err := svc.Store.PersistPosts(ctx, savedPosts, userID)
 		if err != nil {
 			logger.Error("error persisting posts", "error", err)
 			return
 		}
 
-		logger.Info("successfully persisted posts", slog.Int("num_persisted", len(ids)))
+		logger.Info("successfully persisted posts", slog.Int("num_persisted", len(names)))
 	}()
 
 	c.IndentedJSON(http.StatusAccepted, gin.H{
@@ -6,11 +6,13 @@ import (
 	"github.com/samber/lo"
 )
 
+// Secrets are read from secrets/reddit_config.json, e.g.
+// `{"ClientId": "...", "ClientSecret": "...", "RedirectURI": "https://<host>/v1/reddit/callback"}`
 type Secrets struct {
 	ClientId     string
 	ClientSecret string
-	Username     string
-	Password     string
+	// RedirectURI must match the one registered for the reddit app exactly
+	RedirectURI string
 }
 
 type AuthResponse struct {
@@ -18,6 +20,15 @@ type AuthResponse struct {
 	TokenType   string `json:"token_type"`
 	ExpiresIn   int    `json:"expires_in"`
 	Scope       string `json:"scope"`
+	// only set when exchanging an authorization code for a permanent grant
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Credentials are what's needed to sync a user's linked reddit account
+type Credentials struct {
+	Username     string `json:"username"`
+	RefreshToken string `json:"-"`
+	Scope        string `json:"scope"`
 }
 
 // TODO(zeke): store id!
@@ -0,0 +1,150 @@
+package reddit
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const (
+	maxRetries     = 5
+	defaultBackoff = time.Second
+	maxBackoff     = time.Minute
+	// refresh tokens a little early, so they don't expire mid request
+	tokenExpiryBuffer = time.Minute
+)
+
+// limiter tracks how many requests reddit says are left in the current window,
+// holding requests back until it resets once they run out.
+// see: https://support.reddithelp.com/hc/en-us/articles/16160319875092-Reddit-Data-API-Wiki
+type limiter struct {
+	mu        sync.Mutex
+	known     bool
+	remaining float64
+	resetAt   time.Time
+}
+
+// wait blocks until a request can be made, reserving it
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	var d time.Duration
+	if l.known && l.remaining < 1 {
+		d = time.Until(l.resetAt)
+	}
+	if d <= 0 {
+		l.remaining--
+		l.mu.Unlock()
+		return nil
+	}
+	l.mu.Unlock()
+
+	zlog.Logger(ctx).Warn("reddit rate limit reached, waiting for reset",
+		"wait", d.String())
+	if err := sleep(ctx, d); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// unknown until the next response says otherwise
+	l.known = false
+	return nil
+}
+
+// update records the limits reddit reports on every api response
+func (l *limiter) update(h http.Header) {
+	remaining, err := strconv.ParseFloat(h.Get("X-Ratelimit-Remaining"), 64)
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseFloat(h.Get("X-Ratelimit-Reset"), 64)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.known = true
+	l.remaining = remaining
+	l.resetAt = time.Now().Add(time.Duration(reset * float64(time.Second)))
+}
+
+// exhaust holds back every request for d, after being told to slow down
+func (l *limiter) exhaust(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.known = true
+	l.remaining = 0
+	l.resetAt = time.Now().Add(d)
+}
+
+// retryAfter is how long reddit asked us to wait, if it said
+func retryAfter(h http.Header) (time.Duration, bool) {
+	for _, key := range []string{"Retry-After", "X-Ratelimit-Reset"} {
+		if seconds, err := strconv.ParseFloat(h.Get(key), 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second)), true
+		}
+	}
+	return 0, false
+}
+
+func retryable(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type cachedToken struct {
+	auth      AuthResponse
+	expiresAt time.Time
+}
+
+// tokenCache holds access tokens until they expire, keyed by the refresh token they came from
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		tokens: make(map[string]cachedToken),
+	}
+}
+
+func (tc *tokenCache) get(key string) (AuthResponse, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	cached, ok := tc.tokens[key]
+	if !ok || time.Now().Add(tokenExpiryBuffer).After(cached.expiresAt) {
+		return AuthResponse{}, false
+	}
+	return cached.auth, true
+}
+
+func (tc *tokenCache) put(key string, auth AuthResponse) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.tokens[key] = cachedToken{
+		auth:      auth,
+		expiresAt: time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second),
+	}
+}
+
+func (tc *tokenCache) drop(key string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.tokens, key)
+}
@@ -0,0 +1,141 @@
+package reddit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zestze/zest-backend/internal/httptest"
+)
+
+// throttlingRT serves the mock response as the first page of saved posts,
+// and lets the test decide how later pages are answered
+func throttlingRT(
+	t *testing.T, auths *atomic.Int32, nextPage func(attempt int) *http.Response,
+) httptest.RoundTripFunc {
+	t.Helper()
+	var attempts atomic.Int32
+	return httptest.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if !strings.Contains(req.URL.Host, "oauth") {
+			auths.Add(1)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: io.NopCloser(strings.NewReader(
+					`{"access_token": "access", "token_type": "bearer", "expires_in": 3600}`)),
+			}, nil
+		}
+		if req.URL.Query().Get("after") == "" {
+			bs, err := os.ReadFile("mock_api_response.json")
+			assert.NoError(t, err)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"X-Ratelimit-Remaining": {"599.0"},
+					"X-Ratelimit-Reset":     {"300"},
+				},
+				Body: io.NopCloser(strings.NewReader(string(bs))),
+			}, nil
+		}
+		return nextPage(int(attempts.Add(1))), nil
+	})
+}
+
+func lastPage() *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"data": {"children": [], "after": ""}}`)),
+	}
+}
+
+func TestFetch_CachesToken(t *testing.T) {
+	assert := assert.New(t)
+	var auths atomic.Int32
+	client := NewClient(WithRoundTripper(throttlingRT(t, &auths, func(int) *http.Response {
+		return lastPage()
+	})))
+	creds := Credentials{Username: "user", RefreshToken: "refresh"}
+
+	ctx := context.Background()
+	for range 3 {
+		_, err := client.Fetch(ctx, creds, true)
+		assert.NoError(err)
+	}
+	assert.Equal(int32(1), auths.Load())
+
+	// each user has their own token
+	_, err := client.Fetch(ctx, Credentials{Username: "other", RefreshToken: "other"}, false)
+	assert.NoError(err)
+	assert.Equal(int32(2), auths.Load())
+}
+
+func TestFetch_RetriesThrottled(t *testing.T) {
+	assert := assert.New(t)
+	var auths atomic.Int32
+	client := NewClient(WithRoundTripper(throttlingRT(t, &auths, func(attempt int) *http.Response {
+		switch attempt {
+		case 1:
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"Retry-After": {"0.01"}},
+				Body:       http.NoBody,
+			}
+		case 2:
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody}
+		default:
+			return lastPage()
+		}
+	})))
+	client.backoff = time.Millisecond
+
+	posts, err := client.Fetch(context.Background(),
+		Credentials{Username: "user", RefreshToken: "refresh"}, true)
+	assert.NoError(err)
+	assert.Len(posts, 6)
+}
+
+func TestFetch_KeepsFetchedPages(t *testing.T) {
+	assert := assert.New(t)
+	var auths atomic.Int32
+	client := NewClient(WithRoundTripper(throttlingRT(t, &auths, func(int) *http.Response {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}
+	})))
+	client.backoff = time.Millisecond
+
+	posts, err := client.Fetch(context.Background(),
+		Credentials{Username: "user", RefreshToken: "refresh"}, true)
+	assert.Error(err)
+	assert.Len(posts, 6)
+}
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// nothing known yet, so nothing to wait for
+	l := &limiter{}
+	start := time.Now()
+	assert.NoError(l.wait(ctx))
+
+	l.update(http.Header{
+		"X-Ratelimit-Remaining": {"1.0"},
+		"X-Ratelimit-Reset":     {"0.05"},
+	})
+	assert.NoError(l.wait(ctx))
+	assert.Less(time.Since(start), 50*time.Millisecond)
+
+	// the last request was used up, so wait for the reset
+	assert.NoError(l.wait(ctx))
+	assert.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+
+	// waiting gives up with the context
+	l.exhaust(time.Hour)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(l.wait(ctx), context.DeadlineExceeded)
+}
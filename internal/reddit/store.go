@@ -3,7 +3,7 @@ package reddit
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"time"
 
 	"github.com/zestze/zest-backend/internal/zql"
 
@@ -20,32 +20,45 @@ func NewStore(db *sql.DB) Store {
 	}
 }
 
+// PersistPosts records the posts as saved by the user. posts are shared across users,
+// so the latest scores are kept for everyone, returning the names of the posts persisted.
 func (s Store) PersistPosts(
 	ctx context.Context, savedPosts []Post, userID int,
-) ([]int64, error) {
+) ([]string, error) {
 	logger := zlog.Logger(ctx)
 
-	stmt, err := s.db.PrepareContext(ctx,
-		`INSERT INTO reddit_posts 
-		(permalink, subreddit, num_comments, upvote_ratio, ups, score,
+	thingStmt, err := s.db.PrepareContext(ctx,
+		`INSERT INTO reddit_things 
+		(name, permalink, subreddit, num_comments, upvote_ratio, ups, score,
 		total_awards_received, suggested_sort,
-		title, name, created_utc, user_id,
+		title, created_utc,
 		link_title, body)
 		VALUES
-		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		ON CONFLICT (name)
 			DO UPDATE SET 
+			num_comments=excluded.num_comments,
 			ups=excluded.ups,
 			score=excluded.score,
 			upvote_ratio=excluded.upvote_ratio,
 			link_title=excluded.link_title,
-			body=excluded.body
-		RETURNING id`)
+			body=excluded.body`)
 	if err != nil {
 		logger.Error("error preparing statement", "error", err)
 		return nil, err
 	}
-	defer stmt.Close()
+	defer thingStmt.Close()
+
+	// saved_seen_at is when the save was first synced, so is left alone after
+	saveStmt, err := s.db.PrepareContext(ctx,
+		`INSERT INTO reddit_saves (user_id, name, saved_seen_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, name) DO NOTHING`)
+	if err != nil {
+		logger.Error("error preparing statement", "error", err)
+		return nil, err
+	}
+	defer saveStmt.Close()
 
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -53,41 +66,44 @@ func (s Store) PersistPosts(
 		return nil, err
 	}
 
-	ids := make([]int64, 0, len(savedPosts))
+	now := time.Now().UTC()
+	names := make([]string, 0, len(savedPosts))
 	for _, post := range savedPosts {
-		var id int64
-		err := tx.Stmt(stmt).
-			QueryRowContext(ctx,
-				post.Permalink, post.Subreddit, post.NumComments,
-				post.UpvoteRatio, post.Ups, post.Score,
-				post.TotalAwardsReceived, post.SuggestedSort,
-				post.Title, post.Name, post.CreatedUTC,
-				userID,
-				post.LinkTitle, post.Body).
-			Scan(&id)
-		if err != nil && errors.Is(err, sql.ErrNoRows) {
-			continue
-		} else if err != nil {
+		if _, err := tx.Stmt(thingStmt).ExecContext(ctx,
+			post.Name, post.Permalink, post.Subreddit, post.NumComments,
+			post.UpvoteRatio, post.Ups, post.Score,
+			post.TotalAwardsReceived, post.SuggestedSort,
+			post.Title, post.CreatedUTC,
+			post.LinkTitle, post.Body); err != nil {
 			logger.Error("error persisting post", "permalink", post.Permalink,
 				"error", err)
 			return nil, zql.Rollback(tx, err)
 		}
 
-		ids = append(ids, id)
+		if _, err := tx.Stmt(saveStmt).ExecContext(ctx,
+			userID, post.Name, now); err != nil {
+			logger.Error("error persisting save", "name", post.Name,
+				"error", err)
+			return nil, zql.Rollback(tx, err)
+		}
+
+		names = append(names, post.Name)
 	}
 
-	return ids, tx.Commit()
+	return names, tx.Commit()
 }
 
 func (s Store) GetAllPosts(ctx context.Context, userID int) ([]Post, error) {
 	logger := zlog.Logger(ctx)
 
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT permalink, subreddit, score, title, name, 
-			created_utc, link_title, body
-		FROM reddit_posts 
-		WHERE user_id=$1
-		ORDER BY created_utc DESC
+		`SELECT reddit_things.permalink, reddit_things.subreddit, reddit_things.score,
+			reddit_things.title, reddit_things.name, reddit_things.created_utc,
+			reddit_things.link_title, reddit_things.body
+		FROM reddit_things
+		JOIN reddit_saves ON reddit_saves.name = reddit_things.name
+		WHERE reddit_saves.user_id=$1
+		ORDER BY reddit_things.created_utc DESC
 		LIMIT 100`,
 		userID)
 	if err != nil {
@@ -118,13 +134,15 @@ func (s Store) GetSubreddits(ctx context.Context, userID int) ([]string, error)
 	logger := zlog.Logger(ctx)
 
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT DISTINCT(subreddit)
-		FROM reddit_posts
-		WHERE user_id=$1
-		ORDER BY subreddit asc`,
+		`SELECT DISTINCT(reddit_things.subreddit)
+		FROM reddit_things
+		JOIN reddit_saves ON reddit_saves.name = reddit_things.name
+		WHERE reddit_saves.user_id=$1
+		ORDER BY reddit_things.subreddit asc`,
 		userID)
 	if err != nil {
 		logger.Error("error querying for rows", "error", err)
+		return nil, err
 	}
 	defer rows.Close()
 
@@ -146,11 +164,13 @@ func (s Store) GetPostsFor(ctx context.Context, subreddit string, userID int) ([
 	logger := zlog.Logger(ctx)
 
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT permalink, score, title, name, created_utc,
-			link_title, body
-		FROM reddit_posts 
-		WHERE subreddit=$1 AND user_id=$2
-		ORDER BY created_utc DESC`,
+		`SELECT reddit_things.permalink, reddit_things.score, reddit_things.title,
+			reddit_things.name, reddit_things.created_utc,
+			reddit_things.link_title, reddit_things.body
+		FROM reddit_things
+		JOIN reddit_saves ON reddit_saves.name = reddit_things.name
+		WHERE reddit_things.subreddit=$1 AND reddit_saves.user_id=$2
+		ORDER BY reddit_things.created_utc DESC`,
 		subreddit, userID)
 	if err != nil {
 		logger.Error("error querying for rows", "error", err)
@@ -182,11 +202,16 @@ func (s Store) Reset(ctx context.Context) error {
 	logger := zlog.Logger(ctx)
 
 	if _, err := s.db.Exec(`
-		DROP TABLE IF EXISTS reddit_posts;
-		CREATE TABLE IF NOT EXISTS reddit_posts (
-			id                    INTEGER PRIMARY KEY AUTOINCREMENT,
-			name                  TEXT UNIQUE,
-			user_id               INTEGER,
+		DROP TABLE IF EXISTS reddit_saves;
+		CREATE TABLE IF NOT EXISTS reddit_saves (
+			user_id       INTEGER,
+			name          TEXT,
+			saved_seen_at TEXT,
+			PRIMARY KEY (user_id, name)
+		);
+		DROP TABLE IF EXISTS reddit_things;
+		CREATE TABLE IF NOT EXISTS reddit_things (
+			name                  TEXT PRIMARY KEY,
 			permalink             TEXT,
 			subreddit             TEXT,
 			title                 TEXT,
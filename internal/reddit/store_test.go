@@ -27,9 +27,9 @@ func TestDB(t *testing.T) {
 	posts := mockFetchPosts(t, "mock_api_response.json")
 
 	userID := 1
-	ids, err := store.PersistPosts(ctx, posts, userID)
+	names, err := store.PersistPosts(ctx, posts, userID)
 	assert.NoError(err)
-	assert.Len(ids, 6)
+	assert.Len(names, 6)
 
 	persistedPosts, err := store.GetAllPosts(ctx, userID)
 	assert.NoError(err)
@@ -43,6 +43,32 @@ func TestDB(t *testing.T) {
 	subreddits, err := store.GetSubreddits(ctx, userID)
 	assert.NoError(err)
 	assert.Len(subreddits, 5)
+
+	// another user saving the same posts sees them too
+	otherID := 2
+	persistedPosts, err = store.GetAllPosts(ctx, otherID)
+	assert.NoError(err)
+	assert.Empty(persistedPosts)
+
+	names, err = store.PersistPosts(ctx, posts[:2], otherID)
+	assert.NoError(err)
+	assert.Len(names, 2)
+
+	persistedPosts, err = store.GetAllPosts(ctx, otherID)
+	assert.NoError(err)
+	assert.Len(persistedPosts, 2)
+
+	// without changing what the first user has saved
+	persistedPosts, err = store.GetAllPosts(ctx, userID)
+	assert.NoError(err)
+	assert.Len(persistedPosts, 6)
+
+	// resyncing is idempotent
+	_, err = store.PersistPosts(ctx, posts, userID)
+	assert.NoError(err)
+	persistedPosts, err = store.GetAllPosts(ctx, userID)
+	assert.NoError(err)
+	assert.Len(persistedPosts, 6)
 }
 
 func mockFetchPosts(t *testing.T, fname string) []Post {
@@ -0,0 +1,237 @@
+package reddit
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zcrypt"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+// how long the user has to grant access on reddit before the state is no longer accepted
+const stateTTL = 10 * time.Minute
+
+var (
+	ErrNoAccount    = errors.New("no linked reddit account")
+	ErrInvalidState = errors.New("invalid or expired oauth state")
+)
+
+type TokenStore struct {
+	db      *sql.DB
+	keyring zcrypt.Keyring
+}
+
+func NewTokenStore(db *sql.DB, keyring zcrypt.Keyring) TokenStore {
+	return TokenStore{
+		db:      db,
+		keyring: keyring,
+	}
+}
+
+// CreateState returns a random, single use state for the user to round trip through reddit,
+// so the callback can check that the user who started linking an account is the one finishing it.
+func (s TokenStore) CreateState(ctx context.Context, userID user.ID) (string, error) {
+	logger := zlog.Logger(ctx)
+
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		logger.Error("error generating state", "error", err)
+		return "", err
+	}
+	state := base64.RawURLEncoding.EncodeToString(bs)
+
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO reddit_oauth_states (state, user_id, expires_at)
+		VALUES ($1, $2, $3)`,
+		state, userID, time.Now().Add(stateTTL).UTC()); err != nil {
+		logger.Error("error persisting state", "error", err)
+		return "", err
+	}
+	return state, nil
+}
+
+// ConsumeState returns the user the state was created for, and makes sure it can't be used again
+func (s TokenStore) ConsumeState(ctx context.Context, state string) (user.ID, error) {
+	logger := zlog.Logger(ctx)
+
+	var (
+		userID    user.ID
+		expiresAt time.Time
+	)
+	err := s.db.QueryRowContext(ctx,
+		`DELETE FROM reddit_oauth_states
+		WHERE state=$1
+		RETURNING user_id, expires_at`, state).
+		Scan(&userID, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidState
+	} else if err != nil {
+		logger.Error("error consuming state", "error", err)
+		return 0, err
+	}
+
+	if time.Now().After(expiresAt) {
+		return 0, ErrInvalidState
+	}
+	return userID, nil
+}
+
+// PersistCredentials links the reddit account to the user, replacing any previously linked one
+func (s TokenStore) PersistCredentials(ctx context.Context, userID user.ID, creds Credentials) error {
+	logger := zlog.Logger(ctx)
+
+	keyID, refresh, err := s.keyring.Seal(creds.RefreshToken)
+	if err != nil {
+		logger.Error("error encrypting refresh token", "error", err)
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO reddit_tokens
+		(user_id, username, refresh_token, scope, key_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id)
+			DO UPDATE SET
+			username=excluded.username,
+			refresh_token=excluded.refresh_token,
+			scope=excluded.scope,
+			key_id=excluded.key_id`,
+		userID, creds.Username, refresh, creds.Scope, keyID); err != nil {
+		logger.Error("error persisting reddit tokens", "error", err)
+		return err
+	}
+	return nil
+}
+
+// GetCredentials loads the user's linked reddit account, or ErrNoAccount if there isn't one
+func (s TokenStore) GetCredentials(ctx context.Context, userID user.ID) (Credentials, error) {
+	logger := zlog.Logger(ctx)
+
+	var (
+		creds Credentials
+		keyID string
+	)
+	err := s.db.QueryRowContext(ctx,
+		`SELECT username, refresh_token, scope, key_id
+		FROM reddit_tokens
+		WHERE user_id=$1`, userID).
+		Scan(&creds.Username, &creds.RefreshToken, &creds.Scope, &keyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Credentials{}, ErrNoAccount
+	} else if err != nil {
+		logger.Error("encountered internal error when scanning reddit auth", "error", err)
+		return Credentials{}, err
+	}
+
+	if creds.RefreshToken, err = s.keyring.Open(keyID, creds.RefreshToken); err != nil {
+		logger.Error("error decrypting refresh token", "error", err)
+		return Credentials{}, err
+	}
+	return creds, nil
+}
+
+// DeleteCredentials unlinks the user's reddit account, reporting if there was one.
+// saved posts already synced are kept.
+func (s TokenStore) DeleteCredentials(ctx context.Context, userID user.ID) (bool, error) {
+	logger := zlog.Logger(ctx)
+
+	res, err := s.db.ExecContext(ctx,
+		`DELETE FROM reddit_tokens WHERE user_id=$1`, userID)
+	if err != nil {
+		logger.Error("error deleting reddit tokens", "error", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Rotate re-encrypts every refresh token not already under the keyring's current key,
+// returning the number of rows updated.
+func (s TokenStore) Rotate(ctx context.Context) (int, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT user_id, refresh_token, key_id
+		FROM reddit_tokens
+		WHERE key_id <> $1`, s.keyring.CurrentID())
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	type sealedRow struct {
+		userID  user.ID
+		refresh string
+		keyID   string
+	}
+	toRotate := make([]sealedRow, 0)
+	for rows.Next() {
+		var r sealedRow
+		if err = rows.Scan(&r.userID, &r.refresh, &r.keyID); err != nil {
+			return 0, err
+		}
+		toRotate = append(toRotate, r)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, r := range toRotate {
+		keyID, refresh, err := s.keyring.Reseal(r.keyID, r.refresh)
+		if err != nil {
+			logger.Error("error resealing refresh token", "user_id", r.userID, "error", err)
+			return rotated, err
+		}
+
+		// if zero, the account was relinked (and so re-encrypted) underneath us
+		res, err := s.db.ExecContext(ctx,
+			`UPDATE reddit_tokens
+			SET refresh_token=$1, key_id=$2
+			WHERE user_id=$3 AND refresh_token=$4`,
+			refresh, keyID, r.userID, r.refresh)
+		if err != nil {
+			logger.Error("error updating token", "user_id", r.userID, "error", err)
+			return rotated, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return rotated, err
+		}
+		rotated += int(n)
+	}
+	return rotated, nil
+}
+
+func (s TokenStore) Reset(ctx context.Context) error {
+	logger := zlog.Logger(ctx)
+
+	if _, err := s.db.Exec(`
+		DROP TABLE IF EXISTS reddit_tokens;
+		CREATE TABLE IF NOT EXISTS reddit_tokens (
+			user_id       INTEGER PRIMARY KEY,
+			username      TEXT,
+			refresh_token TEXT,
+			scope         TEXT,
+			key_id        TEXT
+		);
+		DROP TABLE IF EXISTS reddit_oauth_states;
+		CREATE TABLE IF NOT EXISTS reddit_oauth_states (
+			state      TEXT PRIMARY KEY,
+			user_id    INTEGER,
+			expires_at TEXT
+		);`); err != nil {
+		logger.Error("error running reset sql", "error", err)
+		return err
+	}
+	return nil
+}
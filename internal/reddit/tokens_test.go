@@ -0,0 +1,102 @@
+package reddit
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zestze/zest-backend/internal/zcrypt"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+func TestTokenStore(t *testing.T) {
+	assert := assert.New(t)
+	f, err := os.CreateTemp("", "reddit.*.db")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	db, err := zql.Sqlite3(f.Name())
+	assert.NoError(err)
+	defer db.Close()
+	store := NewTokenStore(db, zcrypt.ForTesting())
+
+	ctx := context.Background()
+	assert.NoError(store.Reset(ctx))
+
+	userID := 1
+	_, err = store.GetCredentials(ctx, userID)
+	assert.ErrorIs(err, ErrNoAccount)
+
+	creds := Credentials{Username: "user", RefreshToken: "refresh", Scope: defaultScopes}
+	assert.NoError(store.PersistCredentials(ctx, userID, creds))
+
+	var rawRefresh string
+	assert.NoError(db.QueryRowContext(ctx,
+		`SELECT refresh_token FROM reddit_tokens WHERE user_id=$1`, userID).
+		Scan(&rawRefresh))
+	assert.NotEqual(creds.RefreshToken, rawRefresh)
+
+	loaded, err := store.GetCredentials(ctx, userID)
+	assert.NoError(err)
+	assert.Equal(creds, loaded)
+
+	// relinking replaces the account
+	relinked := Credentials{Username: "other", RefreshToken: "refresh2", Scope: defaultScopes}
+	assert.NoError(store.PersistCredentials(ctx, userID, relinked))
+	loaded, err = store.GetCredentials(ctx, userID)
+	assert.NoError(err)
+	assert.Equal(relinked, loaded)
+
+	// nothing to do, already under the current key
+	n, err := store.Rotate(ctx)
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	ok, err := store.DeleteCredentials(ctx, userID)
+	assert.NoError(err)
+	assert.True(ok)
+	ok, err = store.DeleteCredentials(ctx, userID)
+	assert.NoError(err)
+	assert.False(ok)
+	_, err = store.GetCredentials(ctx, userID)
+	assert.ErrorIs(err, ErrNoAccount)
+}
+
+func TestTokenStore_States(t *testing.T) {
+	assert := assert.New(t)
+	f, err := os.CreateTemp("", "reddit.*.db")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	db, err := zql.Sqlite3(f.Name())
+	assert.NoError(err)
+	defer db.Close()
+	store := NewTokenStore(db, zcrypt.ForTesting())
+
+	ctx := context.Background()
+	assert.NoError(store.Reset(ctx))
+
+	state, err := store.CreateState(ctx, 1)
+	assert.NoError(err)
+	assert.NotEmpty(state)
+
+	userID, err := store.ConsumeState(ctx, state)
+	assert.NoError(err)
+	assert.Equal(1, userID)
+
+	// states are single use
+	_, err = store.ConsumeState(ctx, state)
+	assert.ErrorIs(err, ErrInvalidState)
+
+	_, err = store.ConsumeState(ctx, "made-up")
+	assert.ErrorIs(err, ErrInvalidState)
+
+	_, err = db.ExecContext(ctx,
+		`INSERT INTO reddit_oauth_states (state, user_id, expires_at) VALUES ($1, $2, $3)`,
+		"expired", 1, time.Now().Add(-time.Minute).UTC())
+	assert.NoError(err)
+	_, err = store.ConsumeState(ctx, "expired")
+	assert.ErrorIs(err, ErrInvalidState)
+}
@@ -0,0 +1,288 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+var ErrNoAccount = errors.New("no linked spotify account")
+
+// Listener scopes history to one of the user's linked spotify accounts,
+// or to every account merged together if AccountID is zero.
+type Listener struct {
+	UserID    int
+	AccountID int
+}
+
+// AllAccounts merges history across every account the user has linked
+func AllAccounts(userID int) Listener {
+	return Listener{UserID: userID}
+}
+
+// nullAccount is the account plays are tagged with, NULL if not scoped to an account
+func (l Listener) nullAccount() sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(l.AccountID), Valid: l.AccountID != 0}
+}
+
+// Account is a spotify account linked to a zest user
+type Account struct {
+	ID int `json:"id"`
+	// SpotifyID is empty for accounts linked before ids were recorded,
+	// until they're next refreshed
+	SpotifyID   string    `json:"spotify_id"`
+	DisplayName string    `json:"display_name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type AccountStore struct {
+	db *sql.DB
+}
+
+func NewAccountStore(db *sql.DB) AccountStore {
+	return AccountStore{
+		db: db,
+	}
+}
+
+// LinkAccount records the spotify user as one of the user's accounts, returning the account.
+// relinking an account updates it in place, and the first new spotify user
+// claims any account that was linked before spotify ids were recorded.
+func (s AccountStore) LinkAccount(ctx context.Context, userID int, me UserObject) (Account, error) {
+	logger := zlog.Logger(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return Account{}, err
+	}
+
+	var a Account
+	err = tx.QueryRowContext(ctx, `
+UPDATE spotify_accounts
+SET display_name = $3
+WHERE user_id = $1 AND spotify_id = $2
+RETURNING id, created_at`,
+		userID, me.ID, me.DisplayName).Scan(&a.ID, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, `
+UPDATE spotify_accounts
+SET spotify_id = $2, display_name = $3
+WHERE id = (
+	SELECT id
+	FROM spotify_accounts
+	WHERE user_id = $1 AND spotify_id IS NULL
+	ORDER BY id
+	LIMIT 1
+)
+RETURNING id, created_at`,
+			userID, me.ID, me.DisplayName).Scan(&a.ID, &a.CreatedAt)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, `
+INSERT INTO spotify_accounts
+(user_id, spotify_id, display_name)
+VALUES
+($1, $2, $3)
+RETURNING id, created_at`,
+			userID, me.ID, me.DisplayName).Scan(&a.ID, &a.CreatedAt)
+	}
+	if err != nil {
+		logger.Error("error linking spotify account", "error", err)
+		return Account{}, zql.Rollback(tx, err)
+	}
+
+	a.SpotifyID, a.DisplayName = me.ID, me.DisplayName
+	return a, tx.Commit()
+}
+
+// GetAccounts returns the listener's account, or every account the user has linked, oldest first
+func (s AccountStore) GetAccounts(ctx context.Context, listener Listener) ([]Account, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, COALESCE(spotify_id, ''), display_name, created_at
+FROM spotify_accounts
+WHERE user_id = $1 AND ($2 = 0 OR id = $2)
+ORDER BY id`, listener.UserID, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]Account, 0)
+	for rows.Next() {
+		var a Account
+		if err = rows.Scan(&a.ID, &a.SpotifyID, &a.DisplayName, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// Resolve picks the account to use for requests that need a single account,
+// which is the user's oldest account when merging across accounts.
+// returns ErrNoAccount if the account doesn't belong to the user, or the user has none.
+func (s AccountStore) Resolve(ctx context.Context, listener Listener) (Listener, error) {
+	var accountID int
+	err := s.db.QueryRowContext(ctx, `
+SELECT id
+FROM spotify_accounts
+WHERE user_id = $1 AND ($2 = 0 OR id = $2)
+ORDER BY id
+LIMIT 1`, listener.UserID, listener.AccountID).Scan(&accountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Listener{}, ErrNoAccount
+	} else if err != nil {
+		zlog.Logger(ctx).Error("error resolving spotify account", "error", err)
+		return Listener{}, err
+	}
+	return Listener{UserID: listener.UserID, AccountID: accountID}, nil
+}
+
+// DeleteAccount unlinks the account and drops its tokens.
+// plays are kept without an account, except those at the same moment as a play that already has none.
+// returns false if the account doesn't belong to the user.
+func (s AccountStore) DeleteAccount(ctx context.Context, userID, accountID int) (bool, error) {
+	logger := zlog.Logger(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return false, err
+	}
+
+	// unlinking sets the plays' account to NULL, which would collide with these
+	for _, table := range []string{"spotify_played_tracks", "spotify_songs"} {
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf(`
+DELETE FROM %[1]v AS plays
+WHERE plays.user_id = $1 AND plays.account_id = $2
+	AND EXISTS (
+		SELECT 1
+		FROM %[1]v AS unlinked
+		WHERE unlinked.user_id = plays.user_id
+			AND unlinked.played_at = plays.played_at
+			AND unlinked.account_id IS NULL
+	)`, table), userID, accountID); err != nil {
+			logger.Error("error deleting colliding plays", "table", table, "error", err)
+			return false, zql.Rollback(tx, err)
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+DELETE FROM spotify_accounts
+WHERE user_id = $1 AND id = $2`, userID, accountID)
+	if err != nil {
+		logger.Error("error deleting spotify account", "error", err)
+		return false, zql.Rollback(tx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, zql.Rollback(tx, err)
+	}
+	return n > 0, tx.Commit()
+}
+
+type listenerHandler func(*gin.Context, Listener, *slog.Logger)
+
+// withListener scopes the handler to the account in the account_id query param,
+// or to every account the user has linked if there isn't one.
+func (svc Controller) withListener(f listenerHandler) gin.HandlerFunc {
+	return zgin.WithUser(func(c *gin.Context, userID user.ID, logger *slog.Logger) {
+		listener := AllAccounts(userID)
+		if raw := c.Query("account_id"); raw != "" {
+			accountID, err := strconv.Atoi(raw)
+			if err != nil || accountID <= 0 {
+				zgin.BadRequest(c, "account_id must be a positive integer")
+				return
+			}
+
+			listener.AccountID = accountID
+			logger = logger.With(slog.Int("account_id", accountID))
+			if _, err = svc.Accounts.Resolve(c.Request.Context(), listener); errors.Is(err, ErrNoAccount) {
+				accountNotFound(c)
+				return
+			} else if err != nil {
+				logger.Error("error resolving spotify account", "error", err)
+				zgin.InternalError(c)
+				return
+			}
+		}
+		f(c, listener, logger)
+	})
+}
+
+// resolveAccount resolves the single account to use for the request.
+// If it fails, a response has already been written.
+func (svc Controller) resolveAccount(
+	c *gin.Context, listener Listener, logger *slog.Logger,
+) (Listener, bool) {
+	listener, err := svc.Accounts.Resolve(c.Request.Context(), listener)
+	if errors.Is(err, ErrNoAccount) {
+		accountNotFound(c)
+		return Listener{}, false
+	} else if err != nil {
+		logger.Error("error resolving spotify account", "error", err)
+		zgin.InternalError(c)
+		return Listener{}, false
+	}
+	return listener, true
+}
+
+func accountNotFound(c *gin.Context) {
+	c.IndentedJSON(http.StatusNotFound, gin.H{
+		"error": ErrNoAccount.Error(),
+	})
+}
+
+func (svc Controller) getAccounts(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	accounts, err := svc.Accounts.GetAccounts(c.Request.Context(), AllAccounts(userID))
+	if err != nil {
+		logger.Error("error loading spotify accounts", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"accounts": accounts,
+	})
+}
+
+func (svc Controller) deleteAccount(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		zgin.BadRequest(c, "account id must be an integer")
+		return
+	}
+
+	ok, err := svc.Accounts.DeleteAccount(c.Request.Context(), userID, accountID)
+	if err != nil {
+		logger.Error("error deleting spotify account", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if !ok {
+		accountNotFound(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
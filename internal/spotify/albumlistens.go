@@ -0,0 +1,423 @@
+package spotify
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+const (
+	albumTracksPageSize = 50
+	// plays further apart than this are separate listens, even of the same album
+	albumListenGap         = 30 * time.Minute
+	defaultAlbumCompletion = 0.8
+)
+
+// AlbumTrack is a track as listed on an album, which may not be one we've played
+type AlbumTrack struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DiscNumber  int    `json:"disc_number"`
+	TrackNumber int    `json:"track_number"`
+	DurationMS  int    `json:"duration_ms"`
+}
+
+// GetAlbumTracks returns ok false if the album doesn't exist, which is the case for albums pulled from spotify.
+//
+// see: https://developer.spotify.com/documentation/web-api/reference/get-an-albums-tracks
+func (c Client) GetAlbumTracks(ctx context.Context, token AccessToken, id string) ([]AlbumTrack, bool, error) {
+	var tracks []AlbumTrack
+	for {
+		var page struct {
+			Items []AlbumTrack `json:"items"`
+			Total int          `json:"total"`
+		}
+		q := url.Values{
+			"limit":  {strconv.Itoa(albumTracksPageSize)},
+			"offset": {strconv.Itoa(len(tracks))},
+		}
+		status, err := c.get(ctx, token, "/albums/"+id+"/tracks", q, &page)
+		if status == http.StatusNotFound {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		tracks = append(tracks, page.Items...)
+		if len(page.Items) == 0 || len(tracks) >= page.Total {
+			return tracks, true, nil
+		}
+	}
+}
+
+// GetAlbumTracks returns the cached track lists of the albums, in album order.
+// albums we haven't cached are missing.
+// albums that were listed without any tracks are included, so they aren't fetched again.
+func (s ContextStore) GetAlbumTracks(ctx context.Context, ids []string) (map[string][]AlbumTrack, error) {
+	// albums listed before tracks_listed_at was recorded only have their tracks to go on
+	rows, err := s.db.QueryContext(ctx, `
+SELECT spotify_albums.id, spotify_album_tracks.track_id, spotify_album_tracks.name,
+	spotify_album_tracks.disc_number, spotify_album_tracks.track_number,
+	spotify_album_tracks.duration_ms
+FROM spotify_albums
+LEFT JOIN spotify_album_tracks ON spotify_album_tracks.album_id = spotify_albums.id
+WHERE spotify_albums.id = ANY($1)
+	AND (spotify_albums.tracks_listed_at IS NOT NULL OR spotify_album_tracks.track_id IS NOT NULL)
+ORDER BY spotify_albums.id, spotify_album_tracks.disc_number, spotify_album_tracks.track_number`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := make(map[string][]AlbumTrack)
+	for rows.Next() {
+		var (
+			albumID, trackID, name              sql.NullString
+			discNumber, trackNumber, durationMS sql.NullInt64
+		)
+		if err = rows.Scan(&albumID, &trackID, &name,
+			&discNumber, &trackNumber, &durationMS); err != nil {
+			return nil, err
+		}
+		if !trackID.Valid {
+			albums[albumID.String] = make([]AlbumTrack, 0)
+			continue
+		}
+		albums[albumID.String] = append(albums[albumID.String], AlbumTrack{
+			ID:          trackID.String,
+			Name:        name.String,
+			DiscNumber:  int(discNumber.Int64),
+			TrackNumber: int(trackNumber.Int64),
+			DurationMS:  int(durationMS.Int64),
+		})
+	}
+	return albums, rows.Err()
+}
+
+// PersistAlbumTracks caches the album's track list, which may be empty
+func (s ContextStore) PersistAlbumTracks(ctx context.Context, albumID string, tracks []AlbumTrack) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `
+UPDATE spotify_albums
+SET tracks_listed_at = now()
+WHERE id = $1`, albumID); err != nil {
+		return zql.Rollback(tx, err)
+	}
+	for _, t := range tracks {
+		if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_album_tracks
+(album_id, track_id, name, disc_number, track_number, duration_ms)
+VALUES
+($1, $2, $3, $4, $5, $6)
+ON CONFLICT
+	DO NOTHING`,
+			albumID, t.ID, t.Name, t.DiscNumber, t.TrackNumber, t.DurationMS); err != nil {
+			return zql.Rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// AlbumPlay is a play from an album's context
+type AlbumPlay struct {
+	PlayedAt  time.Time
+	AlbumID   string
+	TrackID   string
+	TrackName string
+}
+
+// GetAlbumPlays returns the plays in the range that were played from an album, oldest first
+func (s HistoryStore) GetAlbumPlays(
+	ctx context.Context, listener Listener, start, end time.Time,
+) ([]AlbumPlay, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT spotify_played_tracks.played_at, spotify_played_tracks.context_blob->>'uri',
+	spotify_tracks.id, spotify_tracks.name
+FROM spotify_played_tracks
+JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND spotify_played_tracks.context_blob->>'type' = $4
+	AND ($5 = 0 OR spotify_played_tracks.account_id = $5)
+ORDER BY spotify_played_tracks.played_at`,
+		listener.UserID, start, end, ContextAlbum, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	plays := make([]AlbumPlay, 0)
+	for rows.Next() {
+		var (
+			play AlbumPlay
+			uri  string
+		)
+		if err = rows.Scan(&play.PlayedAt, &uri, &play.TrackID, &play.TrackName); err != nil {
+			return nil, err
+		}
+		play.AlbumID = uri[strings.LastIndex(uri, ":")+1:]
+		plays = append(plays, play)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return plays, nil
+}
+
+// AlbumListen is one sitting of listening to an album
+type AlbumListen struct {
+	AlbumID   string    `json:"album_id"`
+	AlbumName string    `json:"album_name"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	// InOrder is how many of the album's tracks were played in album order
+	InOrder     int     `json:"in_order"`
+	TotalTracks int     `json:"total_tracks"`
+	Completion  float64 `json:"completion"`
+}
+
+type AlbumListenSummary struct {
+	AlbumID   string `json:"album_id"`
+	AlbumName string `json:"album_name"`
+	// Listens counts the complete listens of the album
+	Listens        int       `json:"listens"`
+	BestCompletion float64   `json:"best_completion"`
+	LastListened   time.Time `json:"last_listened"`
+}
+
+// splitAlbumRuns splits plays into runs of the same album, without long gaps between plays
+func splitAlbumRuns(plays []AlbumPlay) [][]AlbumPlay {
+	var runs [][]AlbumPlay
+	for i, play := range plays {
+		if i == 0 || play.AlbumID != plays[i-1].AlbumID || play.PlayedAt.Sub(plays[i-1].PlayedAt) > albumListenGap {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], play)
+	}
+	return runs
+}
+
+// scoreAlbumRun measures how much of tracks the run played in order,
+// as the longest run of tracks played in increasing album position.
+func scoreAlbumRun(run []AlbumPlay, tracks []AlbumTrack) AlbumListen {
+	positions := make(map[string]int, len(tracks)*2)
+	for i, t := range tracks {
+		positions[t.ID] = i
+		// tracks can be relinked to a different id than the album lists, so fall back to names
+		if _, ok := positions[strings.ToLower(t.Name)]; !ok {
+			positions[strings.ToLower(t.Name)] = i
+		}
+	}
+
+	// longest strictly increasing subsequence of album positions, via patience sorting
+	var tails []int
+	for _, play := range run {
+		pos, ok := positions[play.TrackID]
+		if !ok {
+			if pos, ok = positions[strings.ToLower(play.TrackName)]; !ok {
+				continue
+			}
+		}
+		i, _ := slices.BinarySearch(tails, pos)
+		if i == len(tails) {
+			tails = append(tails, pos)
+		} else {
+			tails[i] = pos
+		}
+	}
+
+	listen := AlbumListen{
+		AlbumID:     run[0].AlbumID,
+		StartedAt:   run[0].PlayedAt,
+		EndedAt:     run[len(run)-1].PlayedAt,
+		InOrder:     len(tails),
+		TotalTracks: len(tracks),
+	}
+	if len(tracks) > 0 {
+		listen.Completion = float64(listen.InOrder) / float64(len(tracks))
+	}
+	return listen
+}
+
+// detectAlbumListens finds the runs that completed at least minCompletion of their album,
+// along with a summary per album, most listened first.
+func detectAlbumListens(
+	plays []AlbumPlay, tracklists map[string][]AlbumTrack, names map[string]string, minCompletion float64,
+) ([]AlbumListen, []AlbumListenSummary) {
+	listens := make([]AlbumListen, 0)
+	summaries := make(map[string]*AlbumListenSummary)
+	for _, run := range splitAlbumRuns(plays) {
+		listen := scoreAlbumRun(run, tracklists[run[0].AlbumID])
+		listen.AlbumName = names[listen.AlbumID]
+		if listen.TotalTracks == 0 || listen.Completion < minCompletion {
+			continue
+		}
+		listens = append(listens, listen)
+
+		summary, ok := summaries[listen.AlbumID]
+		if !ok {
+			summary = &AlbumListenSummary{AlbumID: listen.AlbumID, AlbumName: listen.AlbumName}
+			summaries[listen.AlbumID] = summary
+		}
+		summary.Listens++
+		summary.BestCompletion = max(summary.BestCompletion, listen.Completion)
+		if listen.EndedAt.After(summary.LastListened) {
+			summary.LastListened = listen.EndedAt
+		}
+	}
+
+	albums := make([]AlbumListenSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		albums = append(albums, *summary)
+	}
+	slices.SortFunc(albums, func(a, b AlbumListenSummary) int {
+		return cmp.Or(cmp.Compare(b.Listens, a.Listens), b.LastListened.Compare(a.LastListened))
+	})
+	return listens, albums
+}
+
+// albumTracklists loads the track lists and names of the albums, fetching and caching any we don't have.
+// at most maxContextLookups albums are fetched, so the rest may be missing.
+// albums spotify no longer has are cached without a name or tracks, and never count as listened to.
+func (svc Controller) albumTracklists(
+	ctx context.Context, listener Listener, albumIDs []string,
+) (map[string][]AlbumTrack, map[string]string, error) {
+	logger := zlog.Logger(ctx)
+
+	names, err := svc.Contexts.GetAlbumNames(ctx, albumIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	tracklists, err := svc.Contexts.GetAlbumTracks(ctx, albumIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var token AccessToken
+	lookups, skipped := 0, 0
+	for _, id := range albumIDs {
+		_, named := names[id]
+		_, listed := tracklists[id]
+		if named && listed {
+			continue
+		} else if lookups == maxContextLookups {
+			skipped++
+			continue
+		}
+		lookups++
+
+		if token.Access == "" {
+			// any of the user's accounts can look up albums
+			if listener, err = svc.Accounts.Resolve(ctx, listener); err != nil {
+				return nil, nil, err
+			}
+			if token, err = svc.fetchToken(ctx, listener); err != nil {
+				return nil, nil, err
+			}
+		}
+		// track lists reference the album, so it has to be stored first
+		available := true
+		if !named {
+			album, ok, err := svc.Client.GetAlbum(ctx, token, id)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error fetching album [%v]: %w", id, err)
+			} else if !ok {
+				logger.Warn("album isn't available", "album_id", id)
+				album = unavailableAlbum(id)
+				available = false
+			}
+			if err = svc.Contexts.PersistAlbum(ctx, album); err != nil {
+				return nil, nil, err
+			}
+			names[id] = album.Name
+		}
+		if !listed {
+			var tracks []AlbumTrack
+			if available {
+				var ok bool
+				tracks, ok, err = svc.Client.GetAlbumTracks(ctx, token, id)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error fetching tracks for album [%v]: %w", id, err)
+				} else if !ok {
+					logger.Warn("album tracks aren't available", "album_id", id)
+				}
+			}
+			if err = svc.Contexts.PersistAlbumTracks(ctx, id, tracks); err != nil {
+				return nil, nil, err
+			}
+			logger.Info("cached album tracks", "album_id", id, "num_tracks", len(tracks))
+			tracklists[id] = tracks
+		}
+	}
+	if skipped > 0 {
+		logger.Warn("too many albums to look up, leaving the rest for later",
+			"num_looked_up", lookups, "num_skipped", skipped)
+	}
+	return tracklists, names, nil
+}
+
+func (svc Controller) getAlbumListens(c *gin.Context, listener Listener, logger *slog.Logger) {
+	opts := struct {
+		Options
+		MinCompletion float64 `form:"min_completion"`
+	}{
+		MinCompletion: defaultAlbumCompletion,
+	}
+	if err := c.BindQuery(&opts); err != nil || opts.MinCompletion <= 0 || opts.MinCompletion > 1 {
+		logger.Error("error binding query for album listens", "error", err)
+		zgin.BadRequest(c, "please provide correct query params")
+		return
+	}
+	r, ok := svc.resolveStatsRange(c, listener.UserID, logger, opts.Options)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	plays, err := svc.History.GetAlbumPlays(ctx, listener, r.Start, r.End)
+	if err != nil {
+		logger.Error("error loading album plays", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	var albumIDs []string
+	for _, play := range plays {
+		if !slices.Contains(albumIDs, play.AlbumID) {
+			albumIDs = append(albumIDs, play.AlbumID)
+		}
+	}
+	tracklists, names, err := svc.albumTracklists(ctx, listener, albumIDs)
+	if err != nil {
+		logger.Error("error loading album track lists", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	listens, albums := detectAlbumListens(plays, tracklists, names, opts.MinCompletion)
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"start":   r.Start,
+		"end":     r.End,
+		"listens": listens,
+		"albums":  albums,
+	})
+}
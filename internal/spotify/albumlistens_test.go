@@ -0,0 +1,62 @@
+package spotify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectAlbumListens(t *testing.T) {
+	assert := assert.New(t)
+
+	tracks := []AlbumTrack{
+		{ID: "1", Name: "Black Out Days"},
+		{ID: "2", Name: "Fall in Love"},
+		{ID: "3", Name: "Don't Move"},
+		{ID: "4", Name: "Celebrating Nothing"},
+		{ID: "5", Name: "Howling at the Moon"},
+	}
+	start := time.Date(2024, 2, 10, 17, 0, 0, 0, time.UTC)
+	play := func(minutes int, albumID, trackID, name string) AlbumPlay {
+		return AlbumPlay{
+			PlayedAt: start.Add(time.Duration(minutes) * time.Minute),
+			AlbumID:  albumID, TrackID: trackID, TrackName: name,
+		}
+	}
+	plays := []AlbumPlay{
+		// everything in order, with a skip back that doesn't count, and a relinked track
+		play(0, "voices", "1", ""),
+		play(4, "voices", "2", ""),
+		play(8, "voices", "1", ""),
+		play(12, "voices", "relinked", "don't move"),
+		play(16, "voices", "4", ""),
+		play(20, "voices", "5", ""),
+		// a different album
+		play(24, "currents", "x", ""),
+		// the same album after a long break, only half of it
+		play(120, "voices", "1", ""),
+		play(124, "voices", "2", ""),
+	}
+	tracklists := map[string][]AlbumTrack{"voices": tracks}
+	names := map[string]string{"voices": "Voices"}
+
+	listens, albums := detectAlbumListens(plays, tracklists, names, defaultAlbumCompletion)
+	if assert.Len(listens, 1) {
+		assert.Equal(5, listens[0].InOrder)
+		assert.Equal(1.0, listens[0].Completion)
+		assert.Equal("Voices", listens[0].AlbumName)
+		assert.Equal(start.Add(20*time.Minute), listens[0].EndedAt)
+	}
+	if assert.Len(albums, 1) {
+		assert.Equal(1, albums[0].Listens)
+	}
+
+	// counting the half listen too
+	listens, albums = detectAlbumListens(plays, tracklists, names, 0.4)
+	assert.Len(listens, 2)
+	if assert.Len(albums, 1) {
+		assert.Equal(2, albums[0].Listens)
+		assert.Equal(1.0, albums[0].BestCompletion)
+	}
+}
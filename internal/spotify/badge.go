@@ -0,0 +1,190 @@
+package spotify
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const (
+	BadgeRecent = "recent"
+	BadgeTop    = "top"
+
+	// badges are embedded in other sites, so keep them fresh without rendering on every view
+	badgeMaxAge = 5 * time.Minute
+	// longer names are cut off so they fit on the card
+	badgeMaxRunes = 40
+	badgeTopDays  = 7
+)
+
+// Badge is what's shown on a public badge
+type Badge struct {
+	Label    string
+	Title    string
+	Subtitle string
+}
+
+var badgeTemplate = template.Must(template.New("badge").Funcs(template.FuncMap{
+	"text": func(s string) string {
+		return html.EscapeString(truncate(s, badgeMaxRunes))
+	},
+}).Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="360" height="84" viewBox="0 0 360 84" role="img" aria-label="{{text .Label}}: {{text .Title}}">
+<rect width="360" height="84" rx="8" fill="#121212"/>
+<text x="16" y="24" fill="#1db954" font-family="Helvetica,Arial,sans-serif" font-size="12">{{text .Label}}</text>
+<text x="16" y="48" fill="#ffffff" font-family="Helvetica,Arial,sans-serif" font-size="16" font-weight="bold">{{text .Title}}</text>
+<text x="16" y="70" fill="#b3b3b3" font-family="Helvetica,Arial,sans-serif" font-size="13">{{text .Subtitle}}</text>
+</svg>
+`))
+
+// truncate cuts s down to n runes, marking that it was cut off
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func renderBadge(b Badge) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := badgeTemplate.Execute(&buf, b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GetLastPlayedBadge describes the user's most recent play on any account, or false if they have none
+func (s HistoryStore) GetLastPlayedBadge(ctx context.Context, userID int, loc *time.Location) (Badge, bool, error) {
+	var (
+		badge    = Badge{Label: "Last played on Spotify"}
+		artist   string
+		playedAt time.Time
+	)
+	err := s.db.QueryRowContext(ctx, `
+SELECT spotify_tracks.name, COALESCE((
+		SELECT string_agg(spotify_artists.name, ', ' ORDER BY spotify_artists.name)
+		FROM spotify_credits
+		JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+		WHERE spotify_credits.track_id = spotify_tracks.id
+	), ''), spotify_played_tracks.played_at
+FROM spotify_played_tracks
+JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id
+WHERE spotify_played_tracks.user_id = $1
+ORDER BY spotify_played_tracks.played_at DESC
+LIMIT 1`, userID).Scan(&badge.Title, &artist, &playedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Badge{}, false, nil
+	} else if err != nil {
+		zlog.Logger(ctx).Error("error loading last played", "error", err)
+		return Badge{}, false, err
+	}
+
+	badge.Subtitle = artist + " · " + playedAt.In(loc).Format("Jan 2, 3:04 PM")
+	return badge, true, nil
+}
+
+// GetTopArtistBadge describes the artist the user played the most since, or false if they played nothing
+func (s HistoryStore) GetTopArtistBadge(ctx context.Context, userID int, since time.Time) (Badge, bool, error) {
+	var (
+		badge = Badge{Label: "Top artist this week on Spotify"}
+		plays int
+	)
+	err := s.db.QueryRowContext(ctx, `
+SELECT spotify_artists.name, COUNT(*)
+FROM spotify_played_tracks
+JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_played_tracks.played_at >= $2
+GROUP BY spotify_artists.id, spotify_artists.name
+ORDER BY 2 DESC, spotify_artists.name
+LIMIT 1`, userID, since).Scan(&badge.Title, &plays)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Badge{}, false, nil
+	} else if err != nil {
+		zlog.Logger(ctx).Error("error loading top artist", "error", err)
+		return Badge{}, false, err
+	}
+
+	badge.Subtitle = pluralize(plays, "play")
+	return badge, true, nil
+}
+
+func pluralize(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return strconv.Itoa(n) + " " + noun + "s"
+}
+
+// RegisterPublic adds routes that don't need auth. they only expose data users have opted in to sharing.
+func (svc Controller) RegisterPublic(r gin.IRouter) {
+	r.GET("/public/:username/spotify/badge.svg", svc.getBadge)
+}
+
+func (svc Controller) getBadge(c *gin.Context) {
+	ctx := c.Request.Context()
+	logger := zlog.Logger(ctx).With(slog.String("username", c.Param("username")))
+
+	kind := c.DefaultQuery("type", BadgeRecent)
+	if kind != BadgeRecent && kind != BadgeTop {
+		zgin.BadRequest(c, "type must be one of "+BadgeRecent+" or "+BadgeTop)
+		return
+	}
+
+	// users that don't exist look the same as users that haven't opted in
+	userID, settings, err := svc.Users.GetPublicSettings(ctx, c.Param("username"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !settings.PublicBadge) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{
+			"error": "no badge for this user",
+		})
+		return
+	} else if err != nil {
+		zgin.InternalError(c)
+		return
+	}
+	loc, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		logger.Error("error loading user location", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	var (
+		badge Badge
+		ok    bool
+	)
+	if kind == BadgeTop {
+		badge, ok, err = svc.History.GetTopArtistBadge(ctx, userID, time.Now().AddDate(0, 0, -badgeTopDays))
+	} else {
+		badge, ok, err = svc.History.GetLastPlayedBadge(ctx, userID, loc)
+	}
+	if err != nil {
+		logger.Error("error loading badge", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if !ok {
+		badge = Badge{Label: "Spotify", Title: "Nothing played yet"}
+	}
+
+	svg, err := renderBadge(badge)
+	if err != nil {
+		logger.Error("error rendering badge", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(badgeMaxAge.Seconds())))
+	c.Data(http.StatusOK, "image/svg+xml; charset=utf-8", svg)
+}
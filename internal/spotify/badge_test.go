@@ -0,0 +1,41 @@
+package spotify
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderBadge(t *testing.T) {
+	assert := assert.New(t)
+
+	svg, err := renderBadge(Badge{
+		Label:    "Last played on Spotify",
+		Title:    `Don't <Move> & "Stay"`,
+		Subtitle: strings.Repeat("Phantogram ", 10),
+	})
+	assert.NoError(err)
+
+	// names are escaped, so the badge is still valid xml
+	decoder := xml.NewDecoder(strings.NewReader(string(svg)))
+	for {
+		_, err := decoder.Token()
+		if err != nil {
+			assert.ErrorContains(err, "EOF")
+			break
+		}
+	}
+	assert.Contains(string(svg), "Don&#39;t &lt;Move&gt; &amp; &#34;Stay&#34;")
+	assert.NotContains(string(svg), strings.Repeat("Phantogram ", 10))
+}
+
+func TestTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Sigur Rós", truncate("Sigur Rós", 9))
+	assert.Equal("Sigur R…", truncate("Sigur Rós", 8))
+	assert.Equal("1 play", pluralize(1, "play"))
+	assert.Equal("2 plays", pluralize(2, "play"))
+}
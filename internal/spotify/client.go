@@ -14,7 +14,11 @@ import (
 	jsoniter "github.com/json-iterator/go"
 )
 
-const defaultSecretsPath = "secrets/spotify_config.json"
+const (
+	defaultSecretsPath = "secrets/spotify_config.json"
+	// max page size allowed by the recently played endpoint
+	recentlyPlayedLimit = 50
+)
 
 var ErrTokenExpired = errors.New("access token expired")
 
@@ -104,40 +108,77 @@ func (c Client) doRequestToken(ctx context.Context, form url.Values) (AccessToke
 func (c Client) GetRecentlyPlayed(
 	ctx context.Context, token AccessToken, after time.Time,
 ) ([]PlayHistoryObject, error) {
+	apiResponse, err := c.GetRecentlyPlayedPage(ctx, token, Cursor{After: after})
+	if err != nil {
+		return nil, err
+	}
+	return apiResponse.Items, nil
+}
+
+// Cursor positions a recently played request. spotify only allows one of After or Before,
+// and if neither is set the most recent plays are returned.
+type Cursor struct {
+	After  time.Time
+	Before time.Time
+}
+
+// GetRecentlyPlayedPage is like GetRecentlyPlayed but returns the whole response,
+// so that callers can follow the cursors.
+func (c Client) GetRecentlyPlayedPage(
+	ctx context.Context, token AccessToken, cursor Cursor,
+) (ApiResponse, error) {
+	q := url.Values{}
+	q.Add("limit", strconv.Itoa(recentlyPlayedLimit))
+	if !cursor.After.IsZero() {
+		q.Add("after", strconv.FormatInt(cursor.After.UnixMilli(), 10))
+	} else if !cursor.Before.IsZero() {
+		q.Add("before", strconv.FormatInt(cursor.Before.UnixMilli(), 10))
+	}
+
+	var apiResponse ApiResponse
+	if _, err := c.get(ctx, token, "/me/player/recently-played", q, &apiResponse); err != nil {
+		return ApiResponse{}, err
+	}
+	return apiResponse, nil
+}
+
+// get performs an authenticated GET against the spotify web api and decodes the body into out.
+// the status code is returned so callers can special case things like 204s.
+func (c Client) get(
+	ctx context.Context, token AccessToken, path string, q url.Values, out any,
+) (int, error) {
 	if token.Expired() {
-		return nil, ErrTokenExpired
+		return 0, ErrTokenExpired
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
-		"https://api.spotify.com/v1/me/player/recently-played", nil)
+		"https://api.spotify.com/v1"+path, nil)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	req.Header.Add("Authorization", "Bearer "+token.Access)
-
-	q := req.URL.Query()
-	q.Add("limit", "50")
-	q.Add("after", strconv.FormatInt(after.UnixMilli(), 10))
-	req.URL.RawQuery = q.Encode()
+	if q != nil {
+		req.URL.RawQuery = q.Encode()
+	}
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusNoContent {
+		return resp.StatusCode, nil
+	} else if resp.StatusCode != http.StatusOK {
 		bs, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, err
+			return resp.StatusCode, err
 		}
-		return nil, fmt.Errorf("error from spotify api, status: [%v], body: [%v]",
+		return resp.StatusCode, fmt.Errorf("error from spotify api, status: [%v], body: [%v]",
 			resp.StatusCode, string(bs))
 	}
 
-	var apiResponse ApiResponse
-	if err := jsoniter.NewDecoder(resp.Body).Decode(&apiResponse); err != nil {
-		return nil, err
+	if err := jsoniter.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, err
 	}
-
-	return apiResponse.Items, nil
+	return resp.StatusCode, nil
 }
@@ -10,9 +10,14 @@ import (
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/zestze/zest-backend/internal/httptest"
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zql"
 )
 
+// shared so that tokens persisted by one integration test can be read by the next
+var testKeyring = zcrypt.ForTesting()
+
 func TestClient_MakeAuth(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test due to running in short mode")
@@ -35,14 +40,14 @@ func TestClient_MakeAuth(t *testing.T) {
 	assert.NoError(err)
 	defer db.Close()
 
-	store := NewStoreV1(db)
+	store := NewStoreV1(db, WithKeyring(testKeyring))
 
 	assert.NoError(store.Reset(ctx))
 
-	hardcodedID := 1
-	assert.NoError(store.PersistToken(ctx, token, hardcodedID))
+	hardcoded := Listener{UserID: 1, AccountID: 1}
+	assert.NoError(store.PersistToken(ctx, token, hardcoded))
 
-	token2, err := store.GetToken(ctx, hardcodedID)
+	token2, err := store.GetToken(ctx, hardcoded)
 	assert.NoError(err)
 
 	assert.Equal(token.Access, token2.Access)
@@ -57,11 +62,11 @@ func TestClient_FetchSongs(t *testing.T) {
 	assert.NoError(err)
 	defer db.Close()
 
-	store := NewStoreV1(db)
+	store := NewStoreV1(db, WithKeyring(testKeyring))
 
 	ctx := context.Background()
-	hardcodedID := 1
-	token, err := store.GetToken(ctx, hardcodedID)
+	hardcoded := Listener{UserID: 1, AccountID: 1}
+	token, err := store.GetToken(ctx, hardcoded)
 	assert.NoError(err)
 
 	fmt.Printf("original token: %+v\n", token)
@@ -74,7 +79,7 @@ func TestClient_FetchSongs(t *testing.T) {
 		token, err = client.RefreshAccess(ctx, token)
 		assert.NoError(err)
 		fmt.Printf("updated token: %+v\n", token)
-		err = store.PersistToken(ctx, token, hardcodedID)
+		err = store.PersistToken(ctx, token, hardcoded)
 		assert.NoError(err)
 	}
 
@@ -89,3 +94,78 @@ func TestClient_FetchSongs(t *testing.T) {
 	assert.True(len(items) > 0)
 	assert.NoError(jsoniter.NewEncoder(f).Encode(items))
 }
+
+func TestClient_GetCurrentlyPlaying(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	token := AccessToken{
+		Access:    "access",
+		Scope:     ScopeReadCurrentlyPlaying,
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	client := Client{Client: &http.Client{
+		Transport: httptest.MockRTWithFile(t, "mock_currently_playing.json"),
+	}}
+	playing, err := client.GetCurrentlyPlaying(ctx, token)
+	assert.NoError(err)
+	assert.True(playing.IsPlaying)
+	assert.NotNil(playing.Item)
+	assert.Equal("1BeNZQORyV0jEF2toAmrsA", playing.Item.ID)
+
+	// spotify responds with a 204 when nothing is playing
+	client = Client{Client: &http.Client{
+		Transport: httptest.RoundTripFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusNoContent,
+				Body:       http.NoBody,
+			}, nil
+		}),
+	}}
+	nothing, err := client.GetCurrentlyPlaying(ctx, token)
+	assert.NoError(err)
+	assert.False(nothing.IsPlaying)
+	assert.Nil(nothing.Item)
+
+	assert.True(playing.Changed(nothing))
+	assert.False(playing.Changed(playing))
+}
+
+func TestClient_GetAlbum(t *testing.T) {
+	assert := assert.New(t)
+	token := AccessToken{Access: "access", ExpiresAt: time.Now().Add(time.Hour)}
+
+	// albums pulled from spotify 404
+	client := Client{Client: &http.Client{
+		Transport: httptest.RoundTripFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusNotFound,
+				Body:       http.NoBody,
+			}, nil
+		}),
+	}}
+	_, ok, err := client.GetAlbum(context.Background(), token, "removed")
+	assert.NoError(err)
+	assert.False(ok)
+	_, ok, err = client.GetAlbumTracks(context.Background(), token, "removed")
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestClient_GetPlaylistTracks(t *testing.T) {
+	assert := assert.New(t)
+	token := AccessToken{Access: "access", ExpiresAt: time.Now().Add(time.Hour)}
+
+	// spotify's editorial playlists can be followed, but their tracks 403
+	client := Client{Client: &http.Client{
+		Transport: httptest.RoundTripFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusForbidden,
+				Body:       http.NoBody,
+			}, nil
+		}),
+	}}
+	_, ok, err := client.GetPlaylistTracks(context.Background(), token, "37i9dQZF1DXcBWIGoYBM5M")
+	assert.NoError(err)
+	assert.False(ok)
+}
@@ -0,0 +1,360 @@
+package spotify
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const (
+	KindTrack  = "track"
+	KindArtist = "artist"
+)
+
+// how an item moved between the two windows of a comparison.
+// new and dropped items weren't played at all in the other window, while items that
+// entered or exited were played, just not enough to make that window's top items.
+const (
+	MovementNew     = "new"
+	MovementEntered = "entered"
+	MovementDropped = "dropped"
+	MovementExited  = "exited"
+	MovementUp      = "up"
+	MovementDown    = "down"
+	MovementSame    = "same"
+)
+
+const (
+	PresetMonth       = "month"
+	PresetYear        = "year"
+	defaultCompareTop = 50
+)
+
+type RankedItem struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Rank    int     `json:"rank"`
+	Plays   int     `json:"plays"`
+	Minutes float64 `json:"minutes"`
+}
+
+// ItemDelta is how an item changed from window b to window a.
+// ranks are 0 when the item isn't in that window's top items, but minutes are always
+// for the whole window.
+type ItemDelta struct {
+	ID           string  `json:"id"`
+	Name         string  `json:"name"`
+	Movement     string  `json:"movement"`
+	RankA        int     `json:"rank_a"`
+	RankB        int     `json:"rank_b"`
+	RankChange   int     `json:"rank_change"`
+	MinutesA     float64 `json:"minutes_a"`
+	MinutesB     float64 `json:"minutes_b"`
+	MinutesDelta float64 `json:"minutes_delta"`
+}
+
+// itemTable returns the table for the kind of item, and the joins from plays needed to reach it.
+// artists get credit for the whole duration of each track they're on.
+func itemTable(kind string) (string, string, error) {
+	switch kind {
+	case KindTrack:
+		return "spotify_tracks", "", nil
+	case KindArtist:
+		return "spotify_artists", `
+JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id`, nil
+	default:
+		return "", "", fmt.Errorf("unknown kind [%v]", kind)
+	}
+}
+
+// GetTopItems ranks the tracks or artists played in the range by time listened
+func (s HistoryStore) GetTopItems(
+	ctx context.Context, listener Listener, kind string, start, end time.Time, limit int,
+) ([]RankedItem, error) {
+	logger := zlog.Logger(ctx)
+
+	item, joins, err := itemTable(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+SELECT %[1]v.id, %[1]v.name,
+	RANK() OVER (ORDER BY SUM(spotify_tracks.duration_ms) DESC),
+	COUNT(*), SUM(spotify_tracks.duration_ms) / 60000.0
+FROM spotify_played_tracks
+JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id%[2]v
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND ($5 = 0 OR spotify_played_tracks.account_id = $5)
+GROUP BY %[1]v.id, %[1]v.name
+ORDER BY 3, 4 DESC, %[1]v.name
+LIMIT $4`, item, joins),
+		listener.UserID, start, end, limit, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]RankedItem, 0)
+	for rows.Next() {
+		var item RankedItem
+		if err = rows.Scan(&item.ID, &item.Name, &item.Rank, &item.Plays, &item.Minutes); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// GetItemMinutes returns the minutes listened to each of the tracks or artists in the range,
+// leaving out any that weren't played.
+func (s HistoryStore) GetItemMinutes(
+	ctx context.Context, listener Listener, kind string, ids []string, start, end time.Time,
+) (map[string]float64, error) {
+	logger := zlog.Logger(ctx)
+
+	item, joins, err := itemTable(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+SELECT %[1]v.id, SUM(spotify_tracks.duration_ms) / 60000.0
+FROM spotify_played_tracks
+JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id%[2]v
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND %[1]v.id = ANY($4)
+	AND ($5 = 0 OR spotify_played_tracks.account_id = $5)
+GROUP BY %[1]v.id`, item, joins),
+		listener.UserID, start, end, ids, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	minutes := make(map[string]float64)
+	for rows.Next() {
+		var (
+			id string
+			m  float64
+		)
+		if err = rows.Scan(&id, &m); err != nil {
+			return nil, err
+		}
+		minutes[id] = m
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return minutes, nil
+}
+
+// compareRankings describes how each item in either ranking moved from b to a.
+// minutesA and minutesB are the minutes of every item in either ranking for each window,
+// so items just outside the top items are told apart from ones that weren't played.
+func compareRankings(a, b []RankedItem, minutesA, minutesB map[string]float64) []ItemDelta {
+	deltas := make(map[string]*ItemDelta)
+	get := func(item RankedItem) *ItemDelta {
+		d, ok := deltas[item.ID]
+		if !ok {
+			d = &ItemDelta{ID: item.ID, Name: item.Name}
+			deltas[item.ID] = d
+		}
+		return d
+	}
+	for _, item := range a {
+		get(item).RankA = item.Rank
+	}
+	for _, item := range b {
+		get(item).RankB = item.Rank
+	}
+
+	results := make([]ItemDelta, 0, len(deltas))
+	for _, d := range deltas {
+		d.MinutesA, d.MinutesB = minutesA[d.ID], minutesB[d.ID]
+		d.MinutesDelta = d.MinutesA - d.MinutesB
+		switch {
+		case d.RankB == 0 && d.MinutesB > 0:
+			d.Movement = MovementEntered
+		case d.RankB == 0:
+			d.Movement = MovementNew
+		case d.RankA == 0 && d.MinutesA > 0:
+			d.Movement = MovementExited
+		case d.RankA == 0:
+			d.Movement = MovementDropped
+		default:
+			// a lower rank is better, so moving from 5 to 2 is +3
+			d.RankChange = d.RankB - d.RankA
+			d.Movement = MovementSame
+			if d.RankChange > 0 {
+				d.Movement = MovementUp
+			} else if d.RankChange < 0 {
+				d.Movement = MovementDown
+			}
+		}
+		results = append(results, *d)
+	}
+
+	// in the order of window a, then whatever left the top items in the order of window b
+	slices.SortFunc(results, func(x, y ItemDelta) int {
+		if (x.RankA == 0) != (y.RankA == 0) {
+			if x.RankA == 0 {
+				return 1
+			}
+			return -1
+		}
+		if x.RankA != 0 {
+			return cmp.Or(cmp.Compare(x.RankA, y.RankA), cmp.Compare(x.Name, y.Name))
+		}
+		return cmp.Or(cmp.Compare(x.RankB, y.RankB), cmp.Compare(x.Name, y.Name))
+	})
+	return results
+}
+
+// presetWindows returns the current period so far as a, and the whole previous period as b
+func presetWindows(preset string, now time.Time) (Window, Window, error) {
+	var aStart, bStart time.Time
+	switch preset {
+	case PresetMonth:
+		aStart = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		bStart = aStart.AddDate(0, -1, 0)
+	case PresetYear:
+		aStart = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+		bStart = aStart.AddDate(-1, 0, 0)
+	default:
+		return Window{}, Window{}, fmt.Errorf("preset must be one of %v or %v", PresetMonth, PresetYear)
+	}
+	return Window{Start: aStart, End: now},
+		Window{Start: bStart, End: aStart.Add(-time.Microsecond)}, nil
+}
+
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type CompareOptions struct {
+	AStart string `form:"a_start"`
+	AEnd   string `form:"a_end"`
+	BStart string `form:"b_start"`
+	BEnd   string `form:"b_end"`
+	Preset string `form:"preset"`
+	Limit  int    `form:"limit"`
+}
+
+// Windows resolves the options in loc, either from a preset or from all four bounds
+func (opts CompareOptions) Windows(now time.Time, loc *time.Location) (Window, Window, error) {
+	if opts.Preset != "" {
+		return presetWindows(opts.Preset, now.In(loc))
+	}
+
+	var (
+		a, b Window
+		err  error
+	)
+	for _, bound := range []struct {
+		name     string
+		raw      string
+		out      *time.Time
+		endOfDay bool
+	}{
+		{"a_start", opts.AStart, &a.Start, false},
+		{"a_end", opts.AEnd, &a.End, true},
+		{"b_start", opts.BStart, &b.Start, false},
+		{"b_end", opts.BEnd, &b.End, true},
+	} {
+		if bound.raw == "" {
+			return Window{}, Window{}, fmt.Errorf("%v is required without a preset", bound.name)
+		}
+		if *bound.out, err = zgin.ParseTime(bound.raw, loc, bound.endOfDay); err != nil {
+			return Window{}, Window{}, fmt.Errorf("%v: %w", bound.name, err)
+		}
+	}
+	return a, b, nil
+}
+
+func (svc Controller) compare(c *gin.Context, listener Listener, logger *slog.Logger) {
+	opts := CompareOptions{
+		Limit: defaultCompareTop,
+	}
+	if err := c.BindQuery(&opts); err != nil || opts.Limit <= 0 {
+		logger.Error("error binding query for compare", "error", err)
+		zgin.BadRequest(c, "please provide correct query params")
+		return
+	}
+
+	ctx := c.Request.Context()
+	loc, err := svc.Users.GetLocation(ctx, listener.UserID)
+	if err != nil {
+		logger.Error("error loading user location", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	a, b, err := opts.Windows(time.Now(), loc)
+	if err != nil {
+		zgin.BadRequest(c, err.Error())
+		return
+	}
+
+	response := gin.H{
+		"a": a,
+		"b": b,
+	}
+	for _, kind := range []string{KindArtist, KindTrack} {
+		topA, err := svc.History.GetTopItems(ctx, listener, kind, a.Start, a.End, opts.Limit)
+		if err != nil {
+			logger.Error("error loading top items", "kind", kind, "error", err)
+			zgin.InternalError(c)
+			return
+		}
+		topB, err := svc.History.GetTopItems(ctx, listener, kind, b.Start, b.End, opts.Limit)
+		if err != nil {
+			logger.Error("error loading top items", "kind", kind, "error", err)
+			zgin.InternalError(c)
+			return
+		}
+
+		// minutes for everything in either ranking, including items outside one window's top
+		ids := make([]string, 0, len(topA)+len(topB))
+		for _, item := range slices.Concat(topA, topB) {
+			ids = append(ids, item.ID)
+		}
+		minutesA, err := svc.History.GetItemMinutes(ctx, listener, kind, ids, a.Start, a.End)
+		if err != nil {
+			logger.Error("error loading item minutes", "kind", kind, "error", err)
+			zgin.InternalError(c)
+			return
+		}
+		minutesB, err := svc.History.GetItemMinutes(ctx, listener, kind, ids, b.Start, b.End)
+		if err != nil {
+			logger.Error("error loading item minutes", "kind", kind, "error", err)
+			zgin.InternalError(c)
+			return
+		}
+
+		response[kind+"s"] = gin.H{
+			"a":      topA,
+			"b":      topB,
+			"deltas": compareRankings(topA, topB, minutesA, minutesB),
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, response)
+}
@@ -0,0 +1,83 @@
+package spotify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareRankings(t *testing.T) {
+	assert := assert.New(t)
+
+	a := []RankedItem{
+		{ID: "tame", Name: "Tame Impala", Rank: 1, Minutes: 90},
+		{ID: "phantogram", Name: "Phantogram", Rank: 2, Minutes: 60},
+		{ID: "big boi", Name: "Big Boi", Rank: 3, Minutes: 10},
+		{ID: "empire", Name: "Empire of the Sun", Rank: 4, Minutes: 9},
+	}
+	b := []RankedItem{
+		{ID: "phantogram", Name: "Phantogram", Rank: 1, Minutes: 120},
+		{ID: "tame", Name: "Tame Impala", Rank: 2, Minutes: 30},
+		{ID: "mgmt", Name: "MGMT", Rank: 3, Minutes: 20},
+		{ID: "cut copy", Name: "Cut Copy", Rank: 4, Minutes: 15},
+	}
+	// big boi and cut copy were played in the other window too, just not enough to chart
+	minutesA := map[string]float64{"tame": 90, "phantogram": 60, "big boi": 10, "empire": 9, "cut copy": 5}
+	minutesB := map[string]float64{"phantogram": 120, "tame": 30, "mgmt": 20, "cut copy": 15, "big boi": 8}
+
+	deltas := compareRankings(a, b, minutesA, minutesB)
+	if assert.Len(deltas, 6) {
+		assert.Equal(ItemDelta{
+			ID: "tame", Name: "Tame Impala", Movement: MovementUp,
+			RankA: 1, RankB: 2, RankChange: 1, MinutesA: 90, MinutesB: 30, MinutesDelta: 60,
+		}, deltas[0])
+		assert.Equal(MovementDown, deltas[1].Movement)
+		assert.Equal(-60.0, deltas[1].MinutesDelta)
+		assert.Equal(ItemDelta{
+			ID: "big boi", Name: "Big Boi", Movement: MovementEntered,
+			RankA: 3, MinutesA: 10, MinutesB: 8, MinutesDelta: 2,
+		}, deltas[2])
+		assert.Equal("empire", deltas[3].ID)
+		assert.Equal(MovementNew, deltas[3].Movement)
+		assert.Equal(ItemDelta{
+			ID: "mgmt", Name: "MGMT", Movement: MovementDropped,
+			RankB: 3, MinutesB: 20, MinutesDelta: -20,
+		}, deltas[4])
+		assert.Equal(ItemDelta{
+			ID: "cut copy", Name: "Cut Copy", Movement: MovementExited,
+			RankB: 4, MinutesA: 5, MinutesB: 15, MinutesDelta: -10,
+		}, deltas[5])
+	}
+}
+
+func TestCompareOptions_Windows(t *testing.T) {
+	assert := assert.New(t)
+	loc, err := time.LoadLocation("America/New_York")
+	assert.NoError(err)
+	// still march 31st in new york
+	now := time.Date(2024, 4, 1, 2, 0, 0, 0, time.UTC)
+
+	a, b, err := CompareOptions{Preset: PresetMonth}.Windows(now, loc)
+	assert.NoError(err)
+	assert.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, loc), a.Start)
+	assert.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, loc), b.Start)
+	assert.True(b.End.Before(a.Start))
+
+	a, b, err = CompareOptions{Preset: PresetYear}.Windows(now, loc)
+	assert.NoError(err)
+	assert.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, loc), a.Start)
+	assert.Equal(time.Date(2023, 1, 1, 0, 0, 0, 0, loc), b.Start)
+
+	a, b, err = CompareOptions{
+		AStart: "2024-03-01", AEnd: "2024-03-31", BStart: "2024-02-01", BEnd: "2024-02-29",
+	}.Windows(now, loc)
+	assert.NoError(err)
+	assert.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, loc), a.Start)
+	assert.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, loc).Add(-time.Microsecond), b.End)
+
+	_, _, err = CompareOptions{AStart: "2024-03-01"}.Windows(now, loc)
+	assert.Error(err)
+	_, _, err = CompareOptions{Preset: "decade"}.Windows(now, loc)
+	assert.Error(err)
+}
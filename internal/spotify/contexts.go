@@ -0,0 +1,477 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+// context types spotify reports, plus none for plays without one
+const (
+	ContextPlaylist   = "playlist"
+	ContextAlbum      = "album"
+	ContextArtist     = "artist"
+	ContextCollection = "collection"
+	ContextNone       = "none"
+)
+
+// where listening came from, for comparing the user's own curation against spotify's
+const (
+	OriginOwnPlaylists   = "own_playlists"
+	OriginOtherPlaylists = "other_playlists"
+	// playlists spotify makes, which includes daily mixes, radio, and editorial playlists
+	OriginAlgorithmic = "algorithmic"
+	OriginAlbums      = "albums"
+	OriginArtists     = "artists"
+	OriginLikedSongs  = "liked_songs"
+	OriginUnknown     = "unknown"
+)
+
+const (
+	spotifyOwnerID = "spotify"
+	// spotify's own playlists all have ids starting with this, even ones the api won't return
+	spotifyPlaylistPrefix = "37i9dQZF1"
+	// most playlists or albums to look up from spotify while serving a request,
+	// the rest are looked up by later requests as the cache fills in
+	maxContextLookups = 10
+)
+
+type UserObject struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+// PlaylistObject is not exhaustive, just what we need to name a context
+type PlaylistObject struct {
+	Identifier
+	Owner UserObject `json:"owner"`
+}
+
+// see: https://developer.spotify.com/documentation/web-api/reference/get-current-users-profile
+func (c Client) GetCurrentUser(ctx context.Context, token AccessToken) (UserObject, error) {
+	var obj UserObject
+	_, err := c.get(ctx, token, "/me", nil, &obj)
+	return obj, err
+}
+
+// GetPlaylist returns ok false if the playlist doesn't exist or isn't visible to us,
+// which is the case for deleted playlists and many of spotify's own.
+//
+// see: https://developer.spotify.com/documentation/web-api/reference/get-playlist
+func (c Client) GetPlaylist(
+	ctx context.Context, token AccessToken, id string,
+) (PlaylistObject, bool, error) {
+	var obj PlaylistObject
+	q := url.Values{"fields": {"id,name,href,uri,external_urls,owner(id,display_name)"}}
+	status, err := c.get(ctx, token, "/playlists/"+id, q, &obj)
+	if status == http.StatusNotFound {
+		return PlaylistObject{}, false, nil
+	} else if err != nil {
+		return PlaylistObject{}, false, err
+	}
+	return obj, true, nil
+}
+
+// GetAlbum returns ok false if the album doesn't exist, which is the case for albums pulled from spotify.
+//
+// see: https://developer.spotify.com/documentation/web-api/reference/get-an-album
+func (c Client) GetAlbum(ctx context.Context, token AccessToken, id string) (AlbumObject, bool, error) {
+	var obj AlbumObject
+	status, err := c.get(ctx, token, "/albums/"+id, nil, &obj)
+	if status == http.StatusNotFound {
+		return AlbumObject{}, false, nil
+	} else if err != nil {
+		return AlbumObject{}, false, err
+	}
+	return obj, true, nil
+}
+
+type AlbumObject struct {
+	Identifier
+	Type   string        `json:"album_type"`
+	Images []ImageObject `json:"images"`
+}
+
+// unavailableAlbum stands in for an album spotify no longer has, so that we don't keep asking for it
+func unavailableAlbum(id string) AlbumObject {
+	return AlbumObject{Identifier: Identifier{ID: id, URI: "spotify:album:" + id}}
+}
+
+// ContextPlays is how much listening happened in one context
+type ContextPlays struct {
+	Type     string `json:"type"`
+	URI      string `json:"uri,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Origin   string `json:"origin"`
+	Plays    int    `json:"plays"`
+	MSPlayed int    `json:"ms_played"`
+}
+
+// ID is the spotify id at the end of the uri
+func (cp ContextPlays) ID() string {
+	return cp.URI[strings.LastIndex(cp.URI, ":")+1:]
+}
+
+type Share struct {
+	Plays    int     `json:"plays"`
+	MSPlayed int     `json:"ms_played"`
+	Share    float64 `json:"share"`
+}
+
+type ContextBreakdown struct {
+	ByType   map[string]Share `json:"by_type"`
+	ByOrigin map[string]Share `json:"by_origin"`
+	Contexts []ContextPlays   `json:"contexts"`
+}
+
+// GetContextPlays sums up plays in the range by the context they were played from
+func (s HistoryStore) GetContextPlays(
+	ctx context.Context, listener Listener, start, end time.Time,
+) ([]ContextPlays, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT COALESCE(NULLIF(spotify_played_tracks.context_blob->>'type', ''), $4),
+	COALESCE(spotify_played_tracks.context_blob->>'uri', ''),
+	COUNT(*), COALESCE(SUM(spotify_tracks.duration_ms), 0)
+FROM spotify_played_tracks
+JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND ($5 = 0 OR spotify_played_tracks.account_id = $5)
+GROUP BY 1, 2
+ORDER BY 3 DESC`,
+		listener.UserID, start, end, ContextNone, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	plays := make([]ContextPlays, 0)
+	for rows.Next() {
+		var cp ContextPlays
+		if err = rows.Scan(&cp.Type, &cp.URI, &cp.Plays, &cp.MSPlayed); err != nil {
+			return nil, err
+		}
+		plays = append(plays, cp)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return plays, nil
+}
+
+// ContextStore caches the names of playlists and albums that plays came from.
+// albums are cached with the rest of the albums we know about.
+type ContextStore struct {
+	db *sql.DB
+}
+
+func NewContextStore(db *sql.DB) ContextStore {
+	return ContextStore{
+		db: db,
+	}
+}
+
+// GetPlaylists returns the cached playlists by id, skipping any we haven't cached
+func (s ContextStore) GetPlaylists(ctx context.Context, ids []string) (map[string]PlaylistObject, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, name, owner_id, owner_name
+FROM spotify_playlists
+WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	playlists := make(map[string]PlaylistObject)
+	for rows.Next() {
+		var p PlaylistObject
+		if err = rows.Scan(&p.ID, &p.Name, &p.Owner.ID, &p.Owner.DisplayName); err != nil {
+			return nil, err
+		}
+		playlists[p.ID] = p
+	}
+	return playlists, rows.Err()
+}
+
+// PersistPlaylist caches a playlist. playlists we couldn't see are cached with just their id,
+// so that we don't keep asking spotify for them.
+func (s ContextStore) PersistPlaylist(ctx context.Context, p PlaylistObject) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO spotify_playlists
+(id, name, href, uri, external_url, owner_id, owner_name)
+VALUES
+($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (id) DO UPDATE
+SET name = excluded.name, owner_id = excluded.owner_id,
+	owner_name = excluded.owner_name, fetched_at = now()`,
+		p.ID, p.Name, p.Href, p.URI, p.ExternalURLs.Spotify, p.Owner.ID, p.Owner.DisplayName)
+	return err
+}
+
+func (s ContextStore) GetAlbumNames(ctx context.Context, ids []string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, name
+FROM spotify_albums
+WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[string]string)
+	for rows.Next() {
+		var id, name string
+		if err = rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+// PersistAlbum caches an album. albums spotify no longer has are cached with just their id.
+func (s ContextStore) PersistAlbum(ctx context.Context, album AlbumObject) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO spotify_albums
+(id, name, href, uri, external_url, type)
+VALUES
+($1, $2, $3, $4, $5, $6)
+ON CONFLICT
+	DO NOTHING`,
+		album.ID, album.Name, album.Href, album.URI, album.ExternalURLs.Spotify, album.Type)
+	if err != nil {
+		return err
+	}
+	return persistImages(ctx, s.db, ImageAlbum, album.ID, album.Images)
+}
+
+// playlistOrigin classifies a playlist by who made it, relative to the user's spotify ids
+func playlistOrigin(p PlaylistObject, owners []string) string {
+	switch {
+	case p.Owner.ID != "" && slices.Contains(owners, p.Owner.ID):
+		return OriginOwnPlaylists
+	case p.Owner.ID == spotifyOwnerID || strings.HasPrefix(p.ID, spotifyPlaylistPrefix):
+		return OriginAlgorithmic
+	case p.Owner.ID == "":
+		return OriginUnknown
+	default:
+		return OriginOtherPlaylists
+	}
+}
+
+func contextOrigin(contextType string) string {
+	switch contextType {
+	case ContextAlbum:
+		return OriginAlbums
+	case ContextArtist:
+		return OriginArtists
+	case ContextCollection:
+		return OriginLikedSongs
+	default:
+		return OriginUnknown
+	}
+}
+
+func addShare(m map[string]Share, key string, cp ContextPlays) {
+	share := m[key]
+	share.Plays += cp.Plays
+	share.MSPlayed += cp.MSPlayed
+	m[key] = share
+}
+
+// breakdownContexts names and classifies plays by who made the playlist,
+// and sums them up by type and origin. album names should already be filled in.
+func breakdownContexts(plays []ContextPlays, playlists map[string]PlaylistObject, owners []string) ContextBreakdown {
+	breakdown := ContextBreakdown{
+		ByType:   make(map[string]Share),
+		ByOrigin: make(map[string]Share),
+		Contexts: make([]ContextPlays, 0, len(plays)),
+	}
+
+	var total int
+	for _, cp := range plays {
+		if p, ok := playlists[cp.ID()]; ok && cp.Type == ContextPlaylist {
+			cp.Name = p.Name
+			cp.Owner = p.Owner.DisplayName
+			cp.Origin = playlistOrigin(p, owners)
+		} else if cp.Type == ContextPlaylist {
+			cp.Origin = playlistOrigin(PlaylistObject{Identifier: Identifier{ID: cp.ID()}}, owners)
+		} else {
+			cp.Origin = contextOrigin(cp.Type)
+		}
+
+		total += cp.Plays
+		addShare(breakdown.ByType, cp.Type, cp)
+		addShare(breakdown.ByOrigin, cp.Origin, cp)
+		breakdown.Contexts = append(breakdown.Contexts, cp)
+	}
+
+	for _, m := range []map[string]Share{breakdown.ByType, breakdown.ByOrigin} {
+		for key, share := range m {
+			share.Share = float64(share.Plays) / float64(total)
+			m[key] = share
+		}
+	}
+	return breakdown
+}
+
+// resolveContexts fills in names for the playlists and albums in plays, from our cache or from spotify.
+// returns the playlists by id, and the spotify ids of every account the user has linked.
+// at most maxContextLookups are looked up from spotify, so some may be left unnamed.
+func (svc Controller) resolveContexts(
+	ctx context.Context, listener Listener, plays []ContextPlays,
+) (map[string]PlaylistObject, []string, error) {
+	logger := zlog.Logger(ctx)
+
+	var playlistIDs, albumIDs []string
+	for _, cp := range plays {
+		switch cp.Type {
+		case ContextPlaylist:
+			playlistIDs = append(playlistIDs, cp.ID())
+		case ContextAlbum:
+			albumIDs = append(albumIDs, cp.ID())
+		}
+	}
+
+	accounts, err := svc.Accounts.GetAccounts(ctx, AllAccounts(listener.UserID))
+	if err != nil {
+		return nil, nil, err
+	}
+	owners := make([]string, 0, len(accounts))
+	for _, a := range accounts {
+		if a.SpotifyID != "" {
+			owners = append(owners, a.SpotifyID)
+		}
+	}
+
+	playlists, err := svc.Contexts.GetPlaylists(ctx, playlistIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	albums, err := svc.Contexts.GetAlbumNames(ctx, albumIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	missingPlaylist := slices.ContainsFunc(playlistIDs, func(id string) bool {
+		_, ok := playlists[id]
+		return !ok
+	})
+	missingAlbum := slices.ContainsFunc(albumIDs, func(id string) bool {
+		_, ok := albums[id]
+		return !ok
+	})
+
+	var token AccessToken
+	if missingPlaylist || missingAlbum {
+		// any of the user's accounts can look up playlists and albums
+		if listener, err = svc.Accounts.Resolve(ctx, listener); err != nil {
+			return nil, nil, err
+		}
+		if token, err = svc.fetchToken(ctx, listener); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lookups, skipped := 0, 0
+	for _, id := range playlistIDs {
+		if _, ok := playlists[id]; ok {
+			continue
+		} else if lookups == maxContextLookups {
+			skipped++
+			continue
+		}
+		lookups++
+		p, ok, err := svc.Client.GetPlaylist(ctx, token, id)
+		if err != nil {
+			return nil, nil, err
+		} else if !ok {
+			logger.Warn("playlist isn't available", "playlist_id", id)
+			p = PlaylistObject{Identifier: Identifier{ID: id, URI: "spotify:playlist:" + id}}
+		}
+		if err = svc.Contexts.PersistPlaylist(ctx, p); err != nil {
+			return nil, nil, err
+		}
+		playlists[id] = p
+	}
+
+	for i, cp := range plays {
+		if cp.Type != ContextAlbum {
+			continue
+		}
+		name, ok := albums[cp.ID()]
+		if !ok && lookups == maxContextLookups {
+			skipped++
+			continue
+		} else if !ok {
+			lookups++
+			album, ok, err := svc.Client.GetAlbum(ctx, token, cp.ID())
+			if err != nil {
+				return nil, nil, err
+			} else if !ok {
+				logger.Warn("album isn't available", "album_id", cp.ID())
+				album = unavailableAlbum(cp.ID())
+			}
+			if err = svc.Contexts.PersistAlbum(ctx, album); err != nil {
+				return nil, nil, err
+			}
+			name = album.Name
+			albums[cp.ID()] = name
+		}
+		plays[i].Name = name
+	}
+	if skipped > 0 {
+		logger.Warn("too many contexts to look up, leaving the rest for later",
+			"num_looked_up", lookups, "num_skipped", skipped)
+	}
+	return playlists, owners, nil
+}
+
+func (svc Controller) getContexts(c *gin.Context, listener Listener, logger *slog.Logger) {
+	var opts Options
+	if err := c.BindQuery(&opts); err != nil {
+		logger.Error("error binding query for contexts", "error", err)
+		zgin.BadRequest(c, "please provide correct query params")
+		return
+	}
+	start, end, ok := svc.resolveRange(c, listener.UserID, logger, opts)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	plays, err := svc.History.GetContextPlays(ctx, listener, start, end)
+	if err != nil {
+		logger.Error("error loading context plays", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	playlists, owners, err := svc.resolveContexts(ctx, listener, plays)
+	if err != nil {
+		logger.Error("error resolving contexts", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	breakdown := breakdownContexts(plays, playlists, owners)
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"start":     start,
+		"end":       end,
+		"breakdown": breakdown,
+	})
+}
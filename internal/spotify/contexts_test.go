@@ -0,0 +1,36 @@
+package spotify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakdownContexts(t *testing.T) {
+	assert := assert.New(t)
+
+	plays := []ContextPlays{
+		{Type: ContextPlaylist, URI: "spotify:playlist:mine", Plays: 4, MSPlayed: 400},
+		{Type: ContextPlaylist, URI: "spotify:playlist:37i9dQZF1E4daily", Plays: 2, MSPlayed: 200},
+		{Type: ContextPlaylist, URI: "spotify:playlist:friends", Plays: 1, MSPlayed: 100},
+		{Type: ContextAlbum, URI: "spotify:album:nightlife", Name: "Nightlife", Plays: 2, MSPlayed: 200},
+		{Type: ContextNone, Plays: 1, MSPlayed: 100},
+	}
+	playlists := map[string]PlaylistObject{
+		"mine":    {Identifier: Identifier{ID: "mine", Name: "vibes"}, Owner: UserObject{ID: "zeke"}},
+		"friends": {Identifier: Identifier{ID: "friends", Name: "hers"}, Owner: UserObject{ID: "reyna"}},
+	}
+
+	breakdown := breakdownContexts(plays, playlists, []string{"zeke"})
+	assert.Equal(Share{Plays: 7, MSPlayed: 700, Share: 0.7}, breakdown.ByType[ContextPlaylist])
+	assert.Equal(0.4, breakdown.ByOrigin[OriginOwnPlaylists].Share)
+	assert.Equal(0.2, breakdown.ByOrigin[OriginAlgorithmic].Share)
+	assert.Equal(0.1, breakdown.ByOrigin[OriginOtherPlaylists].Share)
+	assert.Equal(0.2, breakdown.ByOrigin[OriginAlbums].Share)
+	assert.Equal(0.1, breakdown.ByOrigin[OriginUnknown].Share)
+
+	if assert.Len(breakdown.Contexts, len(plays)) {
+		assert.Equal("vibes", breakdown.Contexts[0].Name)
+		assert.Equal("Nightlife", breakdown.Contexts[3].Name)
+	}
+}
@@ -11,42 +11,98 @@ import (
 	"github.com/zestze/zest-backend/internal/user"
 
 	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zgin"
 )
 
 type Controller struct {
-	Client    Client
-	StoreV1   GeneralStore
-	StoreV2   GeneralStore
-	Publisher Publisher
+	Client     Client
+	StoreV1    GeneralStore
+	StoreV2    GeneralStore
+	Sync       SyncStore
+	History    HistoryStore
+	Contexts   ContextStore
+	Imports    ImportStore
+	Accounts   AccountStore
+	Playlists  PlaylistStore
+	Library    LibraryStore
+	Releases   ReleaseStore
+	Top        TopStore
+	Images     ImageStore
+	Users      user.Store
+	NowPlaying NowPlayingCache
+	Publisher  Publisher
 }
 
-func New(ctx context.Context, db *sql.DB, publisher Publisher, rt http.RoundTripper) (Controller, error) {
+func New(
+	ctx context.Context, db *sql.DB, rdb redis.UniversalClient, keyring zcrypt.Keyring,
+	publisher Publisher, rt http.RoundTripper,
+) (Controller, error) {
 	client, err := NewClient(rt)
 	if err != nil {
 		return Controller{}, err
 	}
 	return Controller{
-		Client:    client,
-		StoreV1:   NewStoreV1(db),
-		StoreV2:   NewStoreV2(db),
-		Publisher: publisher,
+		Client:     client,
+		StoreV1:    NewStoreV1(db, WithKeyring(keyring)),
+		StoreV2:    NewStoreV2(db, WithKeyring(keyring)),
+		Sync:       NewSyncStore(db),
+		History:    NewHistoryStore(db),
+		Contexts:   NewContextStore(db),
+		Imports:    NewImportStore(db),
+		Accounts:   NewAccountStore(db),
+		Playlists:  NewPlaylistStore(db),
+		Library:    NewLibraryStore(db),
+		Releases:   NewReleaseStore(db),
+		Top:        NewTopStore(db),
+		Images:     NewImageStore(db),
+		Users:      user.NewStore(db),
+		NowPlaying: NewNowPlayingCache(rdb),
+		Publisher:  publisher,
 	}, nil
 }
 
 func (svc Controller) Register(r gin.IRouter, auth gin.HandlerFunc) {
 	g := r.Group("/spotify")
 	g.Use(auth)
-	g.POST("/refresh", zgin.WithUser(svc.refresh))
-	g.POST("/backfill", zgin.WithUser(svc.backfill))
+	g.POST("/refresh", svc.withListener(svc.refresh))
+	g.POST("/backfill", svc.withListener(svc.backfill))
 	g.POST("/token", zgin.WithUser(svc.addToken))
-	g.GET("/songs", zgin.WithUser(svc.getSongs))
-	g.GET("/artists", zgin.WithUser(svc.getArtists))
-	g.GET("/artist/songs", zgin.WithUser(svc.getSongsForArtist))
+	g.GET("/accounts", zgin.WithUser(svc.getAccounts))
+	g.DELETE("/accounts/:id", zgin.WithUser(svc.deleteAccount))
+	g.GET("/songs", svc.withListener(svc.getSongs))
+	g.GET("/artists", svc.withListener(svc.getArtists))
+	g.GET("/artists/:id", svc.withListener(svc.getArtist))
+	g.GET("/tracks/:id", svc.withListener(svc.getTrack))
+	g.POST("/import/lastfm", zgin.WithUser(svc.importLastFM))
+	g.GET("/import/unmatched", zgin.WithUser(svc.getUnmatched))
+	g.GET("/search", svc.withListener(svc.search))
+	g.GET("/rediscover", svc.withListener(svc.rediscover))
+	g.GET("/contexts", svc.withListener(svc.getContexts))
+	g.GET("/stats/popularity", svc.withListener(svc.getPopularity))
+	g.GET("/discoveries", svc.withListener(svc.getDiscoveries))
+	g.GET("/graph", svc.withListener(svc.getGraph))
+	g.GET("/compare", svc.withListener(svc.compare))
+	g.GET("/albums/listens", svc.withListener(svc.getAlbumListens))
+	g.POST("/playlists/sync", svc.withListener(svc.syncPlaylists))
+	g.GET("/playlists", svc.withListener(svc.getPlaylists))
+	g.GET("/playlists/:id/history", zgin.WithUser(svc.getPlaylistHistory))
+	g.POST("/library/sync", svc.withListener(svc.syncLibrary))
+	g.GET("/library", svc.withListener(svc.getLibrary))
+	g.GET("/library/likes", svc.withListener(svc.getLikeCounts))
+	g.POST("/releases/refresh", svc.withListener(svc.pollReleases))
+	g.GET("/releases/new", zgin.WithUser(svc.getNewReleases))
+	g.POST("/top/snapshot", svc.withListener(svc.takeTopSnapshots))
+	g.GET("/top/artists/:id", svc.withListener(svc.getArtistRanks))
+	g.GET("/gaps", svc.withListener(svc.getGaps))
+	g.GET("/now-playing", svc.withListener(svc.getNowPlaying))
+	g.GET("/now-playing/stream", svc.withListener(svc.streamNowPlaying))
 }
 
-func (svc Controller) fetchToken(ctx context.Context, userID int) (AccessToken, error) {
-	token, err := svc.StoreV2.GetToken(ctx, userID)
+// fetchToken loads the token for the listener's account, refreshing it if it's expired
+func (svc Controller) fetchToken(ctx context.Context, listener Listener) (AccessToken, error) {
+	token, err := svc.StoreV2.GetToken(ctx, listener)
 	if err != nil {
 		return AccessToken{}, fmt.Errorf("error getting token %w", err)
 	}
@@ -57,92 +113,159 @@ func (svc Controller) fetchToken(ctx context.Context, userID int) (AccessToken,
 			return AccessToken{}, fmt.Errorf("error refreshing token %w", err)
 		}
 
-		if err = svc.StoreV2.PersistToken(ctx, token, userID); err != nil {
+		if err = svc.StoreV2.PersistToken(ctx, token, listener); err != nil {
 			return AccessToken{}, fmt.Errorf("error persisting token %w", err)
 		}
 	}
 	return token, nil
 }
 
-func (svc Controller) refresh(c *gin.Context, userID user.ID, logger *slog.Logger) {
+// refresh syncs recently played for the listener's account, or for every account the user has linked
+func (svc Controller) refresh(c *gin.Context, listener Listener, logger *slog.Logger) {
 	ctx := c.Request.Context()
-	token, err := svc.fetchToken(ctx, userID)
+	accounts, err := svc.Accounts.GetAccounts(ctx, listener)
 	if err != nil {
-		logger.Error("error fetching token", "error", err)
+		logger.Error("error loading spotify accounts", "error", err)
 		zgin.InternalError(c)
 		return
+	} else if len(accounts) == 0 {
+		accountNotFound(c)
+		return
 	}
 
-	after := time.Now().Add(-time.Hour).UTC()
-	items, err := svc.Client.GetRecentlyPlayed(ctx, token, after)
-	if err != nil {
-		logger.Error("error fetching songs", "error", err)
-		zgin.InternalError(c)
-		return
+	numPersisted := 0
+	for _, account := range accounts {
+		logger := logger.With(slog.Int("account_id", account.ID))
+		n, err := svc.syncAccount(ctx, listener.UserID, account, logger)
+		if err != nil {
+			logger.Error("error syncing account", "error", err)
+			zgin.InternalError(c)
+			return
+		}
+		numPersisted += n
+	}
+	// images are nice to have, so they shouldn't fail the sync
+	if err = svc.lookupArtistImages(ctx, Listener{UserID: listener.UserID, AccountID: accounts[0].ID}); err != nil {
+		logger.Warn("error looking up artist images", "error", err)
 	}
 
 	msg := gin.H{
-		"num_persisted": 0,
+		"num_persisted": numPersisted,
 	}
-	if len(items) == 0 {
-		if err = svc.Publisher.Publish(ctx, msg); err != nil {
-			logger.Error("error publishing message", "error", err)
+	if err = svc.Publisher.Publish(ctx, msg); err != nil {
+		logger.Error("error publishing message", "error", err)
+	}
+	c.IndentedJSON(http.StatusOK, msg)
+}
+
+// syncAccount persists everything played on the account since it was last synced,
+// returning the number of plays persisted.
+func (svc Controller) syncAccount(
+	ctx context.Context, userID int, account Account, logger *slog.Logger,
+) (int, error) {
+	listener := Listener{UserID: userID, AccountID: account.ID}
+	token, err := svc.fetchToken(ctx, listener)
+	if err != nil {
+		return 0, err
+	}
+
+	// accounts linked before spotify ids were recorded
+	if account.SpotifyID == "" {
+		me, err := svc.Client.GetCurrentUser(ctx, token)
+		if err != nil {
+			return 0, fmt.Errorf("error fetching spotify user %w", err)
+		}
+		if _, err = svc.Accounts.LinkAccount(ctx, listener.UserID, me); err != nil {
+			return 0, err
 		}
-		c.IndentedJSON(http.StatusOK, msg)
-		return
 	}
 
-	// persist songs via both methods!
-	persisted, err := svc.StoreV1.PersistRecentlyPlayed(ctx, items, userID)
+	last, err := svc.Sync.LastPlayedAt(ctx, listener)
 	if err != nil {
-		logger.Error("error persisting songs", "error", err)
-		zgin.InternalError(c)
-		return
+		return 0, err
 	}
 
-	_, err = svc.StoreV2.PersistRecentlyPlayed(ctx, items, userID)
+	items, gap, err := syncRecentlyPlayed(ctx, svc.Client, token, last)
 	if err != nil {
-		logger.Error("error persisting songs", "error", err)
-		zgin.InternalError(c)
-		return
+		return 0, fmt.Errorf("error fetching songs %w", err)
 	}
 
-	msg["num_persisted"] = len(persisted)
-	if err = svc.Publisher.Publish(ctx, msg); err != nil {
-		logger.Error("error publishing message", "error", err)
+	if gap != nil {
+		logger.Warn("detected gap in recently played coverage",
+			"gap_start", gap.Start, "gap_end", gap.End)
+		if err = svc.Sync.PersistGap(ctx, listener, *gap); err != nil {
+			return 0, err
+		}
 	}
-	c.IndentedJSON(http.StatusOK, msg)
+
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	// persist songs via both methods!
+	persisted, err := svc.StoreV1.PersistRecentlyPlayed(ctx, items, listener)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = svc.StoreV2.PersistRecentlyPlayed(ctx, items, listener); err != nil {
+		return 0, err
+	}
+	return len(persisted), nil
+}
+
+// lookupArtistImages stores the images of artists the user has played, a batch at a time,
+// since plays only include artists without their images.
+func (svc Controller) lookupArtistImages(ctx context.Context, listener Listener) error {
+	ids, err := svc.Images.GetArtistsWithoutImages(ctx, listener.UserID, maxArtistImageLookups)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	token, err := svc.fetchToken(ctx, listener)
+	if err != nil {
+		return err
+	}
+	artists, err := svc.Client.GetArtists(ctx, token, ids)
+	if err != nil {
+		return fmt.Errorf("error fetching artists %w", err)
+	}
+	return svc.Images.PersistArtistImages(ctx, ids, artists)
 }
 
 // TODO(zeke): generally backfill doesn't feel like a great reason to have a separate endpoint
-func (svc Controller) backfill(c *gin.Context, userID int, logger *slog.Logger) {
+func (svc Controller) backfill(c *gin.Context, listener Listener, logger *slog.Logger) {
 	qStart, qEnd := c.Query("start"), c.Query("end")
 	if qStart == "" || qEnd == "" {
 		zgin.BadRequest(c, "please provide start and end for backfill")
 		return
 	}
 
-	// TODO(zeke): maybe put timezone into env var?
-	// parse as datetime!
-	loc, err := time.LoadLocation("America/New_York")
+	// dates are in the user's timezone
+	loc, err := svc.Users.GetLocation(c.Request.Context(), listener.UserID)
 	if err != nil {
-		logger.Error("somehow didn't load location", "error", err)
+		logger.Error("error loading user location", "error", err)
 		zgin.InternalError(c)
 		return
 	}
-	start, err := time.ParseInLocation(time.DateOnly, qStart, loc)
+	start, err := zgin.ParseTime(qStart, loc, false)
 	if err != nil {
-		zgin.BadRequest(c, "start must be provided as format "+time.DateOnly)
+		zgin.BadRequest(c, "start: "+err.Error())
 		return
 	}
-	end, err := time.ParseInLocation(time.DateOnly, qEnd, loc)
+	end, err := zgin.ParseTime(qEnd, loc, true)
 	if err != nil {
-		zgin.BadRequest(c, "end must be provided as format "+time.DateOnly)
+		zgin.BadRequest(c, "end: "+err.Error())
+		return
+	}
+
+	// backfilling needs a single account to tag plays with
+	listener, ok := svc.resolveAccount(c, listener, logger)
+	if !ok {
 		return
 	}
 
 	// then fetch token
-	token, err := svc.fetchToken(c, userID)
+	token, err := svc.fetchToken(c, listener)
 	if err != nil {
 		logger.Error("error fetching token", "error", err)
 		zgin.InternalError(c)
@@ -173,7 +296,7 @@ func (svc Controller) backfill(c *gin.Context, userID int, logger *slog.Logger)
 				return
 			}
 
-			persisted, err := svc.StoreV2.PersistRecentlyPlayed(ctx, items, userID)
+			persisted, err := svc.StoreV2.PersistRecentlyPlayed(ctx, items, listener)
 			if err != nil {
 				logger.Error("error persisting songs", "error", err)
 				return
@@ -189,6 +312,7 @@ func (svc Controller) backfill(c *gin.Context, userID int, logger *slog.Logger)
 	})
 }
 
+// addToken links the spotify account the token belongs to, and stores the token for it
 func (svc Controller) addToken(c *gin.Context, userID user.ID, logger *slog.Logger) {
 	var token AccessToken
 	if err := c.ShouldBindJSON(&token); err != nil {
@@ -199,19 +323,45 @@ func (svc Controller) addToken(c *gin.Context, userID user.ID, logger *slog.Logg
 		return
 	}
 
-	if err := svc.StoreV2.PersistToken(c.Request.Context(), token, userID); err != nil {
+	ctx := c.Request.Context()
+	if token.Expired() {
+		refreshed, err := svc.Client.RefreshAccess(ctx, token)
+		if err != nil {
+			logger.Error("error refreshing token", "error", err)
+			zgin.BadRequest(c, "token is expired and couldn't be refreshed")
+			return
+		}
+		token = refreshed
+	}
+
+	me, err := svc.Client.GetCurrentUser(ctx, token)
+	if err != nil {
+		logger.Error("error fetching spotify user", "error", err)
+		zgin.BadRequest(c, "token couldn't be used to identify the spotify account")
+		return
+	}
+	account, err := svc.Accounts.LinkAccount(ctx, userID, me)
+	if err != nil {
+		logger.Error("error linking spotify account", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	listener := Listener{UserID: userID, AccountID: account.ID}
+	if err := svc.StoreV2.PersistToken(ctx, token, listener); err != nil {
 		logger.Error("error persisting token", "error", err)
 		zgin.InternalError(c)
 		return
 	}
 
 	c.IndentedJSON(http.StatusCreated, gin.H{
-		"status": "ok",
+		"status":  "ok",
+		"account": account,
 	})
 }
 
-func (svc Controller) getSongs(c *gin.Context, userID user.ID, logger *slog.Logger) {
-	opts := defaultOptions()
+func (svc Controller) getSongs(c *gin.Context, listener Listener, logger *slog.Logger) {
+	var opts Options
 	if err := c.BindQuery(&opts); err != nil {
 		logger.Error("error binding query for getSongs", "error", err)
 		c.IndentedJSON(http.StatusBadRequest, gin.H{
@@ -219,9 +369,13 @@ func (svc Controller) getSongs(c *gin.Context, userID user.ID, logger *slog.Logg
 		})
 		return
 	}
+	start, end, ok := svc.resolveRange(c, listener.UserID, logger, opts)
+	if !ok {
+		return
+	}
 
 	songs, err := svc.StoreV2.GetRecentlyPlayed(
-		c.Request.Context(), userID, opts.Start, opts.End)
+		c.Request.Context(), listener, start, end)
 	if err != nil {
 		logger.Error("error loading recently played songs", "error", err)
 		zgin.InternalError(c)
@@ -233,8 +387,8 @@ func (svc Controller) getSongs(c *gin.Context, userID user.ID, logger *slog.Logg
 	})
 }
 
-func (svc Controller) getArtists(c *gin.Context, userID user.ID, logger *slog.Logger) {
-	opts := defaultOptions()
+func (svc Controller) getArtists(c *gin.Context, listener Listener, logger *slog.Logger) {
+	var opts Options
 	if err := c.BindQuery(&opts); err != nil {
 		logger.Error("error binding query for getArtists", "error", err)
 		c.IndentedJSON(http.StatusBadRequest, gin.H{
@@ -242,9 +396,13 @@ func (svc Controller) getArtists(c *gin.Context, userID user.ID, logger *slog.Lo
 		})
 		return
 	}
+	start, end, ok := svc.resolveRange(c, listener.UserID, logger, opts)
+	if !ok {
+		return
+	}
 
 	artists, err := svc.StoreV2.GetRecentlyPlayedByArtist(
-		c.Request.Context(), userID, opts.Start, opts.End)
+		c.Request.Context(), listener, start, end)
 	if err != nil {
 		logger.Error("error loading recently played artists", "error", err)
 		zgin.InternalError(c)
@@ -256,64 +414,65 @@ func (svc Controller) getArtists(c *gin.Context, userID user.ID, logger *slog.Lo
 	})
 }
 
-func (svc Controller) getSongsForArtist(c *gin.Context, userID user.ID, logger *slog.Logger) {
-	opts := struct {
-		Options
-		Artist string `form:"artist"`
-	}{
-		Options: defaultOptions(),
+// Options are the bounds of a time range. Each can be an RFC 3339 timestamp,
+// or a date that's interpreted in the user's timezone. Defaults to the last hour.
+type Options struct {
+	Start string `form:"start"`
+	End   string `form:"end"`
+}
+
+func (opts Options) Range(loc *time.Location) (time.Time, time.Time, error) {
+	end := time.Now().UTC()
+	start := end.Add(-time.Hour)
+
+	var err error
+	if opts.Start != "" {
+		if start, err = zgin.ParseTime(opts.Start, loc, false); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("start: %w", err)
+		}
 	}
-	if err := c.BindQuery(&opts); err != nil || opts.Artist == "" {
-		logger.Error("error binding query for getSongsByArtist", "error", err)
-		c.IndentedJSON(http.StatusBadRequest, gin.H{
-			"error": "please provide correct query params",
-		})
-		return
+	if opts.End != "" {
+		if end, err = zgin.ParseTime(opts.End, loc, true); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("end: %w", err)
+		}
 	}
+	return start, end, nil
+}
 
-	songs, err := svc.StoreV2.GetRecentlyPlayedForArtist(
-		c.Request.Context(), userID, opts.Artist, opts.Start, opts.End)
+// resolveRange resolves opts in the user's timezone. If it fails, a response has already been written.
+func (svc Controller) resolveRange(
+	c *gin.Context, userID user.ID, logger *slog.Logger, opts Options,
+) (time.Time, time.Time, bool) {
+	loc, err := svc.Users.GetLocation(c.Request.Context(), userID)
 	if err != nil {
-		logger.Error("error loading recently played songs for artist", "error", err)
+		logger.Error("error loading user location", "error", err)
 		zgin.InternalError(c)
-		return
+		return time.Time{}, time.Time{}, false
 	}
 
-	c.IndentedJSON(http.StatusOK, gin.H{
-		"songs": songs,
-	})
-}
-
-type Options struct {
-	Start time.Time `form:"start"`
-	End   time.Time `form:"end"`
-}
-
-func defaultOptions() Options {
-	now := time.Now().UTC()
-	return Options{
-		Start: now.Add(-time.Hour),
-		End:   now,
+	start, end, err := opts.Range(loc)
+	if err != nil {
+		zgin.BadRequest(c, err.Error())
+		return time.Time{}, time.Time{}, false
 	}
+	return start, end, true
 }
 
 // GeneralStore is a minimal abstraction over the two Store structs.
-// this is so that it's clear to the controller what methods are available
+// this is so that it's clear to the controller what methods are available.
+// plays are persisted for the listener's account, and read from it or merged across accounts.
 type GeneralStore interface {
 	PersistRecentlyPlayed(
-		ctx context.Context, songs []PlayHistoryObject, userID int,
+		ctx context.Context, songs []PlayHistoryObject, listener Listener,
 	) ([]string, error)
 	GetRecentlyPlayed(
-		ctx context.Context, userID int, start, end time.Time,
+		ctx context.Context, listener Listener, start, end time.Time,
 	) ([]NameWithTime, error)
 	GetRecentlyPlayedByArtist(
-		ctx context.Context, userID int, start, end time.Time,
-	) ([]NameWithListens, error)
-	GetRecentlyPlayedForArtist(
-		ctx context.Context, userID int, artist string, start, end time.Time,
+		ctx context.Context, listener Listener, start, end time.Time,
 	) ([]NameWithListens, error)
-	PersistToken(ctx context.Context, token AccessToken, userID int) error
-	GetToken(ctx context.Context, userID int) (AccessToken, error)
+	PersistToken(ctx context.Context, token AccessToken, listener Listener) error
+	GetToken(ctx context.Context, listener Listener) (AccessToken, error)
 }
 
 type Publisher interface {
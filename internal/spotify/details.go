@@ -0,0 +1,360 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const detailTopTracks = 10
+
+// the plays detail endpoints summarize, by the listener ($1 and $2) of an artist or track ($3)
+const (
+	artistPlays = `
+SELECT spotify_played_tracks.*
+FROM spotify_played_tracks
+WHERE spotify_played_tracks.user_id = $1
+	AND ($2 = 0 OR spotify_played_tracks.account_id = $2)
+	AND EXISTS (
+		SELECT 1
+		FROM spotify_credits
+		WHERE spotify_credits.track_id = spotify_played_tracks.track_id
+			AND spotify_credits.artist_id = $3
+	)`
+	trackPlays = `
+SELECT spotify_played_tracks.*
+FROM spotify_played_tracks
+WHERE spotify_played_tracks.user_id = $1
+	AND ($2 = 0 OR spotify_played_tracks.account_id = $2)
+	AND spotify_played_tracks.track_id = $3`
+)
+
+// ItemPlays is how much one track or album was played
+type ItemPlays struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Plays   int     `json:"plays"`
+	Minutes float64 `json:"minutes"`
+}
+
+type MonthPlays struct {
+	// Month is the first day of the month, in the user's timezone
+	Month   string  `json:"month"`
+	Plays   int     `json:"plays"`
+	Minutes float64 `json:"minutes"`
+}
+
+// PlayStats summarize every play of an artist or track
+type PlayStats struct {
+	FirstPlayedAt time.Time        `json:"first_played_at"`
+	LastPlayedAt  time.Time        `json:"last_played_at"`
+	Plays         int              `json:"plays"`
+	Minutes       float64          `json:"minutes"`
+	Monthly       []MonthPlays     `json:"monthly"`
+	Albums        []ItemPlays      `json:"albums"`
+	Contexts      ContextBreakdown `json:"contexts"`
+	// contextPlays are resolved into Contexts by the controller, which can reach spotify
+	contextPlays []ContextPlays
+}
+
+type ArtistDetail struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	URL       string      `json:"url"`
+	TopTracks []ItemPlays `json:"top_tracks"`
+	PlayStats
+}
+
+type TrackDetail struct {
+	ID         string       `json:"id"`
+	Name       string       `json:"name"`
+	URL        string       `json:"url"`
+	DurationMS int          `json:"duration_ms"`
+	Artists    []Identifier `json:"artists"`
+	PlayStats
+}
+
+// GetArtistDetail summarizes the listener's plays of the artist.
+// returns false if the listener has never played them.
+func (s HistoryStore) GetArtistDetail(
+	ctx context.Context, listener Listener, id string, loc *time.Location,
+) (ArtistDetail, bool, error) {
+	logger := zlog.Logger(ctx)
+
+	detail := ArtistDetail{ID: id}
+	err := s.db.QueryRowContext(ctx, `
+SELECT name, external_url
+FROM spotify_artists
+WHERE id = $1`, id).Scan(&detail.Name, &detail.URL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ArtistDetail{}, false, nil
+	} else if err != nil {
+		logger.Error("error loading artist", "error", err)
+		return ArtistDetail{}, false, err
+	}
+
+	stats, ok, err := s.getPlayStats(ctx, listener, artistPlays, id, loc)
+	if err != nil || !ok {
+		return ArtistDetail{}, ok, err
+	}
+	detail.PlayStats = stats
+
+	detail.TopTracks, err = s.queryItemPlays(ctx, `
+WITH plays AS (`+artistPlays+`
+)
+SELECT spotify_tracks.id, spotify_tracks.name, COUNT(*), SUM(spotify_tracks.duration_ms) / 60000.0
+FROM plays
+JOIN spotify_tracks ON spotify_tracks.id = plays.track_id
+GROUP BY spotify_tracks.id, spotify_tracks.name
+ORDER BY 3 DESC, 4 DESC, spotify_tracks.name
+LIMIT $4`, listener.UserID, listener.AccountID, id, detailTopTracks)
+	if err != nil {
+		logger.Error("error loading top tracks", "error", err)
+		return ArtistDetail{}, false, err
+	}
+	return detail, true, nil
+}
+
+// GetTrackDetail summarizes the listener's plays of the track.
+// returns false if the listener has never played it.
+func (s HistoryStore) GetTrackDetail(
+	ctx context.Context, listener Listener, id string, loc *time.Location,
+) (TrackDetail, bool, error) {
+	logger := zlog.Logger(ctx)
+
+	detail := TrackDetail{ID: id}
+	err := s.db.QueryRowContext(ctx, `
+SELECT name, external_url, duration_ms
+FROM spotify_tracks
+WHERE id = $1`, id).Scan(&detail.Name, &detail.URL, &detail.DurationMS)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TrackDetail{}, false, nil
+	} else if err != nil {
+		logger.Error("error loading track", "error", err)
+		return TrackDetail{}, false, err
+	}
+
+	stats, ok, err := s.getPlayStats(ctx, listener, trackPlays, id, loc)
+	if err != nil || !ok {
+		return TrackDetail{}, ok, err
+	}
+	detail.PlayStats = stats
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT spotify_artists.id, spotify_artists.name, spotify_artists.href,
+	spotify_artists.uri, spotify_artists.external_url
+FROM spotify_credits
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+WHERE spotify_credits.track_id = $1
+ORDER BY spotify_artists.name`, id)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return TrackDetail{}, false, err
+	}
+	defer rows.Close()
+
+	detail.Artists = make([]Identifier, 0)
+	for rows.Next() {
+		var a Identifier
+		if err = rows.Scan(&a.ID, &a.Name, &a.Href, &a.URI, &a.ExternalURLs.Spotify); err != nil {
+			return TrackDetail{}, false, err
+		}
+		detail.Artists = append(detail.Artists, a)
+	}
+	if err = rows.Err(); err != nil {
+		return TrackDetail{}, false, err
+	}
+	return detail, true, nil
+}
+
+// getPlayStats summarizes the plays selected by the plays query, for the item with the given id.
+// returns false if there aren't any.
+func (s HistoryStore) getPlayStats(
+	ctx context.Context, listener Listener, plays, id string, loc *time.Location,
+) (PlayStats, bool, error) {
+	logger := zlog.Logger(ctx)
+
+	var (
+		stats       PlayStats
+		first, last sql.NullTime
+	)
+	if err := s.db.QueryRowContext(ctx, `
+WITH plays AS (`+plays+`
+)
+SELECT MIN(plays.played_at), MAX(plays.played_at),
+	COUNT(*), COALESCE(SUM(spotify_tracks.duration_ms), 0) / 60000.0
+FROM plays
+JOIN spotify_tracks ON spotify_tracks.id = plays.track_id`,
+		listener.UserID, listener.AccountID, id).
+		Scan(&first, &last, &stats.Plays, &stats.Minutes); err != nil {
+		logger.Error("error summarizing plays", "error", err)
+		return PlayStats{}, false, err
+	} else if stats.Plays == 0 {
+		return PlayStats{}, false, nil
+	}
+	stats.FirstPlayedAt, stats.LastPlayedAt = first.Time, last.Time
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH plays AS (`+plays+`
+)
+SELECT date_trunc('month', plays.played_at AT TIME ZONE $4),
+	COUNT(*), SUM(spotify_tracks.duration_ms) / 60000.0
+FROM plays
+JOIN spotify_tracks ON spotify_tracks.id = plays.track_id
+GROUP BY 1
+ORDER BY 1`, listener.UserID, listener.AccountID, id, loc.String())
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return PlayStats{}, false, err
+	}
+	defer rows.Close()
+
+	stats.Monthly = make([]MonthPlays, 0)
+	for rows.Next() {
+		var (
+			m     MonthPlays
+			month time.Time
+		)
+		if err = rows.Scan(&month, &m.Plays, &m.Minutes); err != nil {
+			return PlayStats{}, false, err
+		}
+		m.Month = month.Format(time.DateOnly)
+		stats.Monthly = append(stats.Monthly, m)
+	}
+	if err = rows.Err(); err != nil {
+		return PlayStats{}, false, err
+	}
+
+	stats.Albums, err = s.queryItemPlays(ctx, `
+WITH plays AS (`+plays+`
+)
+SELECT spotify_albums.id, spotify_albums.name, COUNT(*), SUM(spotify_tracks.duration_ms) / 60000.0
+FROM plays
+JOIN spotify_tracks ON spotify_tracks.id = plays.track_id
+JOIN spotify_albums ON spotify_albums.id = spotify_tracks.album_id
+GROUP BY spotify_albums.id, spotify_albums.name
+ORDER BY 3 DESC, 4 DESC, spotify_albums.name`, listener.UserID, listener.AccountID, id)
+	if err != nil {
+		logger.Error("error loading albums", "error", err)
+		return PlayStats{}, false, err
+	}
+
+	contexts, err := s.db.QueryContext(ctx, `
+WITH plays AS (`+plays+`
+)
+SELECT COALESCE(NULLIF(plays.context_blob->>'type', ''), $4),
+	COALESCE(plays.context_blob->>'uri', ''),
+	COUNT(*), COALESCE(SUM(spotify_tracks.duration_ms), 0)
+FROM plays
+JOIN spotify_tracks ON spotify_tracks.id = plays.track_id
+GROUP BY 1, 2
+ORDER BY 3 DESC`, listener.UserID, listener.AccountID, id, ContextNone)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return PlayStats{}, false, err
+	}
+	defer contexts.Close()
+
+	stats.contextPlays = make([]ContextPlays, 0)
+	for contexts.Next() {
+		var cp ContextPlays
+		if err = contexts.Scan(&cp.Type, &cp.URI, &cp.Plays, &cp.MSPlayed); err != nil {
+			return PlayStats{}, false, err
+		}
+		stats.contextPlays = append(stats.contextPlays, cp)
+	}
+	return stats, true, contexts.Err()
+}
+
+func (s HistoryStore) queryItemPlays(ctx context.Context, query string, args ...any) ([]ItemPlays, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]ItemPlays, 0)
+	for rows.Next() {
+		var item ItemPlays
+		if err = rows.Scan(&item.ID, &item.Name, &item.Plays, &item.Minutes); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// resolveDetailContexts names the contexts the plays came from, and breaks them down
+func (svc Controller) resolveDetailContexts(ctx context.Context, listener Listener, stats *PlayStats) error {
+	playlists, owners, err := svc.resolveContexts(ctx, listener, stats.contextPlays)
+	if err != nil {
+		return err
+	}
+	stats.Contexts = breakdownContexts(stats.contextPlays, playlists, owners)
+	return nil
+}
+
+func (svc Controller) getArtist(c *gin.Context, listener Listener, logger *slog.Logger) {
+	svc.getDetail(c, listener, logger, KindArtist)
+}
+
+func (svc Controller) getTrack(c *gin.Context, listener Listener, logger *slog.Logger) {
+	svc.getDetail(c, listener, logger, KindTrack)
+}
+
+func (svc Controller) getDetail(c *gin.Context, listener Listener, logger *slog.Logger, kind string) {
+	ctx := c.Request.Context()
+	loc, err := svc.Users.GetLocation(ctx, listener.UserID)
+	if err != nil {
+		logger.Error("error loading user location", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	var (
+		detail any
+		stats  *PlayStats
+		ok     bool
+	)
+	switch kind {
+	case KindArtist:
+		var artist ArtistDetail
+		artist, ok, err = svc.History.GetArtistDetail(ctx, listener, c.Param("id"), loc)
+		detail, stats = &artist, &artist.PlayStats
+	case KindTrack:
+		var track TrackDetail
+		track, ok, err = svc.History.GetTrackDetail(ctx, listener, c.Param("id"), loc)
+		detail, stats = &track, &track.PlayStats
+	default:
+		err = fmt.Errorf("unknown kind [%v]", kind)
+	}
+	if err != nil {
+		logger.Error("error loading detail", "kind", kind, "error", err)
+		zgin.InternalError(c)
+		return
+	} else if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{
+			"error": "you haven't listened to this " + kind,
+		})
+		return
+	}
+
+	if err = svc.resolveDetailContexts(ctx, listener, stats); err != nil {
+		logger.Error("error resolving contexts", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		kind: detail,
+	})
+}
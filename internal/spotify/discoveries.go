@@ -0,0 +1,179 @@
+package spotify
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const (
+	// a discovery stuck if it was played again at least this many days after the first listen
+	stuckAfterDays        = 7
+	defaultDiscoveryLimit = 100
+)
+
+// discoveries lists first listens between $2 and $3, with how many times each was played
+// at least $4 days later on any account. first listens are from the spotify_first_listens view,
+// and are limited to those made on account $5 unless it's zero.
+const discoveries = `
+SELECT spotify_first_listens.kind, spotify_first_listens.id,
+	spotify_first_listens.first_played_at, later.plays AS later_plays
+FROM spotify_first_listens
+CROSS JOIN LATERAL (
+	SELECT COUNT(*) AS plays
+	FROM spotify_played_tracks
+	WHERE spotify_played_tracks.user_id = spotify_first_listens.user_id
+		AND spotify_played_tracks.played_at >= spotify_first_listens.first_played_at + $4 * interval '1 day'
+		AND (
+			(spotify_first_listens.kind = 'track' AND spotify_played_tracks.track_id = spotify_first_listens.id)
+			OR (spotify_first_listens.kind = 'artist' AND EXISTS (
+				SELECT 1
+				FROM spotify_credits
+				WHERE spotify_credits.track_id = spotify_played_tracks.track_id
+					AND spotify_credits.artist_id = spotify_first_listens.id
+			))
+		)
+) later
+WHERE spotify_first_listens.user_id = $1
+	AND spotify_first_listens.first_played_at BETWEEN $2 AND $3
+	AND ($5 = 0 OR spotify_first_listens.account_id = $5)`
+
+// Discovery is the first time the user heard a track or artist
+type Discovery struct {
+	// Kind is one of track or artist
+	Kind          string    `json:"kind"`
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	FirstPlayedAt time.Time `json:"first_played_at"`
+	// LaterPlays are plays at least a week after the first
+	LaterPlays int  `json:"later_plays"`
+	Stuck      bool `json:"stuck"`
+}
+
+type DiscoveryCount struct {
+	// Start is the date the bucket starts on, in the user's timezone
+	Start        string `json:"start"`
+	Tracks       int    `json:"tracks"`
+	Artists      int    `json:"artists"`
+	StuckTracks  int    `json:"stuck_tracks"`
+	StuckArtists int    `json:"stuck_artists"`
+}
+
+// GetDiscoveries returns the tracks and artists first heard in the range, most recent first
+func (s HistoryStore) GetDiscoveries(
+	ctx context.Context, listener Listener, start, end time.Time, limit int,
+) ([]Discovery, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH discoveries AS (`+discoveries+`
+)
+SELECT discoveries.kind, discoveries.id, COALESCE(spotify_tracks.name, spotify_artists.name, ''),
+	discoveries.first_played_at, discoveries.later_plays
+FROM discoveries
+LEFT JOIN spotify_tracks ON discoveries.kind = 'track' AND spotify_tracks.id = discoveries.id
+LEFT JOIN spotify_artists ON discoveries.kind = 'artist' AND spotify_artists.id = discoveries.id
+ORDER BY discoveries.first_played_at DESC, discoveries.kind
+LIMIT $6`,
+		listener.UserID, start, end, stuckAfterDays, listener.AccountID, limit)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]Discovery, 0)
+	for rows.Next() {
+		var d Discovery
+		if err = rows.Scan(&d.Kind, &d.ID, &d.Name, &d.FirstPlayedAt, &d.LaterPlays); err != nil {
+			return nil, err
+		}
+		d.Stuck = d.LaterPlays > 0
+		results = append(results, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetDiscoveryCounts counts discoveries in the range per bucket, in loc
+func (s HistoryStore) GetDiscoveryCounts(
+	ctx context.Context, listener Listener, start, end time.Time, bucket string, loc *time.Location,
+) ([]DiscoveryCount, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH discoveries AS (`+discoveries+`
+)
+SELECT date_trunc($6, first_played_at AT TIME ZONE $7) AS bucket,
+	COUNT(*) FILTER (WHERE kind = 'track'),
+	COUNT(*) FILTER (WHERE kind = 'artist'),
+	COUNT(*) FILTER (WHERE kind = 'track' AND later_plays > 0),
+	COUNT(*) FILTER (WHERE kind = 'artist' AND later_plays > 0)
+FROM discoveries
+GROUP BY 1
+ORDER BY 1`,
+		listener.UserID, start, end, stuckAfterDays, listener.AccountID, bucket, loc.String())
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]DiscoveryCount, 0)
+	for rows.Next() {
+		var (
+			count       DiscoveryCount
+			bucketStart time.Time
+		)
+		if err = rows.Scan(&bucketStart, &count.Tracks, &count.Artists,
+			&count.StuckTracks, &count.StuckArtists); err != nil {
+			return nil, err
+		}
+		count.Start = bucketStart.Format(time.DateOnly)
+		counts = append(counts, count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (svc Controller) getDiscoveries(c *gin.Context, listener Listener, logger *slog.Logger) {
+	defaults := DefaultStatsOptions()
+	defaults.Bucket = BucketMonth
+	defaults.Limit = defaultDiscoveryLimit
+	opts, r, ok := svc.resolveStats(c, listener.UserID, logger, defaults)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	results, err := svc.History.GetDiscoveries(ctx, listener, r.Start, r.End, opts.Limit)
+	if err != nil {
+		logger.Error("error loading discoveries", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	counts, err := svc.History.GetDiscoveryCounts(ctx, listener, r.Start, r.End, opts.Bucket, r.Location)
+	if err != nil {
+		logger.Error("error loading discovery counts", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"start":       r.Start,
+		"end":         r.End,
+		"bucket":      opts.Bucket,
+		"discoveries": results,
+		"counts":      counts,
+	})
+}
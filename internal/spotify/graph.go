@@ -0,0 +1,194 @@
+package spotify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/graph"
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+// ways plays can be grouped, where artists in the same group are listened to together
+const (
+	// GroupByWindow groups plays into sessions, broken up by gaps in listening
+	GroupByWindow  = "window"
+	GroupByContext = "context"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatGraphML = "graphml"
+	FormatDOT     = "dot"
+)
+
+type GraphOptions struct {
+	Options
+	MinWeight     int    `form:"min_weight"`
+	By            string `form:"by"`
+	WindowMinutes int    `form:"window_minutes"`
+	Format        string `form:"format"`
+}
+
+func DefaultGraphOptions() GraphOptions {
+	return GraphOptions{
+		MinWeight:     2,
+		By:            GroupByWindow,
+		WindowMinutes: 30,
+		Format:        FormatJSON,
+	}
+}
+
+func (opts GraphOptions) Validate() error {
+	switch opts.By {
+	case GroupByWindow, GroupByContext:
+	default:
+		return fmt.Errorf("by must be one of %v or %v", GroupByWindow, GroupByContext)
+	}
+	switch opts.Format {
+	case FormatJSON, FormatGraphML, FormatDOT:
+	default:
+		return fmt.Errorf("format must be one of %v, %v or %v", FormatJSON, FormatGraphML, FormatDOT)
+	}
+	if opts.MinWeight <= 0 || opts.WindowMinutes <= 0 {
+		return fmt.Errorf("min_weight and window_minutes must be positive")
+	}
+	return nil
+}
+
+// ArtistPlay is a play along with every artist credited on the track
+type ArtistPlay struct {
+	PlayedAt   time.Time
+	ContextURI string
+	Artists    []Identifier
+}
+
+// GetArtistPlays returns the plays in the range with their artists, oldest first
+func (s HistoryStore) GetArtistPlays(
+	ctx context.Context, listener Listener, start, end time.Time,
+) ([]ArtistPlay, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT spotify_played_tracks.played_at,
+	COALESCE(spotify_played_tracks.context_blob->>'uri', ''),
+	spotify_artists.id, spotify_artists.name
+FROM spotify_played_tracks
+JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND ($4 = 0 OR spotify_played_tracks.account_id = $4)
+ORDER BY spotify_played_tracks.played_at`,
+		listener.UserID, start, end, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	plays := make([]ArtistPlay, 0)
+	for rows.Next() {
+		var (
+			play   ArtistPlay
+			artist Identifier
+		)
+		if err = rows.Scan(&play.PlayedAt, &play.ContextURI, &artist.ID, &artist.Name); err != nil {
+			return nil, err
+		}
+		// a row per credit, and plays are unique per user by time
+		if n := len(plays); n > 0 && plays[n-1].PlayedAt.Equal(play.PlayedAt) {
+			plays[n-1].Artists = append(plays[n-1].Artists, artist)
+			continue
+		}
+		play.Artists = []Identifier{artist}
+		plays = append(plays, play)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return plays, nil
+}
+
+// buildArtistGraph links artists that were played in the same group
+func buildArtistGraph(plays []ArtistPlay, opts GraphOptions) graph.Graph {
+	b := graph.NewBuilder()
+	groups := make(map[string][]string)
+	var (
+		session  []string
+		lastPlay time.Time
+		gap      = time.Duration(opts.WindowMinutes) * time.Minute
+	)
+	for _, play := range plays {
+		if opts.By == GroupByWindow && !lastPlay.IsZero() && play.PlayedAt.Sub(lastPlay) > gap {
+			b.AddGroup(session)
+			session = nil
+		}
+		lastPlay = play.PlayedAt
+
+		for _, artist := range play.Artists {
+			b.AddNode(artist.ID, artist.Name)
+			switch opts.By {
+			case GroupByWindow:
+				session = append(session, artist.ID)
+			case GroupByContext:
+				// plays without a context have nothing in common
+				if play.ContextURI != "" {
+					groups[play.ContextURI] = append(groups[play.ContextURI], artist.ID)
+				}
+			}
+		}
+	}
+	b.AddGroup(session)
+	for _, group := range groups {
+		b.AddGroup(group)
+	}
+	return b.Graph(opts.MinWeight)
+}
+
+func (svc Controller) getGraph(c *gin.Context, listener Listener, logger *slog.Logger) {
+	opts := DefaultGraphOptions()
+	if err := c.BindQuery(&opts); err != nil {
+		logger.Error("error binding query for graph", "error", err)
+		zgin.BadRequest(c, "please provide correct query params")
+		return
+	} else if err = opts.Validate(); err != nil {
+		zgin.BadRequest(c, err.Error())
+		return
+	}
+	r, ok := svc.resolveStatsRange(c, listener.UserID, logger, opts.Options)
+	if !ok {
+		return
+	}
+
+	plays, err := svc.History.GetArtistPlays(c.Request.Context(), listener, r.Start, r.End)
+	if err != nil {
+		logger.Error("error loading artist plays", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	g := buildArtistGraph(plays, opts)
+
+	switch opts.Format {
+	case FormatGraphML:
+		c.Header("Content-Type", "application/graphml+xml")
+		err = g.WriteGraphML(c.Writer)
+	case FormatDOT:
+		c.Header("Content-Type", "text/vnd.graphviz")
+		err = g.WriteDOT(c.Writer, "artists")
+	default:
+		c.IndentedJSON(http.StatusOK, gin.H{
+			"start": r.Start,
+			"end":   r.End,
+			"graph": g,
+		})
+	}
+	if err != nil {
+		logger.Error("error writing graph", "error", err)
+	}
+}
@@ -0,0 +1,43 @@
+package spotify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zestze/zest-backend/internal/graph"
+)
+
+func TestBuildArtistGraph(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2024, 2, 10, 17, 0, 0, 0, time.UTC)
+	play := func(minutes int, contextURI string, ids ...string) ArtistPlay {
+		p := ArtistPlay{PlayedAt: start.Add(time.Duration(minutes) * time.Minute), ContextURI: contextURI}
+		for _, id := range ids {
+			p.Artists = append(p.Artists, Identifier{ID: id, Name: "artist " + id})
+		}
+		return p
+	}
+	plays := []ArtistPlay{
+		play(0, "spotify:playlist:a", "phantogram"),
+		play(4, "spotify:playlist:a", "tame"),
+		play(8, "", "phantogram", "big boi"),
+		// a new session, but the same playlist
+		play(120, "spotify:playlist:a", "phantogram"),
+		play(124, "spotify:playlist:a", "tame"),
+	}
+
+	opts := DefaultGraphOptions()
+	g := buildArtistGraph(plays, opts)
+	assert.Equal([]graph.Edge{{Source: "phantogram", Target: "tame", Weight: 2}}, g.Edges)
+
+	opts.MinWeight = 1
+	g = buildArtistGraph(plays, opts)
+	assert.Len(g.Edges, 3)
+
+	// the whole playlist is one group, and the play without a context is in none
+	opts.By = GroupByContext
+	g = buildArtistGraph(plays, opts)
+	assert.Equal([]graph.Edge{{Source: "phantogram", Target: "tame", Weight: 1}}, g.Edges)
+}
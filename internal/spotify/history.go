@@ -0,0 +1,18 @@
+package spotify
+
+import (
+	"database/sql"
+)
+
+// HistoryStore answers read-only questions about a user's play history.
+// queries are written against the normalized tables that StoreV2 persists to,
+// and generally rely on postgres specific features.
+type HistoryStore struct {
+	db *sql.DB
+}
+
+func NewHistoryStore(db *sql.DB) HistoryStore {
+	return HistoryStore{
+		db: db,
+	}
+}
@@ -0,0 +1,797 @@
+//go:build integration
+// +build integration
+
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zestze/zest-backend/internal/lastfm"
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+// historyForTesting sets up a database with the mock songs persisted for a single user,
+// on the only account they've linked
+func historyForTesting(t *testing.T, dbName string) (*sql.DB, Listener, func()) {
+	t.Helper()
+	ctx := context.Background()
+
+	db, toDefer, err := zql.ForTesting(ctx, dbName, "localhost", "../../schema.sql", true)
+	assert.NoError(t, err)
+
+	userID, err := user.NewStore(db).PersistUser(ctx, "zeke", "reyna", 1)
+	assert.NoError(t, err)
+
+	account, err := NewAccountStore(db).LinkAccount(ctx, int(userID), UserObject{ID: "zeke", DisplayName: "Zeke"})
+	assert.NoError(t, err)
+	listener := Listener{UserID: int(userID), AccountID: account.ID}
+
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	_, err = NewStoreV2(db).PersistRecentlyPlayed(ctx, songs, listener)
+	assert.NoError(t, err)
+
+	return db, listener, func() {
+		db.Close()
+		toDefer()
+	}
+}
+
+func TestHistory_Search(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_search")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	results, err := store.Search(ctx, listener, "phantogram", defaultSearchLimit)
+	assert.NoError(err)
+	if assert.NotEmpty(results) {
+		assert.Equal("artist", results[0].Kind)
+		assert.Equal("Phantogram", results[0].Name)
+		assert.True(results[0].Listens > 0)
+	}
+
+	// trigram matching should survive typos
+	results, err = store.Search(ctx, listener, "phantogrm", defaultSearchLimit)
+	assert.NoError(err)
+	assert.NotEmpty(results)
+}
+
+func TestImport_Scrobbles(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_import")
+	defer cleanup()
+	store := NewImportStore(db)
+
+	// the mock songs were played around 2024-02-10T17:00Z
+	scrobbles := []lastfm.Scrobble{
+		// exact match, but long before anything we have
+		{Artist: "phantogram", Track: "don't move", PlayedAt: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)},
+		// on repeat, which isn't a duplicate since it's from the same source
+		{Artist: "phantogram", Track: "don't move", PlayedAt: time.Date(2023, 1, 1, 12, 4, 0, 0, time.UTC)},
+		// fuzzy match
+		{Artist: "Phantogramm", Track: "Dont Move", PlayedAt: time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)},
+		// already have this play from spotify
+		{Artist: "Phantogram", Track: "Don't Move", PlayedAt: time.Date(2024, 2, 10, 17, 45, 0, 0, time.UTC)},
+		{Artist: "Nobody", Track: "Nothing", PlayedAt: time.Date(2023, 1, 3, 12, 0, 0, 0, time.UTC)},
+	}
+	result, err := store.ImportScrobbles(ctx, listener.UserID, SourceLastFM, scrobbles)
+	assert.NoError(err)
+	assert.Equal(ImportResult{Matched: 4, Persisted: 3, Duplicates: 1, Unmatched: 1}, result)
+
+	unmatched, err := store.GetUnmatched(ctx, listener.UserID)
+	assert.NoError(err)
+	if assert.Len(unmatched, 1) {
+		assert.Equal("Nobody", unmatched[0].Artist)
+	}
+
+	// importing again is a no-op
+	result, err = store.ImportScrobbles(ctx, listener.UserID, SourceLastFM, scrobbles)
+	assert.NoError(err)
+	assert.Equal(0, result.Persisted)
+}
+
+func TestImport_Listens(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_listens")
+	defer cleanup()
+	store := NewImportStore(db)
+
+	listens := []Listen{
+		{Artist: "Phantogram", Track: "Don't Move", PlayedAt: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)},
+		// a local file we've never heard of
+		{Artist: "Nobody", Album: "Nowhere", Track: "Nothing", DurationMS: 180000,
+			PlayedAt: time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)},
+		{Artist: "nobody", Album: "Nowhere", Track: "nothing",
+			PlayedAt: time.Date(2023, 1, 3, 12, 0, 0, 0, time.UTC)},
+	}
+	result, err := store.PersistListens(ctx, listener.UserID, SourceListenBrainz, listens)
+	assert.NoError(err)
+	assert.Equal(ImportResult{Matched: 2, Persisted: 3}, result)
+
+	// both plays of the unknown track should share the same synthetic rows
+	var (
+		trackID string
+		plays   int
+	)
+	err = db.QueryRowContext(ctx, `
+SELECT track_id, count(*)
+FROM spotify_played_tracks
+WHERE user_id = $1 AND source = $2 AND track_id LIKE 'local:%'
+GROUP BY track_id`, listener.UserID, SourceListenBrainz).Scan(&trackID, &plays)
+	assert.NoError(err)
+	assert.Equal(localID("track", "Nobody", "Nothing"), trackID)
+	assert.Equal(2, plays)
+
+	// a track on repeat is submitted one play at a time, and every play counts
+	looped := Listen{Artist: "Phantogram", Track: "Don't Move", PlayedAt: time.Date(2023, 1, 5, 12, 0, 0, 0, time.UTC)}
+	for range 2 {
+		result, err = store.PersistListens(ctx, listener.UserID, SourceListenBrainz, []Listen{looped})
+		assert.NoError(err)
+		assert.Equal(ImportResult{Matched: 1, Persisted: 1}, result)
+		looped.PlayedAt = looped.PlayedAt.Add(4 * time.Minute)
+	}
+
+	// a spotify id we haven't synced yet doesn't get made up rows,
+	// which would otherwise stick once spotify reports the real track
+	unsynced := "0unsyncedSpotifyTrack0"
+	result, err = store.PersistListens(ctx, listener.UserID, SourceListenBrainz, []Listen{
+		{Artist: "Somebody", Album: "Somewhere", Track: "Something", SpotifyID: unsynced,
+			PlayedAt: time.Date(2023, 1, 4, 12, 0, 0, 0, time.UTC)},
+	})
+	assert.NoError(err)
+	assert.Equal(ImportResult{Persisted: 1}, result)
+
+	var synced int
+	assert.NoError(db.QueryRowContext(ctx,
+		`SELECT count(*) FROM spotify_tracks WHERE id = $1`, unsynced).Scan(&synced))
+	assert.Equal(0, synced)
+}
+
+func TestHistory_Rediscover(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_rediscover")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	// the mock songs were played around 2024-02-10T17:00Z
+	opts := DefaultRediscoverOptions()
+	opts.MinPlays = 1
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	results, err := store.Rediscover(ctx, listener, now, opts)
+	assert.NoError(err)
+	if assert.NotEmpty(results) {
+		assert.True(results[0].Score >= results[len(results)-1].Score)
+		assert.True(results[0].DaysSince > opts.QuietDays)
+		assert.NotEmpty(results[0].Reason)
+	}
+
+	// still within the quiet period, so nothing to rediscover
+	results, err = store.Rediscover(ctx, listener, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), opts)
+	assert.NoError(err)
+	assert.Empty(results)
+}
+
+func TestHistory_GetContextPlays(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_contexts")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	// the mock songs were played around 2024-02-10T17:00Z
+	start := time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)
+	plays, err := store.GetContextPlays(ctx, listener, start, start.Add(24*time.Hour))
+	assert.NoError(err)
+	if assert.NotEmpty(plays) {
+		assert.Equal(ContextPlaylist, plays[0].Type)
+		assert.Equal("37i9dQZF1EP6YuccBxUcC1", plays[0].ID())
+	}
+}
+
+func TestContexts_AlbumTracks(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, _, cleanup := historyForTesting(t, "test_spotify_album_tracks")
+	defer cleanup()
+	store := NewContextStore(db)
+
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	listed, empty, unlisted := songs[0].Track.Album.ID, songs[1].Track.Album.ID, songs[2].Track.Album.ID
+
+	tracks := []AlbumTrack{{ID: songs[0].Track.ID, Name: songs[0].Track.Name, DiscNumber: 1, TrackNumber: 1}}
+	assert.NoError(store.PersistAlbumTracks(ctx, listed, tracks))
+	// albums without tracks are cached too, so they aren't fetched every time
+	assert.NoError(store.PersistAlbumTracks(ctx, empty, nil))
+
+	tracklists, err := store.GetAlbumTracks(ctx, []string{listed, empty, unlisted})
+	assert.NoError(err)
+	assert.Equal(tracks, tracklists[listed])
+	if assert.Contains(tracklists, empty) {
+		assert.Empty(tracklists[empty])
+	}
+	assert.NotContains(tracklists, unlisted)
+}
+
+func TestHistory_Popularity(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_popularity")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	// the mock songs were played around 2024-02-10T17:00Z, which is still the 10th in new york
+	loc, err := time.LoadLocation("America/New_York")
+	assert.NoError(err)
+	start := time.Date(2024, 2, 1, 0, 0, 0, 0, loc)
+	end := start.AddDate(0, 1, 0)
+
+	series, err := store.GetPopularitySeries(ctx, listener, start, end, BucketDay, loc)
+	assert.NoError(err)
+	if assert.Len(series, 1) {
+		assert.Equal("2024-02-10", series[0].Start)
+		assert.True(series[0].Mainstream > 0)
+	}
+
+	obscure, err := store.GetArtistsByPopularity(ctx, listener, start, end, true, 3)
+	assert.NoError(err)
+	mainstream, err := store.GetArtistsByPopularity(ctx, listener, start, end, false, 3)
+	assert.NoError(err)
+	if assert.NotEmpty(obscure) && assert.NotEmpty(mainstream) {
+		assert.True(obscure[0].Popularity <= mainstream[0].Popularity)
+	}
+
+	// the only user is the least mainstream of themselves
+	comparison, err := store.ComparePopularity(ctx, listener, start, end)
+	assert.NoError(err)
+	if assert.NotNil(comparison) {
+		assert.Equal(1, comparison.Users)
+		assert.Equal(0.0, comparison.Percentile)
+	}
+}
+
+func TestHistory_Discoveries(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_discoveries")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	// the mock songs were played around 2024-02-10T17:00Z, so everything in them is a discovery
+	start := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	results, err := store.GetDiscoveries(ctx, listener, start, end, defaultDiscoveryLimit)
+	assert.NoError(err)
+	if assert.NotEmpty(results) {
+		assert.NotEmpty(results[0].Name)
+		assert.False(results[0].Stuck)
+	}
+
+	// a play a month later makes the track stick
+	_, err = NewImportStore(db).PersistListens(ctx, listener.UserID, SourceListenBrainz, []Listen{
+		{Artist: "Phantogram", Track: "Don't Move", PlayedAt: time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)},
+	})
+	assert.NoError(err)
+
+	counts, err := store.GetDiscoveryCounts(ctx, listener, start, end, BucketMonth, time.UTC)
+	assert.NoError(err)
+	if assert.Len(counts, 1) {
+		assert.Equal("2024-02-01", counts[0].Start)
+		assert.True(counts[0].Tracks > 0)
+		assert.Equal(1, counts[0].StuckTracks)
+		assert.True(counts[0].StuckArtists >= 1)
+	}
+}
+
+func TestHistory_GetTopItems(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_top_items")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	// the mock songs were played around 2024-02-10T17:00Z
+	start := time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)
+	for _, kind := range []string{KindTrack, KindArtist} {
+		items, err := store.GetTopItems(ctx, listener, kind, start, start.Add(24*time.Hour), 3)
+		assert.NoError(err)
+		if assert.NotEmpty(items, kind) {
+			assert.Equal(1, items[0].Rank)
+			assert.True(items[0].Minutes > 0)
+		}
+	}
+
+	_, err := store.GetTopItems(ctx, listener, "album", start, start.Add(24*time.Hour), 3)
+	assert.Error(err)
+
+	// minutes are found for items outside the top, and left out for ones that weren't played
+	items, err := store.GetTopItems(ctx, listener, KindTrack, start, start.Add(24*time.Hour), 5)
+	assert.NoError(err)
+	if assert.Len(items, 5) {
+		last := items[4]
+		minutes, err := store.GetItemMinutes(ctx, listener, KindTrack,
+			[]string{last.ID, "nothing"}, start, start.Add(24*time.Hour))
+		assert.NoError(err)
+		assert.Equal(map[string]float64{last.ID: last.Minutes}, minutes)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_accounts")
+	defer cleanup()
+	store := NewAccountStore(db)
+	history := NewHistoryStore(db)
+
+	// relinking the same spotify user keeps the account
+	relinked, err := store.LinkAccount(ctx, listener.UserID, UserObject{ID: "zeke", DisplayName: "zeke2"})
+	assert.NoError(err)
+	assert.Equal(listener.AccountID, relinked.ID)
+
+	// accounts from before spotify ids were recorded are claimed by the next new spotify user
+	var legacyID int
+	assert.NoError(db.QueryRowContext(ctx, `
+INSERT INTO spotify_accounts (user_id, display_name) VALUES ($1, '') RETURNING id`,
+		listener.UserID).Scan(&legacyID))
+	other, err := store.LinkAccount(ctx, listener.UserID, UserObject{ID: "reyna", DisplayName: "Reyna"})
+	assert.NoError(err)
+	assert.Equal(legacyID, other.ID)
+
+	accounts, err := store.GetAccounts(ctx, AllAccounts(listener.UserID))
+	assert.NoError(err)
+	assert.Len(accounts, 2)
+
+	resolved, err := store.Resolve(ctx, AllAccounts(listener.UserID))
+	assert.NoError(err)
+	assert.Equal(listener, resolved)
+	_, err = store.Resolve(ctx, Listener{UserID: listener.UserID + 1, AccountID: other.ID})
+	assert.ErrorIs(err, ErrNoAccount)
+
+	// the mock songs were all played on the first account
+	start := time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	for l, expected := range map[Listener]bool{
+		listener:                     true,
+		AllAccounts(listener.UserID): true,
+		{listener.UserID, other.ID}:  false,
+	} {
+		items, err := history.GetTopItems(ctx, l, KindTrack, start, end, 3)
+		assert.NoError(err)
+		assert.Equal(expected, len(items) > 0, l)
+	}
+
+	countPlays := func() int {
+		var n int
+		assert.NoError(db.QueryRowContext(ctx,
+			`SELECT count(*) FROM spotify_played_tracks WHERE user_id = $1`, listener.UserID).Scan(&n))
+		return n
+	}
+
+	// plays at the same moment on different accounts are both kept
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	_, err = NewStoreV2(db).PersistRecentlyPlayed(ctx, songs, Listener{listener.UserID, other.ID})
+	assert.NoError(err)
+	assert.Equal(2*len(songs), countPlays())
+
+	// unlinking keeps the plays, but not the account they were played on
+	ok, err := store.DeleteAccount(ctx, listener.UserID, listener.AccountID)
+	assert.NoError(err)
+	assert.True(ok)
+	items, err := history.GetTopItems(ctx, AllAccounts(listener.UserID), KindTrack, start, end, 3)
+	assert.NoError(err)
+	assert.NotEmpty(items)
+	items, err = history.GetTopItems(ctx, listener, KindTrack, start, end, 3)
+	assert.NoError(err)
+	assert.Empty(items)
+
+	// the other account's plays now collide with the unlinked ones, so only one of each is kept
+	ok, err = store.DeleteAccount(ctx, listener.UserID, other.ID)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(len(songs), countPlays())
+}
+
+func TestPlaylists_Snapshots(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_playlists")
+	defer cleanup()
+	store := NewPlaylistStore(db)
+
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	items := make([]PlaylistTrackObject, 0, len(songs))
+	for _, song := range songs {
+		items = append(items, PlaylistTrackObject{AddedAt: song.PlayedAt, Track: &song.Track})
+	}
+
+	var p SimplifiedPlaylistObject
+	p.ID, p.Name, p.SnapshotID = "playlist", "Playlist", "v1"
+	added, removed, err := store.PersistSnapshot(ctx, p, items[:3])
+	assert.NoError(err)
+	assert.Equal(3, added)
+	assert.Equal(0, removed)
+
+	// swap a track out
+	p.SnapshotID = "v2"
+	added, removed, err = store.PersistSnapshot(ctx, p, append(items[1:3], items[4]))
+	assert.NoError(err)
+	assert.Equal(1, added)
+	assert.Equal(1, removed)
+
+	snapshots, err := store.GetSnapshotIDs(ctx, []string{p.ID, "missing"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{p.ID: "v2"}, snapshots)
+
+	// only playlists in one of the user's libraries have a history
+	_, ok, err := store.GetHistory(ctx, listener.UserID, p.ID)
+	assert.NoError(err)
+	assert.False(ok)
+
+	assert.NoError(store.LinkPlaylists(ctx, listener, []string{p.ID}))
+	history, ok, err := store.GetHistory(ctx, listener.UserID, p.ID)
+	assert.NoError(err)
+	assert.True(ok)
+	if assert.Len(history, 2) {
+		assert.Equal("v2", history[0].SnapshotID)
+		assert.Equal("v1", history[0].PreviousSnapshotID)
+		assert.Equal(songs[4].Track.ID, history[0].Added[0].TrackID)
+		assert.Equal(songs[0].Track.ID, history[0].Removed[0].TrackID)
+		assert.Len(history[1].Added, 3)
+	}
+
+	playlists, err := store.GetSyncedPlaylists(ctx, AllAccounts(listener.UserID))
+	assert.NoError(err)
+	if assert.Len(playlists, 1) {
+		assert.Equal(3, playlists[0].Tracks)
+	}
+}
+
+func TestLibrary_SavedTracks(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_library")
+	defer cleanup()
+	store := NewLibraryStore(db)
+
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	saved := make([]SavedTrackObject, 0, 3)
+	for _, song := range songs[:3] {
+		saved = append(saved, SavedTrackObject{AddedAt: song.PlayedAt, Track: song.Track})
+	}
+
+	result, err := store.PersistSavedTracks(ctx, listener, saved)
+	assert.NoError(err)
+	assert.Equal(LibrarySyncResult{Tracks: 3, Added: 3}, result)
+
+	// unlike the first track, and like another
+	saved = append(saved[1:], SavedTrackObject{AddedAt: songs[4].PlayedAt, Track: songs[4].Track})
+	result, err = store.PersistSavedTracks(ctx, listener, saved)
+	assert.NoError(err)
+	assert.Equal(LibrarySyncResult{Tracks: 3, Added: 1, Removed: 1}, result)
+
+	tracks, err := store.GetSavedTracks(ctx, listener, false, false)
+	assert.NoError(err)
+	assert.Len(tracks, 3)
+	for _, track := range tracks {
+		assert.Nil(track.RemovedAt)
+		assert.NotEqual(songs[0].Track.ID, track.TrackID)
+	}
+
+	tracks, err = store.GetSavedTracks(ctx, AllAccounts(listener.UserID), true, false)
+	assert.NoError(err)
+	assert.Len(tracks, 4)
+
+	// every mock song has been played
+	unplayed, err := store.GetSavedTracks(ctx, listener, false, true)
+	assert.NoError(err)
+	assert.Empty(unplayed)
+
+	// like a track that has never been played
+	neverPlayed := songs[1].Track
+	neverPlayed.ID = "0neverPlayedTrack00000"
+	neverPlayed.Name = "Never Played"
+	saved = append(saved, SavedTrackObject{AddedAt: songs[4].PlayedAt, Track: neverPlayed})
+	result, err = store.PersistSavedTracks(ctx, listener, saved)
+	assert.NoError(err)
+	assert.Equal(LibrarySyncResult{Tracks: 4, Added: 1}, result)
+
+	unplayed, err = store.GetSavedTracks(ctx, listener, false, true)
+	assert.NoError(err)
+	if assert.Len(unplayed, 1) {
+		assert.Equal(neverPlayed.ID, unplayed[0].TrackID)
+		assert.Equal(0, unplayed[0].Plays)
+	}
+
+	counts, err := store.GetLikeCounts(ctx, listener, time.UTC)
+	assert.NoError(err)
+	liked, removed := 0, 0
+	for _, count := range counts {
+		liked += count.Liked
+		removed += count.Removed
+	}
+	assert.Equal(5, liked)
+	assert.Equal(1, removed)
+
+	_, err = store.PersistSavedTracks(ctx, AllAccounts(listener.UserID), saved)
+	assert.ErrorIs(err, ErrNoAccount)
+}
+
+func TestReleases(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_releases")
+	defer cleanup()
+	store := NewReleaseStore(db)
+
+	artist := ArtistObject{Identifier: Identifier{ID: "artist", Name: "Artist"}}
+	tracked, err := store.TrackArtists(ctx, listener, []ArtistObject{artist, artist}, 1)
+	assert.NoError(err)
+	// followed, plus everyone in the mock history
+	assert.Contains(tracked, TrackedArtist{ID: artist.ID, Name: artist.Name, Reason: TrackedFollowed})
+
+	now := time.Now()
+	release := func(id string, releasedAt time.Time) ReleaseObject {
+		return ReleaseObject{
+			Identifier:           Identifier{ID: id, Name: id},
+			Type:                 "album",
+			ReleaseDate:          releasedAt.Format(time.DateOnly),
+			ReleaseDatePrecision: "day",
+		}
+	}
+
+	// only recent releases are new the first time an artist is polled
+	fresh, err := store.PersistReleases(ctx, listener.UserID, artist.ID, []ReleaseObject{
+		release("old", now.AddDate(-2, 0, 0)),
+		release("recent", now.AddDate(0, 0, -2)),
+	}, now)
+	assert.NoError(err)
+	if assert.Len(fresh, 1) {
+		assert.Equal("recent", fresh[0].AlbumID)
+		assert.Equal(artist.Name, fresh[0].ArtistName)
+	}
+
+	// after that, anything we haven't seen is new, even if it's old
+	later := now.Add(time.Hour)
+	fresh, err = store.PersistReleases(ctx, listener.UserID, artist.ID, []ReleaseObject{
+		release("old", now.AddDate(-2, 0, 0)),
+		release("recent", now.AddDate(0, 0, -2)),
+		release("unearthed", now.AddDate(-1, 0, 0)),
+	}, later)
+	assert.NoError(err)
+	if assert.Len(fresh, 1) {
+		assert.Equal("unearthed", fresh[0].AlbumID)
+	}
+
+	// releases another user has already seen are still new to someone polling the artist for the first time
+	otherID, err := user.NewStore(db).PersistUser(ctx, "other", "password", 2)
+	assert.NoError(err)
+	other := AllAccounts(int(otherID))
+	_, err = store.TrackArtists(ctx, other, []ArtistObject{artist}, 1)
+	assert.NoError(err)
+	fresh, err = store.PersistReleases(ctx, other.UserID, artist.ID, []ReleaseObject{
+		release("old", now.AddDate(-2, 0, 0)),
+		release("recent", now.AddDate(0, 0, -2)),
+		release("unearthed", now.AddDate(-1, 0, 0)),
+	}, later)
+	assert.NoError(err)
+	if assert.Len(fresh, 1) {
+		assert.Equal("recent", fresh[0].AlbumID)
+	}
+	releases, err := store.GetNewReleases(ctx, other.UserID, now)
+	assert.NoError(err)
+	assert.Len(releases, 1)
+
+	_, ok, err := store.Check(ctx, listener.UserID, later)
+	assert.NoError(err)
+	assert.False(ok)
+	last, ok, err := store.Check(ctx, listener.UserID, later.Add(time.Hour))
+	assert.NoError(err)
+	assert.True(ok)
+	assert.WithinDuration(later, last, time.Second)
+
+	releases, err = store.GetNewReleases(ctx, listener.UserID, now.Add(-time.Minute))
+	assert.NoError(err)
+	assert.Len(releases, 2)
+	releases, err = store.GetNewReleases(ctx, listener.UserID, now)
+	assert.NoError(err)
+	assert.Len(releases, 1)
+}
+
+func TestTop_ArtistRanks(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_top")
+	defer cleanup()
+	store := NewTopStore(db)
+
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	phantogram := songs[0].Track.Artists[0].Identifier
+	purityRing := songs[2].Track.Artists[0].Identifier
+
+	// the mock songs were played around 2024-02-10T17:00Z
+	day := time.Date(2024, 2, 11, 12, 0, 0, 0, time.UTC)
+	for i, items := range [][]Identifier{
+		{purityRing, phantogram},
+		{phantogram, purityRing},
+	} {
+		takenAt := day.AddDate(0, 0, i)
+		assert.NoError(store.PersistSnapshots(ctx, listener, []TopSnapshot{{
+			Kind:    TopArtists,
+			Term:    TermShort,
+			TakenOn: takenAt.Format(time.DateOnly),
+			Items:   items,
+		}}, takenAt))
+	}
+	// retaking a snapshot replaces it
+	assert.NoError(store.PersistSnapshots(ctx, listener, []TopSnapshot{{
+		Kind:    TopArtists,
+		Term:    TermShort,
+		TakenOn: day.Format(time.DateOnly),
+		Items:   []Identifier{purityRing, phantogram},
+	}}, day))
+
+	points, err := store.GetArtistRanks(ctx, listener, phantogram.ID, TermShort, day.AddDate(0, 0, -1), day.AddDate(0, 0, 7))
+	assert.NoError(err)
+	if assert.Len(points, 2) {
+		assert.Equal("2024-02-11", points[0].Date)
+		assert.Equal(2, *points[0].SpotifyRank)
+		assert.Equal(1, *points[1].SpotifyRank)
+		// every artist was played once, so they're all tied
+		assert.Equal(1, *points[0].ZestRank)
+		assert.Equal(1, points[0].Plays)
+	}
+
+	// nothing was played within the short term of a year later
+	later := day.AddDate(1, 0, 0)
+	assert.NoError(store.PersistSnapshots(ctx, listener, []TopSnapshot{{
+		Kind:    TopArtists,
+		Term:    TermShort,
+		TakenOn: later.Format(time.DateOnly),
+		Items:   []Identifier{purityRing},
+	}}, later))
+	points, err = store.GetArtistRanks(ctx, listener, phantogram.ID, TermShort, later.AddDate(0, 0, -1), later)
+	assert.NoError(err)
+	if assert.Len(points, 1) {
+		assert.Nil(points[0].SpotifyRank)
+		assert.Nil(points[0].ZestRank)
+		assert.Equal(0, points[0].Plays)
+	}
+
+	assert.ErrorIs(store.PersistSnapshots(ctx, AllAccounts(listener.UserID), nil, day), ErrNoAccount)
+}
+
+func TestHistory_Details(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_details")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	phantogram := songs[0].Track.Artists[0]
+
+	artist, ok, err := store.GetArtistDetail(ctx, listener, phantogram.ID, time.UTC)
+	assert.NoError(err)
+	if assert.True(ok) {
+		assert.Equal("Phantogram", artist.Name)
+		assert.Equal(1, artist.Plays)
+		assert.Equal(songs[0].PlayedAt, artist.FirstPlayedAt.UTC())
+		assert.Equal(artist.FirstPlayedAt, artist.LastPlayedAt)
+		assert.Equal([]MonthPlays{{Month: "2024-02-01", Plays: 1, Minutes: artist.Minutes}}, artist.Monthly)
+		if assert.Len(artist.TopTracks, 1) {
+			assert.Equal(songs[0].Track.ID, artist.TopTracks[0].ID)
+		}
+		if assert.Len(artist.Albums, 1) {
+			assert.Equal(songs[0].Track.Album.ID, artist.Albums[0].ID)
+		}
+		assert.Len(artist.contextPlays, 1)
+	}
+
+	// credited on a track with other artists
+	track, ok, err := store.GetTrackDetail(ctx, listener, songs[3].Track.ID, time.UTC)
+	assert.NoError(err)
+	if assert.True(ok) {
+		assert.Len(track.Artists, 3)
+		assert.Equal(1, track.Plays)
+	}
+
+	_, ok, err = store.GetArtistDetail(ctx, listener, "nobody", time.UTC)
+	assert.NoError(err)
+	assert.False(ok)
+	_, ok, err = store.GetTrackDetail(ctx, Listener{UserID: listener.UserID, AccountID: listener.AccountID + 1},
+		songs[3].Track.ID, time.UTC)
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestImages(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_images")
+	defer cleanup()
+	store := NewImageStore(db)
+
+	songs := mockFetchSongs(t, "mock_api_response.json")
+	track := songs[0].Track
+
+	// images are captured when albums are enriched, as well as when tracks are persisted
+	album := AlbumObject{Identifier: track.Album.Identifier, Type: track.Album.Type, Images: []ImageObject{
+		{URL: "https://i.scdn.co/image/small", Width: 64, Height: 64},
+		{URL: "https://i.scdn.co/image/large", Width: 640, Height: 640},
+	}}
+	assert.NoError(NewContextStore(db).PersistAlbum(ctx, album))
+
+	// tracks fall back to their album's images
+	images, err := store.GetImages(ctx, ImageTrack, track.ID)
+	assert.NoError(err)
+	assert.Equal([]ImageObject{album.Images[1], album.Images[0]}, images)
+
+	images, err = store.GetImages(ctx, ImageTrack, "nothing")
+	assert.NoError(err)
+	assert.Empty(images)
+
+	// played artists don't come with images, so they're looked up afterwards
+	artistIDs, err := store.GetArtistsWithoutImages(ctx, listener.UserID, maxArtistImageLookups)
+	assert.NoError(err)
+	assert.Contains(artistIDs, track.Artists[0].ID)
+	artist := ArtistObject{Identifier: track.Artists[0].Identifier, Images: []ImageObject{
+		{URL: "https://i.scdn.co/image/artist", Width: 640, Height: 640},
+	}}
+	// artists without images are still looked up once
+	assert.NoError(store.PersistArtistImages(ctx, artistIDs, []ArtistObject{artist}))
+	images, err = store.GetImages(ctx, ImageArtist, artist.ID)
+	assert.NoError(err)
+	assert.Equal(artist.Images, images)
+	artistIDs, err = store.GetArtistsWithoutImages(ctx, listener.UserID, maxArtistImageLookups)
+	assert.NoError(err)
+	assert.Empty(artistIDs)
+
+	_, ok, err := store.GetCached(ctx, "https://i.scdn.co/image/abc")
+	assert.NoError(err)
+	assert.False(ok)
+
+	cached, err := store.Cache(ctx, "https://i.scdn.co/image/abc", "image/jpeg", []byte("jpeg"))
+	assert.NoError(err)
+	assert.NotEmpty(cached.ETag)
+	img, ok, err := store.GetCached(ctx, "https://i.scdn.co/image/abc")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(cached, img)
+}
+
+func TestHistory_Badges(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	db, listener, cleanup := historyForTesting(t, "test_spotify_badges")
+	defer cleanup()
+	store := NewHistoryStore(db)
+
+	// the most recent mock song is Phantogram's, played 2024-02-10T17:49Z
+	badge, ok, err := store.GetLastPlayedBadge(ctx, listener.UserID, time.UTC)
+	assert.NoError(err)
+	if assert.True(ok) {
+		assert.Equal("Phantogram · Feb 10, 5:49 PM", badge.Subtitle)
+	}
+
+	badge, ok, err = store.GetTopArtistBadge(ctx, listener.UserID, time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC))
+	assert.NoError(err)
+	if assert.True(ok) {
+		assert.Equal("1 play", badge.Subtitle)
+	}
+
+	_, ok, err = store.GetTopArtistBadge(ctx, listener.UserID, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(err)
+	assert.False(ok)
+	_, ok, err = store.GetLastPlayedBadge(ctx, listener.UserID+1, time.UTC)
+	assert.NoError(err)
+	assert.False(ok)
+}
@@ -0,0 +1,359 @@
+package spotify
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+const (
+	ImageAlbum  = "album"
+	ImageArtist = "artist"
+	// tracks use their album's images
+	ImageTrack = "track"
+
+	// spotify's largest images are 640px jpegs, so this is plenty
+	maxImageBytes = 5 << 20
+	// the image at a url never changes, only which url an item points to
+	imageMaxAge = 30 * 24 * time.Hour
+
+	// most artists spotify returns from one call to /artists
+	artistsPageSize = 50
+	// most artists to look up images for per sync, the rest are looked up by later syncs
+	maxArtistImageLookups = 2 * artistsPageSize
+)
+
+// ImageObject is one size of an album or artist's image. sizes can be unknown, and are zero if so.
+type ImageObject struct {
+	URL    string `json:"url"`
+	Height int    `json:"height"`
+	Width  int    `json:"width"`
+}
+
+// ArtistObject is an artist with their images, as returned by endpoints that list full artists
+type ArtistObject struct {
+	Identifier
+	Images []ImageObject `json:"images"`
+}
+
+// GetArtists returns the full artists, with their images. artists spotify doesn't know are skipped.
+//
+// see: https://developer.spotify.com/documentation/web-api/reference/get-multiple-artists
+func (c Client) GetArtists(ctx context.Context, token AccessToken, ids []string) ([]ArtistObject, error) {
+	artists := make([]ArtistObject, 0, len(ids))
+	for start := 0; start < len(ids); start += artistsPageSize {
+		chunk := ids[start:min(start+artistsPageSize, len(ids))]
+		var page struct {
+			// unknown ids come back as null
+			Artists []*ArtistObject `json:"artists"`
+		}
+		q := url.Values{"ids": {strings.Join(chunk, ",")}}
+		if _, err := c.get(ctx, token, "/artists", q, &page); err != nil {
+			return nil, err
+		}
+		for _, a := range page.Artists {
+			if a != nil {
+				artists = append(artists, *a)
+			}
+		}
+	}
+	return artists, nil
+}
+
+// FetchImage downloads an image from spotify's cdn, returning its body and content type
+func (c Client) FetchImage(ctx context.Context, url string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("error fetching image, status: [%v]", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, "", err
+	} else if len(body) > maxImageBytes {
+		return nil, "", fmt.Errorf("image is over %v bytes", maxImageBytes)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return body, contentType, nil
+}
+
+// pickImage picks the smallest image at least size pixels wide, or the largest if none are.
+// a size of zero picks the largest.
+func pickImage(images []ImageObject, size int) (ImageObject, bool) {
+	if len(images) == 0 {
+		return ImageObject{}, false
+	}
+
+	largest, fits := images[0], -1
+	for i, img := range images {
+		if img.Width > largest.Width {
+			largest = img
+		}
+		if size > 0 && img.Width >= size && (fits < 0 || img.Width < images[fits].Width) {
+			fits = i
+		}
+	}
+	if fits < 0 {
+		return largest, true
+	}
+	return images[fits], true
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// persistImages records the image urls of an album or artist
+func persistImages(ctx context.Context, e execer, kind, id string, images []ImageObject) error {
+	for _, img := range images {
+		if _, err := e.ExecContext(ctx, `
+INSERT INTO spotify_images
+(kind, id, url, width, height)
+VALUES
+($1, $2, $3, $4, $5)
+ON CONFLICT
+	DO NOTHING`, kind, id, img.URL, img.Width, img.Height); err != nil {
+			return fmt.Errorf("error inserting image for %v [%v]: %w", kind, id, err)
+		}
+	}
+	return nil
+}
+
+// GetArtistsWithoutImages returns up to limit artists the user has played that we haven't looked up images for.
+// recently played only includes artists without their images, so they have to be looked up separately.
+func (s ImageStore) GetArtistsWithoutImages(ctx context.Context, userID, limit int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT DISTINCT spotify_artists.id
+FROM spotify_artists
+JOIN spotify_credits ON spotify_credits.artist_id = spotify_artists.id
+JOIN spotify_played_tracks ON spotify_played_tracks.track_id = spotify_credits.track_id
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_artists.images_fetched_at IS NULL
+	AND NOT starts_with(spotify_artists.id, $2)
+	AND NOT EXISTS (
+		SELECT 1
+		FROM spotify_images
+		WHERE spotify_images.kind = $3 AND spotify_images.id = spotify_artists.id
+	)
+LIMIT $4`, userID, localIDPrefix, ImageArtist, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// PersistArtistImages records the images of the artists, and that every artist in ids was looked up,
+// so that artists without any images aren't looked up again.
+func (s ImageStore) PersistArtistImages(ctx context.Context, ids []string, artists []ArtistObject) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, artist := range artists {
+		if err = persistImages(ctx, tx, ImageArtist, artist.ID, artist.Images); err != nil {
+			return zql.Rollback(tx, err)
+		}
+	}
+	if _, err = tx.ExecContext(ctx, `
+UPDATE spotify_artists
+SET images_fetched_at = now()
+WHERE id = ANY($1)`, ids); err != nil {
+		return zql.Rollback(tx, err)
+	}
+	return tx.Commit()
+}
+
+// CachedImage is an image we've downloaded from spotify's cdn
+type CachedImage struct {
+	ContentType string
+	ETag        string
+	Body        []byte
+}
+
+// ImageStore keeps the image urls of albums and artists, and caches the images themselves
+type ImageStore struct {
+	db *sql.DB
+}
+
+func NewImageStore(db *sql.DB) ImageStore {
+	return ImageStore{
+		db: db,
+	}
+}
+
+// GetImages returns every size we know of the album, artist or track's image
+func (s ImageStore) GetImages(ctx context.Context, kind, id string) ([]ImageObject, error) {
+	// tracks don't have their own images
+	if kind == ImageTrack {
+		if err := s.db.QueryRowContext(ctx, `
+SELECT album_id
+FROM spotify_tracks
+WHERE id = $1`, id).Scan(&id); errors.Is(err, sql.ErrNoRows) {
+			return []ImageObject{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		kind = ImageAlbum
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT url, width, height
+FROM spotify_images
+WHERE kind = $1 AND id = $2
+ORDER BY width DESC`, kind, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := make([]ImageObject, 0)
+	for rows.Next() {
+		var img ImageObject
+		if err = rows.Scan(&img.URL, &img.Width, &img.Height); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// GetCached returns the cached image at url, or false if it isn't cached
+func (s ImageStore) GetCached(ctx context.Context, url string) (CachedImage, bool, error) {
+	var img CachedImage
+	err := s.db.QueryRowContext(ctx, `
+SELECT content_type, etag, body
+FROM spotify_image_cache
+WHERE url = $1`, url).Scan(&img.ContentType, &img.ETag, &img.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CachedImage{}, false, nil
+	} else if err != nil {
+		return CachedImage{}, false, err
+	}
+	return img, true, nil
+}
+
+// Cache stores the image downloaded from url, returning it with its etag set
+func (s ImageStore) Cache(ctx context.Context, url, contentType string, body []byte) (CachedImage, error) {
+	sum := sha256.Sum256(body)
+	img := CachedImage{
+		ContentType: contentType,
+		ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		Body:        body,
+	}
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO spotify_image_cache
+(url, content_type, etag, body)
+VALUES
+($1, $2, $3, $4)
+ON CONFLICT (url) DO UPDATE
+SET content_type = excluded.content_type, etag = excluded.etag,
+	body = excluded.body, fetched_at = now()`, url, img.ContentType, img.ETag, img.Body)
+	return img, err
+}
+
+// RegisterImages serves the images of albums, artists and tracks we know of. they're public,
+// so this doesn't need auth, and only urls we've stored are ever fetched.
+func (svc Controller) RegisterImages(r gin.IRouter) {
+	r.GET("/images/:kind/:id", svc.getImage)
+}
+
+func (svc Controller) getImage(c *gin.Context) {
+	ctx := c.Request.Context()
+	logger := zlog.Logger(ctx).With(slog.String("kind", c.Param("kind")), slog.String("id", c.Param("id")))
+
+	kind := c.Param("kind")
+	switch kind {
+	case ImageAlbum, ImageArtist, ImageTrack:
+	default:
+		zgin.BadRequest(c, fmt.Sprintf("kind must be one of %v, %v or %v", ImageAlbum, ImageArtist, ImageTrack))
+		return
+	}
+	size := 0
+	if raw := c.Query("size"); raw != "" {
+		var err error
+		if size, err = strconv.Atoi(raw); err != nil || size <= 0 {
+			zgin.BadRequest(c, "size must be a positive number of pixels")
+			return
+		}
+	}
+
+	images, err := svc.Images.GetImages(ctx, kind, c.Param("id"))
+	if err != nil {
+		logger.Error("error loading images", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	picked, ok := pickImage(images, size)
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{
+			"error": "no image for this " + kind,
+		})
+		return
+	}
+
+	img, ok, err := svc.Images.GetCached(ctx, picked.URL)
+	if err != nil {
+		logger.Error("error loading cached image", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if !ok {
+		body, contentType, err := svc.Client.FetchImage(ctx, picked.URL)
+		if err != nil {
+			logger.Error("error fetching image", "url", picked.URL, "error", err)
+			c.IndentedJSON(http.StatusBadGateway, gin.H{
+				"error": "couldn't fetch image from spotify",
+			})
+			return
+		}
+		if img, err = svc.Images.Cache(ctx, picked.URL, contentType, body); err != nil {
+			// still worth serving
+			logger.Warn("error caching image", "error", err)
+		}
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(imageMaxAge.Seconds())))
+	c.Header("ETag", img.ETag)
+	if c.GetHeader("If-None-Match") == img.ETag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, img.ContentType, img.Body)
+}
@@ -0,0 +1,107 @@
+package spotify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/zestze/zest-backend/internal/httptest"
+)
+
+func TestPickImage(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ok := pickImage(nil, 0)
+	assert.False(ok)
+
+	images := []ImageObject{
+		{URL: "medium", Width: 300},
+		{URL: "large", Width: 640},
+		{URL: "small", Width: 64},
+	}
+	for size, expected := range map[int]string{
+		0:    "large",
+		32:   "small",
+		64:   "small",
+		65:   "medium",
+		300:  "medium",
+		400:  "large",
+		1000: "large",
+	} {
+		img, ok := pickImage(images, size)
+		assert.True(ok)
+		assert.Equal(expected, img.URL, size)
+	}
+}
+
+func TestClient_FetchImage(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	jpeg := []byte("\xff\xd8\xff\xe0 not really a jpeg")
+	client := Client{Client: &http.Client{
+		Transport: httptest.RoundTripFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(jpeg)),
+			}, nil
+		}),
+	}}
+	body, contentType, err := client.FetchImage(ctx, "https://i.scdn.co/image/abc")
+	assert.NoError(err)
+	assert.Equal(jpeg, body)
+	// sniffed, since the cdn didn't say
+	assert.Equal("image/jpeg", contentType)
+
+	client = Client{Client: &http.Client{
+		Transport: httptest.RoundTripFunc(func(*http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(make([]byte, maxImageBytes+1))),
+			}, nil
+		}),
+	}}
+	_, _, err = client.FetchImage(ctx, "https://i.scdn.co/image/huge")
+	assert.Error(err)
+}
+
+func TestClient_GetArtists(t *testing.T) {
+	assert := assert.New(t)
+	token := AccessToken{Access: "access", ExpiresAt: time.Now().Add(time.Hour)}
+
+	ids := make([]string, artistsPageSize+1)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("artist%d", i)
+	}
+	calls := 0
+	client := Client{Client: &http.Client{
+		Transport: httptest.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			requested := strings.Split(req.URL.Query().Get("ids"), ",")
+			assert.LessOrEqual(len(requested), artistsPageSize)
+			// spotify returns null for ids it doesn't know
+			body := `{"artists": [null]}`
+			if requested[0] == "artist0" {
+				body = `{"artists": [{"id": "artist0", "name": "Artist", "images": [{"url": "https://i.scdn.co/image/artist", "width": 640, "height": 640}]}]}`
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+			}, nil
+		}),
+	}}
+	artists, err := client.GetArtists(context.Background(), token, ids)
+	assert.NoError(err)
+	assert.Equal(2, calls)
+	if assert.Len(artists, 1) {
+		assert.Equal("artist0", artists[0].ID)
+		assert.Len(artists[0].Images, 1)
+	}
+}
@@ -0,0 +1,281 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/lastfm"
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+// sources that a row in spotify_played_tracks can come from
+const (
+	SourceSpotify = "spotify"
+	SourceLastFM  = "lastfm"
+)
+
+const (
+	// plays of the same track from different sources are treated as the same listen when they're
+	// within the track's length of each other, plus this slack, since last.fm also scrobbles whatever
+	// is played through spotify. one stamps plays when they start, the other when they end.
+	duplicateSlack = time.Minute
+	// stands in for the length of tracks we don't know the duration of
+	defaultDuplicateWindow = 5 * time.Minute
+	// minimum summed trigram similarity of the track and artist names for a fuzzy match
+	fuzzyMatchThreshold = 1.2
+	maxImportSize       = 64 << 20
+)
+
+type ImportResult struct {
+	Matched    int `json:"matched"`
+	Persisted  int `json:"persisted"`
+	Duplicates int `json:"duplicates"`
+	Unmatched  int `json:"unmatched"`
+}
+
+type UnmatchedScrobble struct {
+	lastfm.Scrobble
+	Source string `json:"source"`
+}
+
+type ImportStore struct {
+	db *sql.DB
+}
+
+func NewImportStore(db *sql.DB) ImportStore {
+	return ImportStore{
+		db: db,
+	}
+}
+
+// ImportScrobbles matches each scrobble to a track we already have stored and persists it as a play.
+// scrobbles that can't be matched are kept for review rather than dropped.
+func (s ImportStore) ImportScrobbles(
+	ctx context.Context, userID int, source string, scrobbles []lastfm.Scrobble,
+) (ImportResult, error) {
+	logger := zlog.Logger(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return ImportResult{}, err
+	}
+
+	var (
+		result ImportResult
+		// scrobble histories repeat the same tracks a lot, so only match each once
+		matches = make(map[string]string)
+	)
+	for _, scrobble := range scrobbles {
+		key := strings.ToLower(scrobble.Artist) + "\x00" + strings.ToLower(scrobble.Track)
+		trackID, ok := matches[key]
+		if !ok {
+			if trackID, err = matchTrack(ctx, tx, scrobble.Artist, scrobble.Track); err != nil {
+				logger.Error("error matching scrobble", "track", scrobble.Track, "error", err)
+				return ImportResult{}, zql.Rollback(tx, err)
+			}
+			matches[key] = trackID
+		}
+
+		if trackID == "" {
+			if err = persistUnmatched(ctx, tx, userID, source, scrobble); err != nil {
+				logger.Error("error persisting unmatched scrobble", "track", scrobble.Track, "error", err)
+				return ImportResult{}, zql.Rollback(tx, err)
+			}
+			result.Unmatched++
+			continue
+		}
+
+		result.Matched++
+		persisted, err := persistImportedPlay(ctx, tx, userID, source, trackID, scrobble.PlayedAt)
+		if err != nil {
+			logger.Error("error persisting scrobble", "track", scrobble.Track, "error", err)
+			return ImportResult{}, zql.Rollback(tx, err)
+		} else if persisted {
+			result.Persisted++
+		} else {
+			result.Duplicates++
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+// matchTrack finds the id of a stored track by exact artist and title,
+// falling back to the most similar track by trigram similarity. Returns "" if nothing matches.
+func matchTrack(ctx context.Context, tx *sql.Tx, artist, track string) (string, error) {
+	var trackID string
+	err := tx.QueryRowContext(ctx, `
+SELECT spotify_tracks.id
+FROM spotify_tracks
+JOIN spotify_credits ON spotify_credits.track_id = spotify_tracks.id
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+WHERE lower(spotify_tracks.name) = lower($1)
+	AND lower(spotify_artists.name) = lower($2)
+LIMIT 1`, track, artist).Scan(&trackID)
+	if err == nil {
+		return trackID, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("error matching exactly: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+SELECT spotify_tracks.id
+FROM spotify_tracks
+JOIN spotify_credits ON spotify_credits.track_id = spotify_tracks.id
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+WHERE spotify_tracks.name % $1
+	AND spotify_artists.name % $2
+	AND similarity(spotify_tracks.name, $1) + similarity(spotify_artists.name, $2) >= $3
+ORDER BY similarity(spotify_tracks.name, $1) + similarity(spotify_artists.name, $2) DESC
+LIMIT 1`, track, artist, fuzzyMatchThreshold).Scan(&trackID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error matching fuzzily: %w", err)
+	}
+	return trackID, nil
+}
+
+// persistImportedPlay persists a play unless another source already has the same track played
+// around the same time. plays from the same source are always kept, so songs on repeat aren't lost.
+// returns if the play was persisted.
+func persistImportedPlay(
+	ctx context.Context, tx *sql.Tx, userID int, source, trackID string, playedAt time.Time,
+) (bool, error) {
+	var persisted string
+	err := tx.QueryRowContext(ctx, `
+INSERT INTO spotify_played_tracks
+(user_id, played_at, track_id, source)
+SELECT $1, $2, $3, $4
+WHERE NOT EXISTS (
+	SELECT 1
+	FROM spotify_played_tracks
+	JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id
+	WHERE spotify_played_tracks.user_id = $1
+		AND spotify_played_tracks.track_id = $3
+		AND spotify_played_tracks.source <> $4
+		AND abs(extract(epoch FROM spotify_played_tracks.played_at - $2::timestamptz)) * 1000
+			<= COALESCE(NULLIF(spotify_tracks.duration_ms, 0), $5) + $6
+)
+ON CONFLICT
+	DO NOTHING
+RETURNING track_id`,
+		userID, playedAt, trackID, source,
+		defaultDuplicateWindow.Milliseconds(), duplicateSlack.Milliseconds()).
+		Scan(&persisted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func persistUnmatched(
+	ctx context.Context, tx *sql.Tx, userID int, source string, scrobble lastfm.Scrobble,
+) error {
+	_, err := tx.ExecContext(ctx, `
+INSERT INTO spotify_unmatched_scrobbles
+(user_id, played_at, artist_name, track_name, album_name, source)
+VALUES
+($1, $2, $3, $4, $5, $6)
+ON CONFLICT
+	DO NOTHING`,
+		userID, scrobble.PlayedAt, scrobble.Artist, scrobble.Track, scrobble.Album, source)
+	return err
+}
+
+func (s ImportStore) GetUnmatched(ctx context.Context, userID int) ([]UnmatchedScrobble, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT played_at, artist_name, track_name, album_name, source
+FROM spotify_unmatched_scrobbles
+WHERE user_id = $1
+ORDER BY played_at DESC`, userID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	unmatched := make([]UnmatchedScrobble, 0)
+	for rows.Next() {
+		var u UnmatchedScrobble
+		if err = rows.Scan(&u.PlayedAt, &u.Artist, &u.Track, &u.Album, &u.Source); err != nil {
+			return nil, err
+		}
+		unmatched = append(unmatched, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return unmatched, nil
+}
+
+// importLastFM accepts a last.fm export either as a multipart file named "file" or as the raw body.
+func (svc Controller) importLastFM(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+
+	var body io.Reader = c.Request.Body
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			logger.Error("error opening uploaded file", "error", err)
+			zgin.InternalError(c)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	scrobbles, err := lastfm.Parse(body)
+	if err != nil {
+		logger.Error("error parsing last.fm export", "error", err)
+		zgin.BadRequest(c, "please provide a last.fm csv or json export")
+		return
+	}
+
+	// matching can take a while for years of history
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Minute)
+		defer cancel()
+		result, err := svc.Imports.ImportScrobbles(ctx, userID, SourceLastFM, scrobbles)
+		if err != nil {
+			logger.Error("error importing scrobbles", "error", err)
+			return
+		}
+		logger.Info("successfully imported scrobbles",
+			"matched", result.Matched, "num_persisted", result.Persisted,
+			"duplicates", result.Duplicates, "unmatched", result.Unmatched)
+	}()
+
+	c.IndentedJSON(http.StatusAccepted, gin.H{
+		"message":       "import successfully started",
+		"num_scrobbles": len(scrobbles),
+	})
+}
+
+func (svc Controller) getUnmatched(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	unmatched, err := svc.Imports.GetUnmatched(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("error loading unmatched scrobbles", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"unmatched": unmatched,
+	})
+}
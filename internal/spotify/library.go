@@ -0,0 +1,366 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+const (
+	ScopeReadLibrary = "user-library-read"
+
+	savedTracksPageSize = 50
+)
+
+// SavedTrackObject is a track in the user's Liked Songs
+type SavedTrackObject struct {
+	AddedAt time.Time   `json:"added_at"`
+	Track   TrackObject `json:"track"`
+}
+
+// see: https://developer.spotify.com/documentation/web-api/reference/get-users-saved-tracks
+func (c Client) GetSavedTracks(ctx context.Context, token AccessToken) ([]SavedTrackObject, error) {
+	var saved []SavedTrackObject
+	for {
+		var page struct {
+			Items []SavedTrackObject `json:"items"`
+			Total int                `json:"total"`
+		}
+		q := url.Values{
+			"limit":  {strconv.Itoa(savedTracksPageSize)},
+			"offset": {strconv.Itoa(len(saved))},
+		}
+		if _, err := c.get(ctx, token, "/me/tracks", q, &page); err != nil {
+			return nil, err
+		}
+		saved = append(saved, page.Items...)
+		if len(page.Items) == 0 || len(saved) >= page.Total {
+			return saved, nil
+		}
+	}
+}
+
+// SavedTrack is a track the user liked, along with how often they've actually played it
+type SavedTrack struct {
+	AccountID int       `json:"account_id"`
+	TrackID   string    `json:"track_id"`
+	Name      string    `json:"name"`
+	Artist    string    `json:"artist"`
+	AddedAt   time.Time `json:"added_at"`
+	// RemovedAt is set once the track is no longer liked
+	RemovedAt *time.Time `json:"removed_at,omitempty"`
+	Plays     int        `json:"plays"`
+}
+
+type LikeCount struct {
+	// Month is the first day of the month, in the user's timezone
+	Month   string `json:"month"`
+	Liked   int    `json:"liked"`
+	Removed int    `json:"removed"`
+}
+
+type LibrarySyncResult struct {
+	Tracks  int `json:"tracks"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+// LibraryStore keeps each account's Liked Songs, including tracks that were since removed
+type LibraryStore struct {
+	db *sql.DB
+}
+
+func NewLibraryStore(db *sql.DB) LibraryStore {
+	return LibraryStore{
+		db: db,
+	}
+}
+
+// PersistSavedTracks replaces the account's Liked Songs with saved.
+// tracks missing from saved are marked removed, and tracks liked again are restored.
+func (s LibraryStore) PersistSavedTracks(
+	ctx context.Context, listener Listener, saved []SavedTrackObject,
+) (LibrarySyncResult, error) {
+	logger := zlog.Logger(ctx)
+	if listener.AccountID == 0 {
+		return LibrarySyncResult{}, ErrNoAccount
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return LibrarySyncResult{}, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+SELECT track_id
+FROM spotify_saved_tracks
+WHERE account_id = $1 AND removed_at IS NULL
+FOR UPDATE`, listener.AccountID)
+	if err != nil {
+		logger.Error("error loading saved tracks", "error", err)
+		return LibrarySyncResult{}, zql.Rollback(tx, err)
+	}
+	liked := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return LibrarySyncResult{}, zql.Rollback(tx, err)
+		}
+		liked[id] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return LibrarySyncResult{}, zql.Rollback(tx, err)
+	}
+
+	result := LibrarySyncResult{Tracks: len(saved)}
+	ids := make([]string, 0, len(saved))
+	for _, item := range saved {
+		if err = persistTrack(ctx, tx, item.Track); err != nil {
+			logger.Error("error persisting track", "track", item.Track.Name, "error", err)
+			return LibrarySyncResult{}, zql.Rollback(tx, err)
+		}
+
+		if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_saved_tracks
+(account_id, track_id, added_at)
+VALUES
+($1, $2, $3)
+ON CONFLICT (account_id, track_id) DO UPDATE
+SET added_at = excluded.added_at, removed_at = NULL, synced_at = now()`,
+			listener.AccountID, item.Track.ID, item.AddedAt); err != nil {
+			logger.Error("error persisting saved track", "track", item.Track.Name, "error", err)
+			return LibrarySyncResult{}, zql.Rollback(tx, err)
+		}
+		if !liked[item.Track.ID] {
+			result.Added++
+		}
+		ids = append(ids, item.Track.ID)
+	}
+
+	res, err := tx.ExecContext(ctx, `
+UPDATE spotify_saved_tracks
+SET removed_at = now()
+WHERE account_id = $1 AND removed_at IS NULL AND NOT track_id = ANY($2)`,
+		listener.AccountID, ids)
+	if err != nil {
+		logger.Error("error marking removed tracks", "error", err)
+		return LibrarySyncResult{}, zql.Rollback(tx, err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return LibrarySyncResult{}, zql.Rollback(tx, err)
+	}
+	result.Removed = int(removed)
+	return result, tx.Commit()
+}
+
+// GetSavedTracks returns the listener's liked tracks, most recently liked first.
+// removed tracks are only included if asked for, and plays are counted across all the user's accounts.
+func (s LibraryStore) GetSavedTracks(
+	ctx context.Context, listener Listener, includeRemoved, unplayedOnly bool,
+) ([]SavedTrack, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT spotify_saved_tracks.account_id, spotify_tracks.id, spotify_tracks.name,
+	COALESCE((
+		SELECT spotify_artists.name
+		FROM spotify_credits
+		JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+		WHERE spotify_credits.track_id = spotify_tracks.id
+		ORDER BY spotify_artists.name
+		LIMIT 1
+	), ''),
+	spotify_saved_tracks.added_at, spotify_saved_tracks.removed_at, plays.count
+FROM spotify_saved_tracks
+JOIN spotify_accounts ON spotify_accounts.id = spotify_saved_tracks.account_id
+JOIN spotify_tracks ON spotify_tracks.id = spotify_saved_tracks.track_id
+CROSS JOIN LATERAL (
+	SELECT COUNT(*) AS count
+	FROM spotify_played_tracks
+	WHERE spotify_played_tracks.user_id = spotify_accounts.user_id
+		AND spotify_played_tracks.track_id = spotify_saved_tracks.track_id
+) plays
+WHERE spotify_accounts.user_id = $1
+	AND ($2 = 0 OR spotify_accounts.id = $2)
+	AND ($3 OR spotify_saved_tracks.removed_at IS NULL)
+	AND (NOT $4 OR plays.count = 0)
+ORDER BY spotify_saved_tracks.added_at DESC, spotify_tracks.id`,
+		listener.UserID, listener.AccountID, includeRemoved, unplayedOnly)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := make([]SavedTrack, 0)
+	for rows.Next() {
+		var (
+			t         SavedTrack
+			removedAt sql.NullTime
+		)
+		if err = rows.Scan(&t.AccountID, &t.TrackID, &t.Name, &t.Artist,
+			&t.AddedAt, &removedAt, &t.Plays); err != nil {
+			return nil, err
+		}
+		if removedAt.Valid {
+			t.RemovedAt = &removedAt.Time
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+// GetLikeCounts counts the tracks liked and removed each month, in loc
+func (s LibraryStore) GetLikeCounts(
+	ctx context.Context, listener Listener, loc *time.Location,
+) ([]LikeCount, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH events AS (
+	SELECT spotify_saved_tracks.added_at AS at, true AS liked
+	FROM spotify_saved_tracks
+	JOIN spotify_accounts ON spotify_accounts.id = spotify_saved_tracks.account_id
+	WHERE spotify_accounts.user_id = $1 AND ($2 = 0 OR spotify_accounts.id = $2)
+	UNION ALL
+	SELECT spotify_saved_tracks.removed_at, false
+	FROM spotify_saved_tracks
+	JOIN spotify_accounts ON spotify_accounts.id = spotify_saved_tracks.account_id
+	WHERE spotify_accounts.user_id = $1 AND ($2 = 0 OR spotify_accounts.id = $2)
+		AND spotify_saved_tracks.removed_at IS NOT NULL
+)
+SELECT date_trunc('month', at AT TIME ZONE $3) AS month,
+	COUNT(*) FILTER (WHERE liked),
+	COUNT(*) FILTER (WHERE NOT liked)
+FROM events
+GROUP BY 1
+ORDER BY 1`, listener.UserID, listener.AccountID, loc.String())
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]LikeCount, 0)
+	for rows.Next() {
+		var (
+			count LikeCount
+			month time.Time
+		)
+		if err = rows.Scan(&month, &count.Liked, &count.Removed); err != nil {
+			return nil, err
+		}
+		count.Month = month.Format(time.DateOnly)
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// syncAccountLibrary stores the account's Liked Songs, marking any that were unliked since the last sync
+func (svc Controller) syncAccountLibrary(ctx context.Context, listener Listener) (LibrarySyncResult, error) {
+	token, err := svc.fetchToken(ctx, listener)
+	if err != nil {
+		return LibrarySyncResult{}, err
+	} else if !token.HasScope(ScopeReadLibrary) {
+		return LibrarySyncResult{}, ErrMissingScope
+	}
+
+	saved, err := svc.Client.GetSavedTracks(ctx, token)
+	if err != nil {
+		return LibrarySyncResult{}, err
+	}
+	return svc.Library.PersistSavedTracks(ctx, listener, saved)
+}
+
+func (svc Controller) syncLibrary(c *gin.Context, listener Listener, logger *slog.Logger) {
+	ctx := c.Request.Context()
+	accounts, err := svc.Accounts.GetAccounts(ctx, listener)
+	if err != nil {
+		logger.Error("error loading spotify accounts", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if len(accounts) == 0 {
+		accountNotFound(c)
+		return
+	}
+
+	var total LibrarySyncResult
+	for _, account := range accounts {
+		l := Listener{UserID: listener.UserID, AccountID: account.ID}
+		result, err := svc.syncAccountLibrary(ctx, l)
+		if errors.Is(err, ErrMissingScope) {
+			c.IndentedJSON(http.StatusForbidden, gin.H{
+				"error":      "token is missing scope " + ScopeReadLibrary,
+				"account_id": account.ID,
+			})
+			return
+		} else if err != nil {
+			logger.Error("error syncing saved tracks", "account_id", account.ID, "error", err)
+			zgin.InternalError(c)
+			return
+		}
+		total.Tracks += result.Tracks
+		total.Added += result.Added
+		total.Removed += result.Removed
+	}
+
+	c.IndentedJSON(http.StatusOK, total)
+}
+
+func (svc Controller) getLibrary(c *gin.Context, listener Listener, logger *slog.Logger) {
+	var opts struct {
+		IncludeRemoved bool `form:"include_removed"`
+		Unplayed       bool `form:"unplayed"`
+	}
+	if err := c.BindQuery(&opts); err != nil {
+		zgin.BadRequest(c, "please provide correct query params")
+		return
+	}
+
+	tracks, err := svc.Library.GetSavedTracks(c.Request.Context(), listener, opts.IncludeRemoved, opts.Unplayed)
+	if err != nil {
+		logger.Error("error loading saved tracks", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"tracks": tracks,
+	})
+}
+
+func (svc Controller) getLikeCounts(c *gin.Context, listener Listener, logger *slog.Logger) {
+	ctx := c.Request.Context()
+	loc, err := svc.Users.GetLocation(ctx, listener.UserID)
+	if err != nil {
+		logger.Error("error loading user location", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	counts, err := svc.Library.GetLikeCounts(ctx, listener, loc)
+	if err != nil {
+		logger.Error("error loading like counts", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"months": counts,
+	})
+}
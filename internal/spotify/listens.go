@@ -0,0 +1,134 @@
+package spotify
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+// SourceListenBrainz is for plays submitted through the listenbrainz compatible api
+const SourceListenBrainz = "listenbrainz"
+
+// prefix for ids of rows we made up, since spotify ids are always base62
+const localIDPrefix = "local:"
+
+// Listen is a play reported by some other player, which may or may not know the spotify id of the track
+type Listen struct {
+	Artist     string
+	Album      string
+	Track      string
+	PlayedAt   time.Time
+	SpotifyID  string
+	DurationMS int
+}
+
+// PersistListens persists each listen as a play, matching it to a stored track when possible.
+// listens that don't match anything get synthetic album, track and artist rows, so unlike
+// scrobble imports nothing is left unmatched.
+func (s ImportStore) PersistListens(
+	ctx context.Context, userID int, source string, listens []Listen,
+) (ImportResult, error) {
+	logger := zlog.Logger(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return ImportResult{}, err
+	}
+
+	var result ImportResult
+	for _, listen := range listens {
+		trackID, matched, err := resolveListen(ctx, tx, listen)
+		if err != nil {
+			logger.Error("error resolving listen", "track", listen.Track, "error", err)
+			return ImportResult{}, zql.Rollback(tx, err)
+		}
+		if matched {
+			result.Matched++
+		}
+
+		persisted, err := persistImportedPlay(ctx, tx, userID, source, trackID, listen.PlayedAt)
+		if err != nil {
+			logger.Error("error persisting listen", "track", listen.Track, "error", err)
+			return ImportResult{}, zql.Rollback(tx, err)
+		} else if persisted {
+			result.Persisted++
+		} else {
+			result.Duplicates++
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+// resolveListen returns the id of the track for listen, and if it was matched to one we already had.
+func resolveListen(ctx context.Context, tx *sql.Tx, listen Listen) (string, bool, error) {
+	if listen.SpotifyID != "" {
+		var trackID string
+		err := tx.QueryRowContext(ctx, `
+SELECT id
+FROM spotify_tracks
+WHERE id = $1`, listen.SpotifyID).Scan(&trackID)
+		if err == nil {
+			return trackID, true, nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return "", false, fmt.Errorf("error looking up spotify id: %w", err)
+		}
+	}
+
+	trackID, err := matchTrack(ctx, tx, listen.Artist, listen.Track)
+	if err != nil {
+		return "", false, err
+	} else if trackID != "" {
+		return trackID, true, nil
+	}
+
+	track := syntheticTrack(listen)
+	if err = persistTrack(ctx, tx, track); err != nil {
+		return "", false, err
+	}
+	return track.ID, false, nil
+}
+
+// syntheticTrack builds a track for a listen we know nothing else about.
+// ids are derived from the names so that repeat listens land on the same rows.
+//
+// the id is local even if the listen has a spotify id, since tracks are never updated once
+// stored, and a real id would be stuck with the made up album and artists after spotify syncs it.
+func syntheticTrack(listen Listen) TrackObject {
+	var track TrackObject
+	track.ID = localID("track", listen.Artist, listen.Track)
+	track.Name = listen.Track
+	track.DurationMS = listen.DurationMS
+
+	track.Album.ID = localID("album", listen.Artist, listen.Album)
+	track.Album.Name = listen.Album
+	track.Album.Type = "album"
+
+	track.Artists = make([]struct {
+		Identifier
+		Genres     []string `json:"genres"`
+		Popularity int      `json:"popularity"`
+	}, 1)
+	track.Artists[0].ID = localID("artist", listen.Artist)
+	track.Artists[0].Name = listen.Artist
+	return track
+}
+
+func localID(kind string, names ...string) string {
+	h := sha256.New()
+	h.Write([]byte(kind))
+	for _, name := range names {
+		h.Write([]byte{0})
+		h.Write([]byte(strings.ToLower(strings.TrimSpace(name))))
+	}
+	return localIDPrefix + hex.EncodeToString(h.Sum(nil))[:22]
+}
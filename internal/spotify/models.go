@@ -3,6 +3,7 @@ package spotify
 import (
 	"encoding/base64"
 	"os"
+	"strconv"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
@@ -20,6 +21,23 @@ type ApiResponse struct {
 	Items []PlayHistoryObject `json:"items"`
 }
 
+// cursors are unix millisecond timestamps, but sent as strings
+func parseCursor(cursor string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms).UTC(), true
+}
+
+func (ar ApiResponse) AfterCursor() (time.Time, bool) {
+	return parseCursor(ar.Cursors.After)
+}
+
+func (ar ApiResponse) BeforeCursor() (time.Time, bool) {
+	return parseCursor(ar.Cursors.Before)
+}
+
 type ExternalURLs struct {
 	Spotify string `json:"spotify"`
 }
@@ -48,7 +66,8 @@ type TrackObject struct {
 	Identifier
 	Album struct {
 		Identifier
-		Type string `json:"album_type"`
+		Type   string        `json:"album_type"`
+		Images []ImageObject `json:"images"`
 	} `json:"album"`
 	Artists []struct {
 		Identifier
@@ -0,0 +1,207 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const (
+	ScopeReadCurrentlyPlaying = "user-read-currently-playing"
+
+	// spotify doesn't push updates, so this is how stale now playing is allowed to get.
+	nowPlayingTTL = 5 * time.Second
+)
+
+var ErrMissingScope = errors.New("access token missing required scope")
+
+type CurrentlyPlayingObject struct {
+	Timestamp            int64         `json:"timestamp"`
+	Context              ContextObject `json:"context"`
+	ProgressMS           int           `json:"progress_ms"`
+	Item                 *TrackObject  `json:"item"`
+	CurrentlyPlayingType string        `json:"currently_playing_type"`
+	IsPlaying            bool          `json:"is_playing"`
+}
+
+// Changed reports if the track or playback state differs, ignoring progress.
+func (obj CurrentlyPlayingObject) Changed(other CurrentlyPlayingObject) bool {
+	trackID := func(o CurrentlyPlayingObject) string {
+		if o.Item == nil {
+			return ""
+		}
+		return o.Item.ID
+	}
+	return trackID(obj) != trackID(other) || obj.IsPlaying != other.IsPlaying
+}
+
+// see: https://developer.spotify.com/documentation/web-api/reference/get-the-users-currently-playing-track
+func (c Client) GetCurrentlyPlaying(
+	ctx context.Context, token AccessToken,
+) (CurrentlyPlayingObject, error) {
+	var obj CurrentlyPlayingObject
+	status, err := c.get(ctx, token, "/me/player/currently-playing", nil, &obj)
+	if err != nil {
+		return CurrentlyPlayingObject{}, err
+	} else if status == http.StatusNoContent {
+		// nothing is playing
+		return CurrentlyPlayingObject{}, nil
+	}
+	return obj, nil
+}
+
+// NowPlayingCache keeps the most recent currently-playing response per account,
+// so that polling clients and streams don't each hit spotify.
+type NowPlayingCache struct {
+	rdb redis.UniversalClient
+	ttl time.Duration
+}
+
+func NewNowPlayingCache(rdb redis.UniversalClient) NowPlayingCache {
+	return NowPlayingCache{
+		rdb: rdb,
+		ttl: nowPlayingTTL,
+	}
+}
+
+func nowPlayingKey(listener Listener) string {
+	return "spotify.now_playing." + strconv.Itoa(listener.UserID) + "." + strconv.Itoa(listener.AccountID)
+}
+
+func (cache NowPlayingCache) Get(
+	ctx context.Context, listener Listener,
+) (CurrentlyPlayingObject, bool, error) {
+	value, err := cache.rdb.Get(ctx, nowPlayingKey(listener)).Result()
+	if errors.Is(err, redis.Nil) {
+		return CurrentlyPlayingObject{}, false, nil
+	} else if err != nil {
+		return CurrentlyPlayingObject{}, false, err
+	}
+
+	var obj CurrentlyPlayingObject
+	if err = jsoniter.UnmarshalFromString(value, &obj); err != nil {
+		return CurrentlyPlayingObject{}, false, err
+	}
+	return obj, true, nil
+}
+
+func (cache NowPlayingCache) Set(
+	ctx context.Context, listener Listener, obj CurrentlyPlayingObject,
+) error {
+	value, err := jsoniter.MarshalToString(obj)
+	if err != nil {
+		return err
+	}
+	return cache.rdb.Set(ctx, nowPlayingKey(listener), value, cache.ttl).Err()
+}
+
+// nowPlaying returns what's playing on the listener's account, which must be set
+func (svc Controller) nowPlaying(ctx context.Context, listener Listener) (CurrentlyPlayingObject, error) {
+	obj, ok, err := svc.NowPlaying.Get(ctx, listener)
+	if err != nil {
+		return CurrentlyPlayingObject{}, err
+	} else if ok {
+		return obj, nil
+	}
+
+	token, err := svc.fetchToken(ctx, listener)
+	if err != nil {
+		return CurrentlyPlayingObject{}, err
+	} else if !token.HasScope(ScopeReadCurrentlyPlaying) {
+		return CurrentlyPlayingObject{}, ErrMissingScope
+	}
+
+	obj, err = svc.Client.GetCurrentlyPlaying(ctx, token)
+	if err != nil {
+		return CurrentlyPlayingObject{}, err
+	}
+
+	if err = svc.NowPlaying.Set(ctx, listener, obj); err != nil {
+		// not worth failing the request over
+		zlog.Logger(ctx).Warn("error caching now playing", "error", err)
+	}
+	return obj, nil
+}
+
+func (svc Controller) getNowPlaying(c *gin.Context, listener Listener, logger *slog.Logger) {
+	listener, ok := svc.resolveAccount(c, listener, logger)
+	if !ok {
+		return
+	}
+
+	obj, err := svc.nowPlaying(c.Request.Context(), listener)
+	if errors.Is(err, ErrMissingScope) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{
+			"error": "token is missing scope " + ScopeReadCurrentlyPlaying,
+		})
+		return
+	} else if err != nil {
+		logger.Error("error fetching now playing", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"now_playing": obj,
+	})
+}
+
+// streamNowPlaying pushes a server-sent event every time the user's current track changes.
+func (svc Controller) streamNowPlaying(c *gin.Context, listener Listener, logger *slog.Logger) {
+	listener, ok := svc.resolveAccount(c, listener, logger)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	// check once up front so errors can still be returned as regular json
+	last, err := svc.nowPlaying(ctx, listener)
+	if errors.Is(err, ErrMissingScope) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{
+			"error": "token is missing scope " + ScopeReadCurrentlyPlaying,
+		})
+		return
+	} else if err != nil {
+		logger.Error("error fetching now playing", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("now_playing", last)
+
+	ticker := time.NewTicker(nowPlayingTTL)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+
+		current, err := svc.nowPlaying(ctx, listener)
+		if err != nil {
+			logger.Error("error fetching now playing for stream", "error", err)
+			c.SSEvent("error", gin.H{"error": "internal error"})
+			return false
+		}
+
+		if current.Changed(last) {
+			c.SSEvent("now_playing", current)
+			last = current
+		}
+		return true
+	})
+}
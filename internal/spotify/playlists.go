@@ -0,0 +1,602 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+const (
+	playlistsPageSize      = 50
+	playlistTracksPageSize = 100
+
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+)
+
+// SimplifiedPlaylistObject is a playlist as listed in the user's playlists
+type SimplifiedPlaylistObject struct {
+	PlaylistObject
+	// SnapshotID changes every time the playlist does
+	SnapshotID string `json:"snapshot_id"`
+}
+
+// PlaylistTrackObject is an item in a playlist.
+// track is nil if it's no longer available, and local files don't have ids.
+type PlaylistTrackObject struct {
+	AddedAt time.Time    `json:"added_at"`
+	AddedBy UserObject   `json:"added_by"`
+	IsLocal bool         `json:"is_local"`
+	Track   *TrackObject `json:"track"`
+}
+
+// see: https://developer.spotify.com/documentation/web-api/reference/get-a-list-of-current-users-playlists
+func (c Client) GetPlaylists(ctx context.Context, token AccessToken) ([]SimplifiedPlaylistObject, error) {
+	var playlists []SimplifiedPlaylistObject
+	for {
+		var page struct {
+			Items []SimplifiedPlaylistObject `json:"items"`
+			Total int                        `json:"total"`
+		}
+		q := url.Values{
+			"limit":  {strconv.Itoa(playlistsPageSize)},
+			"offset": {strconv.Itoa(len(playlists))},
+		}
+		if _, err := c.get(ctx, token, "/me/playlists", q, &page); err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, page.Items...)
+		if len(page.Items) == 0 || len(playlists) >= page.Total {
+			return playlists, nil
+		}
+	}
+}
+
+// GetPlaylistTracks returns ok false if the playlist doesn't exist or its tracks aren't visible to us.
+//
+// see: https://developer.spotify.com/documentation/web-api/reference/get-playlists-tracks
+func (c Client) GetPlaylistTracks(
+	ctx context.Context, token AccessToken, id string,
+) ([]PlaylistTrackObject, bool, error) {
+	var items []PlaylistTrackObject
+	for {
+		var page struct {
+			Items []PlaylistTrackObject `json:"items"`
+			Total int                   `json:"total"`
+		}
+		q := url.Values{
+			"limit":            {strconv.Itoa(playlistTracksPageSize)},
+			"offset":           {strconv.Itoa(len(items))},
+			"additional_types": {"track"},
+		}
+		status, err := c.get(ctx, token, "/playlists/"+id+"/tracks", q, &page)
+		if status == http.StatusNotFound || status == http.StatusForbidden {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		items = append(items, page.Items...)
+		if len(page.Items) == 0 || len(items) >= page.Total {
+			return items, true, nil
+		}
+	}
+}
+
+// playlistTrack returns the track to store for the item, or false if there's nothing to store.
+// local files get synthetic tracks, the same as listens of them do.
+func playlistTrack(item PlaylistTrackObject) (TrackObject, bool) {
+	if item.Track == nil {
+		return TrackObject{}, false
+	} else if !item.IsLocal {
+		return *item.Track, item.Track.ID != ""
+	}
+
+	listen := Listen{
+		Track:      item.Track.Name,
+		Album:      item.Track.Album.Name,
+		DurationMS: item.Track.DurationMS,
+	}
+	if len(item.Track.Artists) > 0 {
+		listen.Artist = item.Track.Artists[0].Name
+	}
+	return syntheticTrack(listen), true
+}
+
+// diffPlaylist returns the tracks added and removed between two versions of a playlist.
+// playlists can have duplicates, so adding a second copy of a track counts as adding it.
+func diffPlaylist(before, after []string) ([]string, []string) {
+	counts := make(map[string]int, len(before))
+	for _, id := range before {
+		counts[id]++
+	}
+
+	added := make([]string, 0)
+	for _, id := range after {
+		if counts[id] > 0 {
+			counts[id]--
+		} else {
+			added = append(added, id)
+		}
+	}
+
+	removed := make([]string, 0)
+	for _, id := range before {
+		if counts[id] > 0 {
+			counts[id]--
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+type PlaylistChange struct {
+	TrackID string `json:"track_id"`
+	Name    string `json:"name"`
+}
+
+// PlaylistSnapshot is a version of a playlist, and what changed since the version before it
+type PlaylistSnapshot struct {
+	SnapshotID string `json:"snapshot_id"`
+	// PreviousSnapshotID is empty for the first version we synced, where every track counts as added
+	PreviousSnapshotID string           `json:"previous_snapshot_id"`
+	Tracks             int              `json:"tracks"`
+	SyncedAt           time.Time        `json:"synced_at"`
+	Added              []PlaylistChange `json:"added"`
+	Removed            []PlaylistChange `json:"removed"`
+}
+
+// SyncedPlaylist is a playlist we keep the track list of
+type SyncedPlaylist struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	OwnerID    string    `json:"owner_id"`
+	OwnerName  string    `json:"owner_name"`
+	SnapshotID string    `json:"snapshot_id"`
+	Tracks     int       `json:"tracks"`
+	SyncedAt   time.Time `json:"synced_at"`
+}
+
+// PlaylistStore keeps the track lists of the playlists in each account's library,
+// and how they've changed over time.
+type PlaylistStore struct {
+	db *sql.DB
+}
+
+func NewPlaylistStore(db *sql.DB) PlaylistStore {
+	return PlaylistStore{
+		db: db,
+	}
+}
+
+// GetSnapshotIDs returns the snapshot we last synced of each playlist, skipping any we haven't synced
+func (s PlaylistStore) GetSnapshotIDs(ctx context.Context, ids []string) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, snapshot_id
+FROM spotify_playlists
+WHERE id = ANY($1) AND snapshot_id IS NOT NULL`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := make(map[string]string)
+	for rows.Next() {
+		var id, snapshotID string
+		if err = rows.Scan(&id, &snapshotID); err != nil {
+			return nil, err
+		}
+		snapshots[id] = snapshotID
+	}
+	return snapshots, rows.Err()
+}
+
+// PersistSnapshot replaces the playlist's track list with items, and records the tracks added and removed
+// since the last snapshot. returns the number of tracks added and removed.
+func (s PlaylistStore) PersistSnapshot(
+	ctx context.Context, p SimplifiedPlaylistObject, items []PlaylistTrackObject,
+) (int, int, error) {
+	logger := zlog.Logger(ctx).With(slog.String("playlist_id", p.ID))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return 0, 0, err
+	}
+
+	var previous sql.NullString
+	err = tx.QueryRowContext(ctx, `
+SELECT snapshot_id
+FROM spotify_playlists
+WHERE id = $1
+FOR UPDATE`, p.ID).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Error("error loading previous snapshot", "error", err)
+		return 0, 0, zql.Rollback(tx, err)
+	} else if previous.String == p.SnapshotID {
+		// synced concurrently by another account following the playlist
+		return 0, 0, tx.Commit()
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_playlists
+(id, name, href, uri, external_url, owner_id, owner_name, snapshot_id)
+VALUES
+($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (id) DO UPDATE
+SET name = excluded.name, owner_id = excluded.owner_id, owner_name = excluded.owner_name,
+	snapshot_id = excluded.snapshot_id, fetched_at = now()`,
+		p.ID, p.Name, p.Href, p.URI, p.ExternalURLs.Spotify,
+		p.Owner.ID, p.Owner.DisplayName, p.SnapshotID); err != nil {
+		logger.Error("error persisting playlist", "error", err)
+		return 0, 0, zql.Rollback(tx, err)
+	}
+
+	before, err := playlistTrackIDs(ctx, tx, p.ID)
+	if err != nil {
+		logger.Error("error loading playlist tracks", "error", err)
+		return 0, 0, zql.Rollback(tx, err)
+	}
+	if _, err = tx.ExecContext(ctx, `
+DELETE FROM spotify_playlist_tracks
+WHERE playlist_id = $1`, p.ID); err != nil {
+		logger.Error("error clearing playlist tracks", "error", err)
+		return 0, 0, zql.Rollback(tx, err)
+	}
+
+	after := make([]string, 0, len(items))
+	for _, item := range items {
+		track, ok := playlistTrack(item)
+		if !ok {
+			continue
+		}
+		if err = persistTrack(ctx, tx, track); err != nil {
+			logger.Error("error persisting track", "track", track.Name, "error", err)
+			return 0, 0, zql.Rollback(tx, err)
+		}
+
+		if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_playlist_tracks
+(playlist_id, position, track_id, added_at, added_by)
+VALUES
+($1, $2, $3, $4, $5)`,
+			p.ID, len(after), track.ID,
+			// very old playlists don't have when tracks were added
+			sql.NullTime{Time: item.AddedAt, Valid: !item.AddedAt.IsZero()},
+			item.AddedBy.ID); err != nil {
+			logger.Error("error persisting playlist track", "track", track.Name, "error", err)
+			return 0, 0, zql.Rollback(tx, err)
+		}
+		after = append(after, track.ID)
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_playlist_snapshots
+(playlist_id, snapshot_id, previous_snapshot_id, tracks)
+VALUES
+($1, $2, $3, $4)
+ON CONFLICT
+	DO NOTHING`,
+		p.ID, p.SnapshotID, previous, len(after)); err != nil {
+		logger.Error("error persisting snapshot", "error", err)
+		return 0, 0, zql.Rollback(tx, err)
+	}
+
+	added, removed := diffPlaylist(before, after)
+	for _, changes := range []struct {
+		change   string
+		trackIDs []string
+	}{{ChangeAdded, added}, {ChangeRemoved, removed}} {
+		for _, trackID := range changes.trackIDs {
+			if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_playlist_changes
+(playlist_id, snapshot_id, track_id, change)
+VALUES
+($1, $2, $3, $4)`,
+				p.ID, p.SnapshotID, trackID, changes.change); err != nil {
+				logger.Error("error persisting playlist change", "error", err)
+				return 0, 0, zql.Rollback(tx, err)
+			}
+		}
+	}
+	return len(added), len(removed), tx.Commit()
+}
+
+func playlistTrackIDs(ctx context.Context, tx *sql.Tx, playlistID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+SELECT track_id
+FROM spotify_playlist_tracks
+WHERE playlist_id = $1
+ORDER BY position`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// LinkPlaylists sets the playlists in the account's library, which must already be persisted
+func (s PlaylistStore) LinkPlaylists(ctx context.Context, listener Listener, ids []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+DELETE FROM spotify_account_playlists
+WHERE account_id = $1 AND NOT playlist_id = ANY($2)`, listener.AccountID, ids); err != nil {
+		return zql.Rollback(tx, err)
+	}
+	for _, id := range ids {
+		if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_account_playlists
+(account_id, playlist_id)
+VALUES
+($1, $2)
+ON CONFLICT
+	DO NOTHING`, listener.AccountID, id); err != nil {
+			return zql.Rollback(tx, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSyncedPlaylists returns the playlists in the listener's libraries, by name
+func (s PlaylistStore) GetSyncedPlaylists(ctx context.Context, listener Listener) ([]SyncedPlaylist, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT spotify_playlists.id, spotify_playlists.name, spotify_playlists.owner_id, spotify_playlists.owner_name,
+	COALESCE(spotify_playlists.snapshot_id, ''), spotify_playlists.fetched_at,
+	(SELECT COUNT(*) FROM spotify_playlist_tracks WHERE playlist_id = spotify_playlists.id)
+FROM spotify_playlists
+WHERE spotify_playlists.id IN (
+	SELECT spotify_account_playlists.playlist_id
+	FROM spotify_account_playlists
+	JOIN spotify_accounts ON spotify_accounts.id = spotify_account_playlists.account_id
+	WHERE spotify_accounts.user_id = $1
+		AND ($2 = 0 OR spotify_accounts.id = $2)
+)
+ORDER BY spotify_playlists.name`, listener.UserID, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	playlists := make([]SyncedPlaylist, 0)
+	for rows.Next() {
+		var p SyncedPlaylist
+		if err = rows.Scan(&p.ID, &p.Name, &p.OwnerID, &p.OwnerName,
+			&p.SnapshotID, &p.SyncedAt, &p.Tracks); err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, p)
+	}
+	return playlists, rows.Err()
+}
+
+// GetHistory returns every snapshot of the playlist we've synced, most recent first.
+// returns false if the playlist isn't in the library of any of the user's accounts.
+func (s PlaylistStore) GetHistory(
+	ctx context.Context, userID int, playlistID string,
+) ([]PlaylistSnapshot, bool, error) {
+	logger := zlog.Logger(ctx)
+
+	var linked bool
+	if err := s.db.QueryRowContext(ctx, `
+SELECT EXISTS (
+	SELECT 1
+	FROM spotify_account_playlists
+	JOIN spotify_accounts ON spotify_accounts.id = spotify_account_playlists.account_id
+	WHERE spotify_accounts.user_id = $1 AND spotify_account_playlists.playlist_id = $2
+)`, userID, playlistID).Scan(&linked); err != nil {
+		logger.Error("error checking playlist", "error", err)
+		return nil, false, err
+	} else if !linked {
+		return nil, false, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT snapshot_id, COALESCE(previous_snapshot_id, ''), tracks, synced_at
+FROM spotify_playlist_snapshots
+WHERE playlist_id = $1
+ORDER BY synced_at DESC`, playlistID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	snapshots := make([]PlaylistSnapshot, 0)
+	byID := make(map[string]int)
+	for rows.Next() {
+		snapshot := PlaylistSnapshot{
+			Added:   make([]PlaylistChange, 0),
+			Removed: make([]PlaylistChange, 0),
+		}
+		if err = rows.Scan(&snapshot.SnapshotID, &snapshot.PreviousSnapshotID,
+			&snapshot.Tracks, &snapshot.SyncedAt); err != nil {
+			return nil, false, err
+		}
+		byID[snapshot.SnapshotID] = len(snapshots)
+		snapshots = append(snapshots, snapshot)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	changes, err := s.db.QueryContext(ctx, `
+SELECT spotify_playlist_changes.snapshot_id, spotify_playlist_changes.change,
+	spotify_tracks.id, spotify_tracks.name
+FROM spotify_playlist_changes
+JOIN spotify_tracks ON spotify_tracks.id = spotify_playlist_changes.track_id
+WHERE spotify_playlist_changes.playlist_id = $1
+ORDER BY spotify_playlist_changes.id`, playlistID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, false, err
+	}
+	defer changes.Close()
+
+	for changes.Next() {
+		var (
+			snapshotID, change string
+			c                  PlaylistChange
+		)
+		if err = changes.Scan(&snapshotID, &change, &c.TrackID, &c.Name); err != nil {
+			return nil, false, err
+		}
+		i, ok := byID[snapshotID]
+		if !ok {
+			continue
+		}
+		if change == ChangeAdded {
+			snapshots[i].Added = append(snapshots[i].Added, c)
+		} else {
+			snapshots[i].Removed = append(snapshots[i].Removed, c)
+		}
+	}
+	return snapshots, true, changes.Err()
+}
+
+type PlaylistSyncResult struct {
+	Playlists int `json:"playlists"`
+	Changed   int `json:"changed"`
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	// Skipped counts playlists whose tracks spotify wouldn't show us
+	Skipped int `json:"skipped"`
+}
+
+// syncAccountPlaylists stores the track list of every playlist in the account's library that changed since
+// it was last synced. playlists whose tracks can't be read are skipped, and only linked if synced before.
+func (svc Controller) syncAccountPlaylists(
+	ctx context.Context, listener Listener, result *PlaylistSyncResult,
+) error {
+	token, err := svc.fetchToken(ctx, listener)
+	if err != nil {
+		return err
+	}
+	playlists, err := svc.Client.GetPlaylists(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(playlists))
+	for _, p := range playlists {
+		ids = append(ids, p.ID)
+	}
+	snapshots, err := svc.Playlists.GetSnapshotIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	logger := zlog.Logger(ctx)
+	result.Playlists += len(playlists)
+	linked := make([]string, 0, len(ids))
+	for _, p := range playlists {
+		if snapshots[p.ID] == p.SnapshotID {
+			linked = append(linked, p.ID)
+			continue
+		}
+		// many of spotify's own playlists can be followed but not read
+		items, ok, err := svc.Client.GetPlaylistTracks(ctx, token, p.ID)
+		if err != nil {
+			return err
+		} else if !ok {
+			logger.Warn("playlist tracks aren't available", "playlist_id", p.ID)
+			result.Skipped++
+			if _, synced := snapshots[p.ID]; synced {
+				linked = append(linked, p.ID)
+			}
+			continue
+		}
+		linked = append(linked, p.ID)
+		added, removed, err := svc.Playlists.PersistSnapshot(ctx, p, items)
+		if err != nil {
+			return err
+		}
+		result.Changed++
+		result.Added += added
+		result.Removed += removed
+	}
+	return svc.Playlists.LinkPlaylists(ctx, listener, linked)
+}
+
+func (svc Controller) syncPlaylists(c *gin.Context, listener Listener, logger *slog.Logger) {
+	ctx := c.Request.Context()
+	accounts, err := svc.Accounts.GetAccounts(ctx, listener)
+	if err != nil {
+		logger.Error("error loading spotify accounts", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if len(accounts) == 0 {
+		accountNotFound(c)
+		return
+	}
+
+	var result PlaylistSyncResult
+	for _, account := range accounts {
+		l := Listener{UserID: listener.UserID, AccountID: account.ID}
+		if err = svc.syncAccountPlaylists(ctx, l, &result); err != nil {
+			logger.Error("error syncing playlists", "account_id", account.ID, "error", err)
+			zgin.InternalError(c)
+			return
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+func (svc Controller) getPlaylists(c *gin.Context, listener Listener, logger *slog.Logger) {
+	playlists, err := svc.Playlists.GetSyncedPlaylists(c.Request.Context(), listener)
+	if err != nil {
+		logger.Error("error loading playlists", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"playlists": playlists,
+	})
+}
+
+func (svc Controller) getPlaylistHistory(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	snapshots, ok, err := svc.Playlists.GetHistory(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		logger.Error("error loading playlist history", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if !ok {
+		c.IndentedJSON(http.StatusNotFound, gin.H{
+			"error": "playlist isn't in any of your libraries",
+		})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"playlist_id": c.Param("id"),
+		"snapshots":   snapshots,
+	})
+}
@@ -0,0 +1,42 @@
+package spotify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffPlaylist(t *testing.T) {
+	assert := assert.New(t)
+
+	added, removed := diffPlaylist(nil, []string{"a", "b"})
+	assert.Equal([]string{"a", "b"}, added)
+	assert.Empty(removed)
+
+	// reordering isn't a change
+	added, removed = diffPlaylist([]string{"a", "b", "c"}, []string{"c", "a", "b"})
+	assert.Empty(added)
+	assert.Empty(removed)
+
+	// duplicates count separately
+	added, removed = diffPlaylist([]string{"a", "b", "b"}, []string{"a", "a", "b", "d"})
+	assert.Equal([]string{"a", "d"}, added)
+	assert.Equal([]string{"b"}, removed)
+}
+
+func TestPlaylistTrack(t *testing.T) {
+	assert := assert.New(t)
+
+	_, ok := playlistTrack(PlaylistTrackObject{})
+	assert.False(ok, "unavailable tracks are skipped")
+
+	// local files don't have ids, so get the same synthetic rows as listens of them
+	var local TrackObject
+	local.Name = "Nothing"
+	local.Album.Name = "Nowhere"
+	local.Artists = syntheticTrack(Listen{Artist: "Nobody"}).Artists
+	track, ok := playlistTrack(PlaylistTrackObject{IsLocal: true, Track: &local})
+	assert.True(ok)
+	assert.Equal(localID("track", "Nobody", "Nothing"), track.ID)
+	assert.Equal(localID("album", "Nobody", "Nowhere"), track.Album.ID)
+}
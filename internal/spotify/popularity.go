@@ -0,0 +1,229 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+// scoredPlays scores every play between $2 and $3, for every user.
+//
+// spotify reports popularity from 0 to 100, but recently played only includes simplified artists
+// without a popularity, and synthetic tracks don't have one either, so 0 is treated as unknown.
+// unknown artist popularity falls back to the popularity of the track.
+const scoredPlays = `
+SELECT spotify_played_tracks.user_id, spotify_played_tracks.account_id, spotify_played_tracks.played_at, scores.*,
+	COALESCE((scores.track_popularity + scores.artist_popularity) / 2,
+		scores.track_popularity, scores.artist_popularity) AS mainstream
+FROM spotify_played_tracks
+JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id
+CROSS JOIN LATERAL (
+	SELECT NULLIF(spotify_tracks.popularity, 0)::float AS track_popularity,
+		(
+			SELECT AVG(COALESCE(NULLIF(spotify_artists.popularity, 0), NULLIF(spotify_tracks.popularity, 0)))
+			FROM spotify_credits
+			JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+			WHERE spotify_credits.track_id = spotify_tracks.id
+		)::float AS artist_popularity
+) scores
+WHERE spotify_played_tracks.played_at BETWEEN $2 AND $3`
+
+// PopularityBucket is the play-weighted average popularity of everything played in a bucket
+type PopularityBucket struct {
+	// Start is the date the bucket starts on, in the user's timezone
+	Start            string  `json:"start"`
+	Plays            int     `json:"plays"`
+	TrackPopularity  float64 `json:"track_popularity"`
+	ArtistPopularity float64 `json:"artist_popularity"`
+	// Mainstream is the average of track and artist popularity
+	Mainstream float64 `json:"mainstream"`
+}
+
+type ArtistPopularity struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Popularity float64 `json:"popularity"`
+	Plays      int     `json:"plays"`
+}
+
+// PopularityComparison places the user's mainstream score among every zest user with plays in the range
+type PopularityComparison struct {
+	Mainstream float64 `json:"mainstream"`
+	// Percentile is the percent of users that are less mainstream
+	Percentile float64 `json:"percentile"`
+	Users      int     `json:"users"`
+}
+
+func (s HistoryStore) GetPopularitySeries(
+	ctx context.Context, listener Listener, start, end time.Time, bucket string, loc *time.Location,
+) ([]PopularityBucket, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH plays AS (`+scoredPlays+`
+)
+SELECT date_trunc($4, played_at AT TIME ZONE $5) AS bucket, COUNT(*),
+	COALESCE(AVG(track_popularity), 0), COALESCE(AVG(artist_popularity), 0), COALESCE(AVG(mainstream), 0)
+FROM plays
+WHERE user_id = $1
+	AND ($6 = 0 OR account_id = $6)
+GROUP BY 1
+ORDER BY 1`,
+		listener.UserID, start, end, bucket, loc.String(), listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := make([]PopularityBucket, 0)
+	for rows.Next() {
+		var (
+			b           PopularityBucket
+			bucketStart time.Time
+		)
+		if err = rows.Scan(&bucketStart, &b.Plays,
+			&b.TrackPopularity, &b.ArtistPopularity, &b.Mainstream); err != nil {
+			return nil, err
+		}
+		b.Start = bucketStart.Format(time.DateOnly)
+		series = append(series, b)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// GetArtistsByPopularity returns the artists the user played in the range,
+// least popular first if ascending, otherwise most popular first.
+func (s HistoryStore) GetArtistsByPopularity(
+	ctx context.Context, listener Listener, start, end time.Time, ascending bool, limit int,
+) ([]ArtistPopularity, error) {
+	logger := zlog.Logger(ctx)
+
+	order := "DESC"
+	if ascending {
+		order = "ASC"
+	}
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+SELECT spotify_artists.id, spotify_artists.name,
+	COALESCE(NULLIF(spotify_artists.popularity, 0), AVG(NULLIF(spotify_tracks.popularity, 0)))::float AS popularity,
+	COUNT(*)
+FROM spotify_played_tracks
+JOIN spotify_tracks ON spotify_tracks.id = spotify_played_tracks.track_id
+JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+WHERE spotify_played_tracks.user_id = $1
+	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND ($5 = 0 OR spotify_played_tracks.account_id = $5)
+GROUP BY spotify_artists.id, spotify_artists.name, spotify_artists.popularity
+HAVING COALESCE(NULLIF(spotify_artists.popularity, 0), AVG(NULLIF(spotify_tracks.popularity, 0))) IS NOT NULL
+ORDER BY popularity %v, COUNT(*) DESC
+LIMIT $4`, order),
+		listener.UserID, start, end, limit, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	artists := make([]ArtistPopularity, 0)
+	for rows.Next() {
+		var a ArtistPopularity
+		if err = rows.Scan(&a.ID, &a.Name, &a.Popularity, &a.Plays); err != nil {
+			return nil, err
+		}
+		artists = append(artists, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return artists, nil
+}
+
+// ComparePopularity returns nil if the listener has no scored plays in the range.
+// other users are scored across all of their accounts.
+func (s HistoryStore) ComparePopularity(
+	ctx context.Context, listener Listener, start, end time.Time,
+) (*PopularityComparison, error) {
+	var comparison PopularityComparison
+	err := s.db.QueryRowContext(ctx, `
+WITH plays AS (`+scoredPlays+`
+), scores AS (
+	SELECT user_id, AVG(mainstream) AS mainstream
+	FROM plays
+	WHERE user_id <> $1 OR $4 = 0 OR account_id = $4
+	GROUP BY user_id
+	HAVING AVG(mainstream) IS NOT NULL
+), ranked AS (
+	SELECT user_id, mainstream,
+		percent_rank() OVER (ORDER BY mainstream) * 100 AS percentile,
+		COUNT(*) OVER () AS users
+	FROM scores
+)
+SELECT mainstream, percentile, users
+FROM ranked
+WHERE user_id = $1`,
+		listener.UserID, start, end, listener.AccountID).
+		Scan(&comparison.Mainstream, &comparison.Percentile, &comparison.Users)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		zlog.Logger(ctx).Error("error comparing popularity", "error", err)
+		return nil, err
+	}
+	return &comparison, nil
+}
+
+func (svc Controller) getPopularity(c *gin.Context, listener Listener, logger *slog.Logger) {
+	opts, r, ok := svc.resolveStats(c, listener.UserID, logger, DefaultStatsOptions())
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	series, err := svc.History.GetPopularitySeries(ctx, listener, r.Start, r.End, opts.Bucket, r.Location)
+	if err != nil {
+		logger.Error("error loading popularity series", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	obscure, err := svc.History.GetArtistsByPopularity(ctx, listener, r.Start, r.End, true, opts.Limit)
+	if err != nil {
+		logger.Error("error loading obscure artists", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	mainstream, err := svc.History.GetArtistsByPopularity(ctx, listener, r.Start, r.End, false, opts.Limit)
+	if err != nil {
+		logger.Error("error loading mainstream artists", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+	comparison, err := svc.History.ComparePopularity(ctx, listener, r.Start, r.End)
+	if err != nil {
+		logger.Error("error comparing popularity", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"start":           r.Start,
+		"end":             r.End,
+		"bucket":          opts.Bucket,
+		"series":          series,
+		"most_obscure":    obscure,
+		"most_mainstream": mainstream,
+		"comparison":      comparison,
+	})
+}
@@ -0,0 +1,162 @@
+package spotify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const day = 24 * time.Hour
+
+// RediscoverOptions configure what counts as played heavily in the past and what counts as not recently.
+// the past window is the WindowDays immediately before the last QuietDays.
+type RediscoverOptions struct {
+	WindowDays int `form:"window_days"`
+	QuietDays  int `form:"quiet_days"`
+	MinPlays   int `form:"min_plays"`
+	Limit      int `form:"limit"`
+}
+
+func DefaultRediscoverOptions() RediscoverOptions {
+	return RediscoverOptions{
+		WindowDays: 180,
+		QuietDays:  60,
+		MinPlays:   5,
+		Limit:      20,
+	}
+}
+
+func (opts RediscoverOptions) Validate() error {
+	if opts.WindowDays <= 0 || opts.QuietDays <= 0 {
+		return fmt.Errorf("window_days and quiet_days must be positive")
+	} else if opts.MinPlays <= 0 {
+		return fmt.Errorf("min_plays must be positive")
+	} else if opts.Limit <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	return nil
+}
+
+// Rediscovery is a track or artist that was played heavily in the past window, but not since
+type Rediscovery struct {
+	// Kind is one of track or artist
+	Kind       string    `json:"kind"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	PastPlays  int       `json:"past_plays"`
+	LastPlayed time.Time `json:"last_played"`
+	DaysSince  int       `json:"days_since"`
+	// Score is the past plays, weighted by how many quiet periods have gone by since the last play
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason"`
+}
+
+// score fills in the explanation of why r was chosen, relative to now
+func (r *Rediscovery) score(now time.Time, opts RediscoverOptions) {
+	since := now.Sub(r.LastPlayed)
+	r.DaysSince = int(since / day)
+	r.Score = float64(r.PastPlays) * since.Hours() / (float64(opts.QuietDays) * 24)
+	r.Reason = fmt.Sprintf("played %v times in the %v days before the last %v, last played %v days ago",
+		r.PastPlays, opts.WindowDays, opts.QuietDays, r.DaysSince)
+}
+
+// Rediscover finds tracks and artists the user played at least MinPlays times in the past window,
+// and hasn't played at all in the last QuietDays, ordered by score.
+func (s HistoryStore) Rediscover(
+	ctx context.Context, listener Listener, now time.Time, opts RediscoverOptions,
+) ([]Rediscovery, error) {
+	logger := zlog.Logger(ctx)
+
+	quietStart := now.Add(-time.Duration(opts.QuietDays) * day)
+	windowStart := quietStart.Add(-time.Duration(opts.WindowDays) * day)
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH plays AS (
+	SELECT track_id, played_at
+	FROM spotify_played_tracks
+	WHERE user_id = $1
+		AND played_at >= $2
+		AND ($5 = 0 OR account_id = $5)
+)
+SELECT 'track' AS kind, spotify_tracks.id, spotify_tracks.name,
+	COUNT(*) FILTER (WHERE plays.played_at < $3), MAX(plays.played_at)
+FROM plays
+JOIN spotify_tracks ON spotify_tracks.id = plays.track_id
+GROUP BY spotify_tracks.id, spotify_tracks.name
+HAVING COUNT(*) FILTER (WHERE plays.played_at < $3) >= $4
+	AND MAX(plays.played_at) < $3
+UNION ALL
+SELECT 'artist', spotify_artists.id, spotify_artists.name,
+	COUNT(*) FILTER (WHERE plays.played_at < $3), MAX(plays.played_at)
+FROM plays
+JOIN spotify_credits ON spotify_credits.track_id = plays.track_id
+JOIN spotify_artists ON spotify_artists.id = spotify_credits.artist_id
+GROUP BY spotify_artists.id, spotify_artists.name
+HAVING COUNT(*) FILTER (WHERE plays.played_at < $3) >= $4
+	AND MAX(plays.played_at) < $3`,
+		listener.UserID, windowStart, quietStart, opts.MinPlays, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]Rediscovery, 0)
+	for rows.Next() {
+		var r Rediscovery
+		if err = rows.Scan(&r.Kind, &r.ID, &r.Name, &r.PastPlays, &r.LastPlayed); err != nil {
+			return nil, err
+		}
+		r.score(now, opts)
+		results = append(results, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(results, func(a, b Rediscovery) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return b.PastPlays - a.PastPlays
+	})
+	if len(results) > opts.Limit {
+		results = results[:opts.Limit]
+	}
+	return results, nil
+}
+
+func (svc Controller) rediscover(c *gin.Context, listener Listener, logger *slog.Logger) {
+	opts := DefaultRediscoverOptions()
+	if err := c.BindQuery(&opts); err != nil {
+		logger.Error("error binding query for rediscover", "error", err)
+		zgin.BadRequest(c, "please provide correct query params")
+		return
+	} else if err = opts.Validate(); err != nil {
+		zgin.BadRequest(c, err.Error())
+		return
+	}
+
+	results, err := svc.History.Rediscover(c.Request.Context(), listener, time.Now().UTC(), opts)
+	if err != nil {
+		logger.Error("error finding rediscoveries", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"options": opts,
+		"results": results,
+	})
+}
@@ -0,0 +1,516 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+const (
+	ScopeFollowRead = "user-follow-read"
+
+	TrackedFollowed = "followed"
+	TrackedPlayed   = "played"
+
+	followedArtistsPageSize = 50
+	artistReleasesPageSize  = 50
+	// artists played at least this many times are tracked even if they aren't followed
+	releaseArtistMinPlays = 25
+	// releases this recent are still new the first time an artist is polled,
+	// older ones are back catalogue
+	releaseRadarWindow = 14 * 24 * time.Hour
+	// how far back to look for users who have never checked for new releases
+	defaultReleaseLookback = 30 * 24 * time.Hour
+)
+
+// ReleaseObject is an album or single, as listed in an artist's discography
+type ReleaseObject struct {
+	Identifier
+	Type        string `json:"album_type"`
+	TotalTracks int    `json:"total_tracks"`
+	// ReleaseDate is only as precise as ReleaseDatePrecision, one of year, month or day
+	ReleaseDate          string        `json:"release_date"`
+	ReleaseDatePrecision string        `json:"release_date_precision"`
+	Artists              []Identifier  `json:"artists"`
+	Images               []ImageObject `json:"images"`
+}
+
+// ReleasedAt parses the release date, taking the start of the year or month if that's all we have
+func (r ReleaseObject) ReleasedAt() (time.Time, error) {
+	switch r.ReleaseDatePrecision {
+	case "year":
+		return time.Parse("2006", r.ReleaseDate)
+	case "month":
+		return time.Parse("2006-01", r.ReleaseDate)
+	case "day":
+		return time.Parse(time.DateOnly, r.ReleaseDate)
+	default:
+		return time.Time{}, fmt.Errorf("unknown release date precision [%v]", r.ReleaseDatePrecision)
+	}
+}
+
+// see: https://developer.spotify.com/documentation/web-api/reference/get-followed
+func (c Client) GetFollowedArtists(ctx context.Context, token AccessToken) ([]ArtistObject, error) {
+	var (
+		artists []ArtistObject
+		after   string
+	)
+	for {
+		var page struct {
+			Artists struct {
+				Items   []ArtistObject `json:"items"`
+				Cursors struct {
+					After string `json:"after"`
+				} `json:"cursors"`
+			} `json:"artists"`
+		}
+		q := url.Values{
+			"type":  {"artist"},
+			"limit": {strconv.Itoa(followedArtistsPageSize)},
+		}
+		if after != "" {
+			q.Set("after", after)
+		}
+		if _, err := c.get(ctx, token, "/me/following", q, &page); err != nil {
+			return nil, err
+		}
+		artists = append(artists, page.Artists.Items...)
+		after = page.Artists.Cursors.After
+		if len(page.Artists.Items) == 0 || after == "" {
+			return artists, nil
+		}
+	}
+}
+
+// GetArtistReleases lists the artist's albums and singles, skipping compilations and appearances
+//
+// see: https://developer.spotify.com/documentation/web-api/reference/get-an-artists-albums
+func (c Client) GetArtistReleases(ctx context.Context, token AccessToken, id string) ([]ReleaseObject, error) {
+	var releases []ReleaseObject
+	for {
+		var page struct {
+			Items []ReleaseObject `json:"items"`
+			Total int             `json:"total"`
+		}
+		q := url.Values{
+			"include_groups": {"album,single"},
+			"limit":          {strconv.Itoa(artistReleasesPageSize)},
+			"offset":         {strconv.Itoa(len(releases))},
+		}
+		if _, err := c.get(ctx, token, "/artists/"+id+"/albums", q, &page); err != nil {
+			return nil, err
+		}
+		releases = append(releases, page.Items...)
+		if len(page.Items) == 0 || len(releases) >= page.Total {
+			return releases, nil
+		}
+	}
+}
+
+// Release is an album or single by an artist the user tracks
+type Release struct {
+	AlbumID     string    `json:"album_id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	ArtistID    string    `json:"artist_id"`
+	ArtistName  string    `json:"artist_name"`
+	ReleaseDate string    `json:"release_date"`
+	TotalTracks int       `json:"total_tracks"`
+	URL         string    `json:"url"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+}
+
+// TrackedArtist is an artist polled for new releases on the user's behalf
+type TrackedArtist struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Reason is one of followed or played
+	Reason string `json:"reason"`
+}
+
+type ReleaseRefreshResult struct {
+	Artists  int       `json:"artists"`
+	Releases []Release `json:"releases"`
+}
+
+// ReleaseStore keeps the discographies of artists users follow or play a lot,
+// so that new releases can be surfaced. releases are shared between users.
+type ReleaseStore struct {
+	db *sql.DB
+}
+
+func NewReleaseStore(db *sql.DB) ReleaseStore {
+	return ReleaseStore{
+		db: db,
+	}
+}
+
+// TrackArtists replaces the artists tracked for the user with those followed,
+// and those played at least minPlays times by the listener.
+func (s ReleaseStore) TrackArtists(
+	ctx context.Context, listener Listener, followed []ArtistObject, minPlays int,
+) ([]TrackedArtist, error) {
+	logger := zlog.Logger(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return nil, err
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+DELETE FROM spotify_release_artists
+WHERE user_id = $1`, listener.UserID); err != nil {
+		logger.Error("error clearing tracked artists", "error", err)
+		return nil, zql.Rollback(tx, err)
+	}
+
+	for _, artist := range followed {
+		if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_artists
+(id, name, href, uri, external_url)
+VALUES
+($1, $2, $3, $4, $5)
+ON CONFLICT
+	DO NOTHING`,
+			artist.ID, artist.Name, artist.Href, artist.URI, artist.ExternalURLs.Spotify); err != nil {
+			logger.Error("error persisting artist", "artist", artist.Name, "error", err)
+			return nil, zql.Rollback(tx, err)
+		}
+		if err = persistImages(ctx, tx, ImageArtist, artist.ID, artist.Images); err != nil {
+			logger.Error("error persisting artist images", "artist", artist.Name, "error", err)
+			return nil, zql.Rollback(tx, err)
+		}
+		if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_release_artists
+(user_id, artist_id, reason)
+VALUES
+($1, $2, $3)
+ON CONFLICT
+	DO NOTHING`, listener.UserID, artist.ID, TrackedFollowed); err != nil {
+			logger.Error("error tracking artist", "artist", artist.Name, "error", err)
+			return nil, zql.Rollback(tx, err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_release_artists
+(user_id, artist_id, reason)
+SELECT $1, spotify_credits.artist_id, $4
+FROM spotify_played_tracks
+JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+WHERE spotify_played_tracks.user_id = $1
+	AND ($2 = 0 OR spotify_played_tracks.account_id = $2)
+GROUP BY spotify_credits.artist_id
+HAVING COUNT(*) >= $3
+ON CONFLICT
+	DO NOTHING`, listener.UserID, listener.AccountID, minPlays, TrackedPlayed); err != nil {
+		logger.Error("error tracking played artists", "error", err)
+		return nil, zql.Rollback(tx, err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+SELECT spotify_artists.id, spotify_artists.name, spotify_release_artists.reason
+FROM spotify_release_artists
+JOIN spotify_artists ON spotify_artists.id = spotify_release_artists.artist_id
+WHERE spotify_release_artists.user_id = $1
+ORDER BY spotify_artists.name`, listener.UserID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, zql.Rollback(tx, err)
+	}
+	artists := make([]TrackedArtist, 0)
+	for rows.Next() {
+		var a TrackedArtist
+		if err = rows.Scan(&a.ID, &a.Name, &a.Reason); err != nil {
+			rows.Close()
+			return nil, zql.Rollback(tx, err)
+		}
+		artists = append(artists, a)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, zql.Rollback(tx, err)
+	}
+	return artists, tx.Commit()
+}
+
+// PersistReleases stores the artist's discography, returning the releases that are new to the user.
+// the first time an artist is polled for the user, only releases within releaseRadarWindow of now are new.
+func (s ReleaseStore) PersistReleases(
+	ctx context.Context, userID int, artistID string, releases []ReleaseObject, now time.Time,
+) ([]Release, error) {
+	logger := zlog.Logger(ctx).With(slog.String("artist_id", artistID))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return nil, err
+	}
+
+	var (
+		artistName string
+		polled     bool
+	)
+	if err = tx.QueryRowContext(ctx, `
+SELECT name, EXISTS (
+	SELECT 1
+	FROM spotify_user_releases
+	WHERE user_id = $2
+		AND artist_id = $1
+)
+FROM spotify_artists
+WHERE id = $1
+FOR UPDATE`, artistID, userID).Scan(&artistName, &polled); err != nil {
+		logger.Error("error loading artist", "error", err)
+		return nil, zql.Rollback(tx, err)
+	}
+
+	fresh := make([]Release, 0)
+	for _, r := range releases {
+		releasedAt, err := r.ReleasedAt()
+		if err != nil {
+			logger.Warn("skipping release", "album_id", r.ID, "error", err)
+			continue
+		}
+		backCatalogue := !polled && releasedAt.Before(now.Add(-releaseRadarWindow))
+
+		release := Release{
+			AlbumID:     r.ID,
+			Name:        r.Name,
+			Type:        r.Type,
+			ArtistID:    artistID,
+			ArtistName:  artistName,
+			ReleaseDate: r.ReleaseDate,
+			TotalTracks: r.TotalTracks,
+			URL:         r.ExternalURLs.Spotify,
+		}
+		res, err := tx.ExecContext(ctx, `
+INSERT INTO spotify_releases
+(artist_id, album_id, name, type, release_date, release_date_precision, released_at,
+	total_tracks, href, uri, external_url, first_seen_at)
+VALUES
+($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+ON CONFLICT
+	DO NOTHING`,
+			artistID, r.ID, r.Name, r.Type, r.ReleaseDate, r.ReleaseDatePrecision, releasedAt,
+			r.TotalTracks, r.Href, r.URI, r.ExternalURLs.Spotify, now)
+		if err != nil {
+			logger.Error("error persisting release", "album_id", r.ID, "error", err)
+			return nil, zql.Rollback(tx, err)
+		}
+		if inserted, _ := res.RowsAffected(); inserted > 0 {
+			if err = persistImages(ctx, tx, ImageAlbum, r.ID, r.Images); err != nil {
+				logger.Error("error persisting release images", "album_id", r.ID, "error", err)
+				return nil, zql.Rollback(tx, err)
+			}
+		}
+
+		// another user may have polled the artist first, so whether it's new depends on this user
+		err = tx.QueryRowContext(ctx, `
+INSERT INTO spotify_user_releases
+(user_id, artist_id, album_id, seen_at, back_catalogue)
+VALUES
+($1, $2, $3, $4, $5)
+ON CONFLICT
+	DO NOTHING
+RETURNING seen_at`, userID, artistID, r.ID, now, backCatalogue).Scan(&release.FirstSeenAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			// already seen
+			continue
+		} else if err != nil {
+			logger.Error("error persisting seen release", "album_id", r.ID, "error", err)
+			return nil, zql.Rollback(tx, err)
+		}
+		if !backCatalogue {
+			fresh = append(fresh, release)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `
+UPDATE spotify_artists
+SET releases_polled_at = $2
+WHERE id = $1`, artistID, now); err != nil {
+		logger.Error("error updating artist", "error", err)
+		return nil, zql.Rollback(tx, err)
+	}
+	return fresh, tx.Commit()
+}
+
+// GetNewReleases returns releases by the user's tracked artists they first saw after since, newest first.
+// back catalogue is never new.
+func (s ReleaseStore) GetNewReleases(ctx context.Context, userID int, since time.Time) ([]Release, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT spotify_releases.album_id, spotify_releases.name, spotify_releases.type,
+	spotify_artists.id, spotify_artists.name, spotify_releases.release_date,
+	spotify_releases.total_tracks, spotify_releases.external_url, spotify_user_releases.seen_at
+FROM spotify_releases
+JOIN spotify_user_releases ON spotify_user_releases.artist_id = spotify_releases.artist_id
+	AND spotify_user_releases.album_id = spotify_releases.album_id
+JOIN spotify_release_artists ON spotify_release_artists.user_id = spotify_user_releases.user_id
+	AND spotify_release_artists.artist_id = spotify_releases.artist_id
+JOIN spotify_artists ON spotify_artists.id = spotify_releases.artist_id
+WHERE spotify_user_releases.user_id = $1
+	AND spotify_user_releases.seen_at > $2
+	AND NOT spotify_user_releases.back_catalogue
+ORDER BY spotify_releases.released_at DESC, spotify_user_releases.seen_at DESC, spotify_releases.album_id`,
+		userID, since)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	releases := make([]Release, 0)
+	for rows.Next() {
+		var r Release
+		if err = rows.Scan(&r.AlbumID, &r.Name, &r.Type, &r.ArtistID, &r.ArtistName,
+			&r.ReleaseDate, &r.TotalTracks, &r.URL, &r.FirstSeenAt); err != nil {
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	return releases, rows.Err()
+}
+
+// Check records that the user checked for new releases at checkedAt, returning when they last checked.
+// returns false if they never have.
+func (s ReleaseStore) Check(ctx context.Context, userID int, checkedAt time.Time) (time.Time, bool, error) {
+	var last sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+WITH previous AS (
+	SELECT checked_at
+	FROM spotify_release_checks
+	WHERE user_id = $1
+)
+INSERT INTO spotify_release_checks
+(user_id, checked_at)
+VALUES
+($1, $2)
+ON CONFLICT (user_id) DO UPDATE
+SET checked_at = excluded.checked_at
+RETURNING (SELECT checked_at FROM previous)`, userID, checkedAt).Scan(&last)
+	if err != nil {
+		zlog.Logger(ctx).Error("error recording release check", "error", err)
+		return time.Time{}, false, err
+	}
+	return last.Time, last.Valid, nil
+}
+
+// refreshReleases re-tracks the listener's artists, then polls each of their discographies,
+// publishing every release that's new to the user.
+func (svc Controller) refreshReleases(ctx context.Context, listener Listener) (ReleaseRefreshResult, error) {
+	logger := zlog.Logger(ctx)
+
+	accounts, err := svc.Accounts.GetAccounts(ctx, listener)
+	if err != nil {
+		return ReleaseRefreshResult{}, err
+	} else if len(accounts) == 0 {
+		return ReleaseRefreshResult{}, ErrNoAccount
+	}
+
+	var (
+		followed []ArtistObject
+		// any of the user's tokens can read discographies
+		token AccessToken
+	)
+	for _, account := range accounts {
+		token, err = svc.fetchToken(ctx, Listener{UserID: listener.UserID, AccountID: account.ID})
+		if err != nil {
+			return ReleaseRefreshResult{}, err
+		} else if !token.HasScope(ScopeFollowRead) {
+			return ReleaseRefreshResult{}, ErrMissingScope
+		}
+		artists, err := svc.Client.GetFollowedArtists(ctx, token)
+		if err != nil {
+			return ReleaseRefreshResult{}, err
+		}
+		followed = append(followed, artists...)
+	}
+
+	tracked, err := svc.Releases.TrackArtists(ctx, listener, followed, releaseArtistMinPlays)
+	if err != nil {
+		return ReleaseRefreshResult{}, err
+	}
+
+	result := ReleaseRefreshResult{Artists: len(tracked), Releases: make([]Release, 0)}
+	for _, artist := range tracked {
+		releases, err := svc.Client.GetArtistReleases(ctx, token, artist.ID)
+		if err != nil {
+			return ReleaseRefreshResult{}, err
+		}
+		fresh, err := svc.Releases.PersistReleases(ctx, listener.UserID, artist.ID, releases, time.Now())
+		if err != nil {
+			return ReleaseRefreshResult{}, err
+		}
+		for _, release := range fresh {
+			if err = svc.Publisher.Publish(ctx, gin.H{
+				"user_id":     listener.UserID,
+				"new_release": release,
+			}); err != nil {
+				logger.Error("error publishing message", "album_id", release.AlbumID, "error", err)
+			}
+		}
+		result.Releases = append(result.Releases, fresh...)
+	}
+	return result, nil
+}
+
+func (svc Controller) pollReleases(c *gin.Context, listener Listener, logger *slog.Logger) {
+	result, err := svc.refreshReleases(c.Request.Context(), listener)
+	if errors.Is(err, ErrNoAccount) {
+		accountNotFound(c)
+		return
+	} else if errors.Is(err, ErrMissingScope) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{
+			"error": "token is missing scope " + ScopeFollowRead,
+		})
+		return
+	} else if err != nil {
+		logger.Error("error refreshing releases", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+func (svc Controller) getNewReleases(c *gin.Context, userID user.ID, logger *slog.Logger) {
+	ctx := c.Request.Context()
+	now := time.Now()
+	since, ok, err := svc.Releases.Check(ctx, userID, now)
+	if err != nil {
+		logger.Error("error recording release check", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if !ok {
+		since = now.Add(-defaultReleaseLookback)
+	}
+
+	releases, err := svc.Releases.GetNewReleases(ctx, userID, since)
+	if err != nil {
+		logger.Error("error loading new releases", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"since":    since,
+		"releases": releases,
+	})
+}
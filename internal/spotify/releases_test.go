@@ -0,0 +1,30 @@
+package spotify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReleasedAt(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range []struct {
+		date, precision string
+		expected        time.Time
+	}{
+		{"2024", "year", time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-03", "month", time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-03-15", "day", time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC)},
+	} {
+		releasedAt, err := ReleaseObject{ReleaseDate: tc.date, ReleaseDatePrecision: tc.precision}.ReleasedAt()
+		assert.NoError(err)
+		assert.Equal(tc.expected, releasedAt)
+	}
+
+	_, err := ReleaseObject{ReleaseDate: "2024-03-15", ReleaseDatePrecision: "week"}.ReleasedAt()
+	assert.Error(err)
+	_, err = ReleaseObject{ReleaseDate: "2024-03", ReleaseDatePrecision: "day"}.ReleasedAt()
+	assert.Error(err)
+}
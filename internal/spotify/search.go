@@ -0,0 +1,120 @@
+package spotify
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+const defaultSearchLimit = 20
+
+type SearchResult struct {
+	// Kind is one of track, album or artist
+	Kind       string    `json:"kind"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Rank       float64   `json:"rank"`
+	Listens    int       `json:"listens"`
+	LastPlayed time.Time `json:"last_played"`
+}
+
+// Search does full text and trigram matching over the names of tracks, albums and artists
+// the user has listened to, ranked by how well they match.
+func (s HistoryStore) Search(
+	ctx context.Context, listener Listener, query string, limit int,
+) ([]SearchResult, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH plays AS (
+	SELECT track_id, COUNT(*) AS listens, MAX(played_at) AS last_played
+	FROM spotify_played_tracks
+	WHERE user_id = $1
+		AND ($4 = 0 OR account_id = $4)
+	GROUP BY track_id
+), hits AS (
+	SELECT 'track' AS kind, spotify_tracks.id, spotify_tracks.name,
+		plays.listens, plays.last_played
+	FROM spotify_tracks
+	JOIN plays ON plays.track_id = spotify_tracks.id
+	WHERE to_tsvector('simple', spotify_tracks.name) @@ plainto_tsquery('simple', $2)
+		OR spotify_tracks.name % $2
+	UNION ALL
+	SELECT 'album', spotify_albums.id, spotify_albums.name,
+		SUM(plays.listens), MAX(plays.last_played)
+	FROM spotify_albums
+	JOIN spotify_tracks ON spotify_tracks.album_id = spotify_albums.id
+	JOIN plays ON plays.track_id = spotify_tracks.id
+	WHERE to_tsvector('simple', spotify_albums.name) @@ plainto_tsquery('simple', $2)
+		OR spotify_albums.name % $2
+	GROUP BY spotify_albums.id, spotify_albums.name
+	UNION ALL
+	SELECT 'artist', spotify_artists.id, spotify_artists.name,
+		SUM(plays.listens), MAX(plays.last_played)
+	FROM spotify_artists
+	JOIN spotify_credits ON spotify_credits.artist_id = spotify_artists.id
+	JOIN plays ON plays.track_id = spotify_credits.track_id
+	WHERE to_tsvector('simple', spotify_artists.name) @@ plainto_tsquery('simple', $2)
+		OR spotify_artists.name % $2
+	GROUP BY spotify_artists.id, spotify_artists.name
+)
+SELECT kind, id, name,
+	ts_rank(to_tsvector('simple', name), plainto_tsquery('simple', $2)) + similarity(name, $2) AS rank,
+	listens::int, last_played
+FROM hits
+ORDER BY rank DESC, listens DESC
+LIMIT $3`,
+		listener.UserID, query, limit, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var r SearchResult
+		if err = rows.Scan(&r.Kind, &r.ID, &r.Name, &r.Rank,
+			&r.Listens, &r.LastPlayed); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (svc Controller) search(c *gin.Context, listener Listener, logger *slog.Logger) {
+	opts := struct {
+		Query string `form:"q"`
+		Limit int    `form:"limit"`
+	}{
+		Limit: defaultSearchLimit,
+	}
+	if err := c.BindQuery(&opts); err != nil || opts.Query == "" || opts.Limit <= 0 {
+		logger.Error("error binding query for search", "error", err)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"error": "please provide correct query params",
+		})
+		return
+	}
+
+	results, err := svc.History.Search(c.Request.Context(), listener, opts.Query, opts.Limit)
+	if err != nil {
+		logger.Error("error searching history", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"results": results,
+	})
+}
@@ -0,0 +1,99 @@
+package spotify
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/user"
+	"github.com/zestze/zest-backend/internal/zgin"
+)
+
+// buckets stats can be grouped by, which are also valid postgres date_trunc fields
+const (
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+const (
+	// stats are about longer stretches than the other endpoints, so default to a longer range
+	defaultStatsDays  = 90
+	defaultStatsLimit = 10
+)
+
+// StatsOptions are shared by the endpoints under /stats
+type StatsOptions struct {
+	Options
+	Bucket string `form:"bucket"`
+	Limit  int    `form:"limit"`
+}
+
+func DefaultStatsOptions() StatsOptions {
+	return StatsOptions{
+		Bucket: BucketWeek,
+		Limit:  defaultStatsLimit,
+	}
+}
+
+func (opts StatsOptions) Validate() error {
+	switch opts.Bucket {
+	case BucketDay, BucketWeek, BucketMonth:
+	default:
+		return fmt.Errorf("bucket must be one of %v, %v or %v", BucketDay, BucketWeek, BucketMonth)
+	}
+	if opts.Limit <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	return nil
+}
+
+// StatsRange is the resolved range of a stats request, and the timezone to bucket in
+type StatsRange struct {
+	Start    time.Time
+	End      time.Time
+	Location *time.Location
+}
+
+// resolveStats binds and validates StatsOptions over the defaults in opts, and resolves them
+// in the user's timezone. If it fails, a response has already been written.
+func (svc Controller) resolveStats(
+	c *gin.Context, userID user.ID, logger *slog.Logger, opts StatsOptions,
+) (StatsOptions, StatsRange, bool) {
+	if err := c.BindQuery(&opts); err != nil {
+		logger.Error("error binding query for stats", "error", err)
+		zgin.BadRequest(c, "please provide correct query params")
+		return StatsOptions{}, StatsRange{}, false
+	} else if err = opts.Validate(); err != nil {
+		zgin.BadRequest(c, err.Error())
+		return StatsOptions{}, StatsRange{}, false
+	}
+
+	r, ok := svc.resolveStatsRange(c, userID, logger, opts.Options)
+	return opts, r, ok
+}
+
+// resolveStatsRange resolves opts in the user's timezone, defaulting to a longer range than usual.
+// If it fails, a response has already been written.
+func (svc Controller) resolveStatsRange(
+	c *gin.Context, userID user.ID, logger *slog.Logger, opts Options,
+) (StatsRange, bool) {
+	loc, err := svc.Users.GetLocation(c.Request.Context(), userID)
+	if err != nil {
+		logger.Error("error loading user location", "error", err)
+		zgin.InternalError(c)
+		return StatsRange{}, false
+	}
+
+	if opts.Start == "" {
+		opts.Start = time.Now().In(loc).AddDate(0, 0, -defaultStatsDays).Format(time.DateOnly)
+	}
+	start, end, err := opts.Range(loc)
+	if err != nil {
+		zgin.BadRequest(c, err.Error())
+		return StatsRange{}, false
+	}
+	return StatsRange{Start: start, End: end, Location: loc}, true
+}
@@ -23,10 +23,10 @@ type StoreV1 struct {
 	TokenStore
 }
 
-func NewStoreV1(db *sql.DB) StoreV1 {
+func NewStoreV1(db *sql.DB, opts ...TokenOption) StoreV1 {
 	return StoreV1{
 		db:         db,
-		TokenStore: NewTokenStore(db),
+		TokenStore: NewTokenStore(db, opts...),
 	}
 }
 
@@ -66,7 +66,7 @@ WHERE user_id=$1`, userID)
 }
 
 func (s StoreV1) PersistRecentlyPlayed(
-	ctx context.Context, songs []PlayHistoryObject, userID int,
+	ctx context.Context, songs []PlayHistoryObject, listener Listener,
 ) ([]string, error) {
 	logger := zlog.Logger(ctx)
 
@@ -74,9 +74,9 @@ func (s StoreV1) PersistRecentlyPlayed(
 		`INSERT INTO spotify_songs
 		(user_id, played_at, track_id,
 		track_name, track_blob, album_id, album_name,
-		artist_id, artist_name, context_blob)
+		artist_id, artist_name, context_blob, account_id)
 		VALUES
-		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 		ON CONFLICT
 			DO NOTHING
 		RETURNING track_id`)
@@ -116,12 +116,12 @@ func (s StoreV1) PersistRecentlyPlayed(
 		var trackID string
 		err = tx.Stmt(stmt).
 			QueryRowContext(ctx,
-				userID, song.PlayedAt,
+				listener.UserID, song.PlayedAt,
 				song.Track.ID, song.Track.Name,
 				trackBlob,
 				song.Track.Album.ID, song.Track.Album.Name,
 				artist.ID, artist.Name,
-				contextBlob).Scan(&trackID)
+				contextBlob, listener.nullAccount()).Scan(&trackID)
 
 		if err != nil && errors.Is(err, sql.ErrNoRows) {
 			continue
@@ -136,15 +136,16 @@ func (s StoreV1) PersistRecentlyPlayed(
 }
 
 func (s StoreV1) GetRecentlyPlayed(
-	ctx context.Context, userID int, start, end time.Time,
+	ctx context.Context, listener Listener, start, end time.Time,
 ) ([]NameWithTime, error) {
 	logger := zlog.Logger(ctx)
 
 	rows, err := s.db.QueryContext(ctx,
 		`SELECT played_at, track_name
 		FROM spotify_songs
-		WHERE user_id=$1 AND $2 <= played_at and played_at <= $3`,
-		userID, start, end)
+		WHERE user_id=$1 AND $2 <= played_at and played_at <= $3
+			AND ($4 = 0 OR account_id = $4)`,
+		listener.UserID, start, end, listener.AccountID)
 
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		logger.Error("encountered internal error when scanning spotify songs", "error", err)
@@ -177,15 +178,16 @@ type TrackBlob struct {
 // GetRecentlyPlayedByArtist returns a map of artist names to the number of times
 // they appear in the user's recently played songs.
 func (s StoreV1) GetRecentlyPlayedByArtist(
-	ctx context.Context, userID int, start, end time.Time,
+	ctx context.Context, listener Listener, start, end time.Time,
 ) ([]NameWithListens, error) {
 	logger := zlog.Logger(ctx)
 
 	rows, err := s.db.QueryContext(ctx,
 		`SELECT artist_name, track_blob
 		FROM spotify_songs
-		WHERE user_id=$1 AND $2 <= played_at and played_at <= $3`,
-		userID, start, end)
+		WHERE user_id=$1 AND $2 <= played_at and played_at <= $3
+			AND ($4 = 0 OR account_id = $4)`,
+		listener.UserID, start, end, listener.AccountID)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		logger.Error("encountered internal error when scanning spotify songs", "error", err)
 	}
@@ -228,60 +230,20 @@ func toSlice(m map[string]int) []NameWithListens {
 	return s
 }
 
-// TODO(zeke): really need to setup multiple tables for this kind of relationship...
-func (s StoreV1) GetRecentlyPlayedForArtist(
-	ctx context.Context, userID int, artist string, start, end time.Time,
-) ([]NameWithListens, error) {
-	logger := zlog.Logger(ctx)
-
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT track_name, artist_name, track_blob
-		FROM spotify_songs
-		WHERE user_id=$1 AND $2 <= played_at and played_at <= $3`,
-		userID, artist, start, end)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		logger.Error("encountered internal error when scanning spotify songs", "error", err)
-	}
-	defer rows.Close()
-
-	songCounts := make(map[string]int)
-	for rows.Next() {
-		var trackName, artistName, trackBlob string
-		if err := rows.Scan(&trackName, &artistName, &trackBlob); err != nil {
-			return nil, err
-		}
-		if artistName == artist {
-			songCounts[trackName] += 1
-			continue
-		}
-		var track TrackBlob
-		if err = jsoniter.UnmarshalFromString(trackBlob, &track); err != nil {
-			return nil, err
-		}
-		if slices.ContainsFunc(track.Artists[1:], func(a artistBlob) bool {
-			return a.Name == artist
-		}) {
-			songCounts[trackName] += 1
-		}
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	return toSlice(songCounts), nil
-}
-
 func (s StoreV1) Reset(ctx context.Context) error {
 	logger := zlog.Logger(ctx)
 
 	if _, err := s.db.Exec(`
 		DROP TABLE IF EXISTS spotify_tokens;
 		CREATE TABLE IF NOT EXISTS spotify_tokens (
-			user_id       INTEGER PRIMARY KEY,
+			account_id    INTEGER PRIMARY KEY,
+			user_id       INTEGER,
 			access_token  TEXT,
 			token_type    TEXT,
 			scope         TEXT,
 			expires_at    TEXT,
-			refresh_token TEXT
+			refresh_token TEXT,
+			key_id        TEXT
 		);
 		DROP TABLE IF EXISTS spotify_songs;
 		CREATE TABLE IF NOT EXISTS spotify_songs (
@@ -295,6 +257,7 @@ func (s StoreV1) Reset(ctx context.Context) error {
 			artist_id    TEXT,
 			artist_name  TEXT,
 			context_blob TEXT,
+			account_id   INTEGER,
 			created_at   INTEGER
 		);`); err != nil {
 		logger.Error("error running reset sql", "error", err)
@@ -9,6 +9,7 @@ import (
 
 	jsoniter "github.com/json-iterator/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zql"
 )
 
@@ -29,18 +30,26 @@ func TestDB(t *testing.T) {
 
 	songs := mockFetchSongs(t, "mock_api_response.json")
 
-	userID := 1
-	persistedTracks, err := store.PersistRecentlyPlayed(ctx, songs, userID)
+	listener := Listener{UserID: 1, AccountID: 1}
+	persistedTracks, err := store.PersistRecentlyPlayed(ctx, songs, listener)
 	assert.NoError(err)
 	assert.Len(persistedTracks, 5)
 
 	start := time.Date(2024, 2, 10, 17, 0, 0, 0, time.UTC)
 	end := start.Add(time.Hour)
-	loaded, err := store.GetRecentlyPlayed(ctx, userID, start, end)
+	loaded, err := store.GetRecentlyPlayed(ctx, listener, start, end)
 	assert.NoError(err)
 	assert.Len(loaded, 5)
 
-	artistMap, err := store.GetRecentlyPlayedByArtist(ctx, userID, start, end)
+	// merged across accounts includes everything, other accounts have nothing
+	loaded, err = store.GetRecentlyPlayed(ctx, AllAccounts(listener.UserID), start, end)
+	assert.NoError(err)
+	assert.Len(loaded, 5)
+	loaded, err = store.GetRecentlyPlayed(ctx, Listener{UserID: 1, AccountID: 2}, start, end)
+	assert.NoError(err)
+	assert.Empty(loaded)
+
+	artistMap, err := store.GetRecentlyPlayedByArtist(ctx, AllAccounts(listener.UserID), start, end)
 	assert.NoError(err)
 	fmt.Println(artistMap)
 	assert.Len(artistMap, 7)
@@ -57,3 +66,86 @@ func mockFetchSongs(t *testing.T, fname string) []PlayHistoryObject {
 	assert.Len(t, items, 5)
 	return items
 }
+
+func TestTokenStore(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := os.CreateTemp("", "spotify.*.db")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	db, err := zql.Sqlite3(f.Name())
+	assert.NoError(err)
+	defer db.Close()
+	store := NewStoreV1(db, WithKeyring(zcrypt.ForTesting()))
+
+	ctx := context.Background()
+	assert.NoError(store.Reset(ctx))
+
+	listener := Listener{UserID: 1, AccountID: 1}
+	token := AccessToken{
+		Access:    "access",
+		Type:      "Bearer",
+		Scope:     ScopeReadCurrentlyPlaying,
+		Refresh:   "refresh",
+		ExpiresAt: time.Now().Add(time.Hour).UTC(),
+	}
+	assert.NoError(store.PersistToken(ctx, token, listener))
+
+	var rawAccess, rawRefresh string
+	assert.NoError(db.QueryRowContext(ctx,
+		`SELECT access_token, refresh_token FROM spotify_tokens WHERE account_id=$1`, listener.AccountID).
+		Scan(&rawAccess, &rawRefresh))
+	assert.NotEqual(token.Access, rawAccess)
+	assert.NotEqual(token.Refresh, rawRefresh)
+
+	loaded, err := store.GetToken(ctx, listener)
+	assert.NoError(err)
+	assert.Equal(token.Access, loaded.Access)
+	assert.Equal(token.Refresh, loaded.Refresh)
+
+	// re-authorizing with more scopes replaces the old ones
+	reauthorized := token
+	reauthorized.Scope = ScopeReadCurrentlyPlaying + " " + ScopeReadLibrary
+	assert.NoError(store.PersistToken(ctx, reauthorized, listener))
+	loaded, err = store.GetToken(ctx, listener)
+	assert.NoError(err)
+	assert.Equal(reauthorized.Scope, loaded.Scope)
+	assert.True(loaded.HasScope(ScopeReadLibrary))
+
+	// tokens belong to a single account
+	_, err = store.GetToken(ctx, AllAccounts(listener.UserID))
+	assert.ErrorIs(err, ErrNoAccount)
+	assert.ErrorIs(store.PersistToken(ctx, token, AllAccounts(listener.UserID)), ErrNoAccount)
+
+	// nothing to do, already under the current key
+	n, err := store.Rotate(ctx)
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	// legacy rows from before encryption are plaintext without a key id
+	legacy := Listener{UserID: 2, AccountID: 2}
+	_, err = db.ExecContext(ctx, `INSERT INTO spotify_tokens
+		(account_id, user_id, access_token, token_type, scope, expires_at, refresh_token)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		legacy.AccountID, legacy.UserID, "legacy-access", "Bearer", "", token.ExpiresAt, "legacy-refresh")
+	assert.NoError(err)
+
+	legacyToken, err := store.GetToken(ctx, legacy)
+	assert.NoError(err)
+	assert.Equal("legacy-access", legacyToken.Access)
+
+	n, err = store.Rotate(ctx)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	assert.NoError(db.QueryRowContext(ctx,
+		`SELECT access_token FROM spotify_tokens WHERE account_id=$1`, legacy.AccountID).
+		Scan(&rawAccess))
+	assert.NotEqual("legacy-access", rawAccess)
+
+	legacyToken, err = store.GetToken(ctx, legacy)
+	assert.NoError(err)
+	assert.Equal("legacy-access", legacyToken.Access)
+	assert.Equal("legacy-refresh", legacyToken.Refresh)
+}
@@ -17,15 +17,15 @@ type StoreV2 struct {
 	TokenStore
 }
 
-func NewStoreV2(db *sql.DB) StoreV2 {
+func NewStoreV2(db *sql.DB, opts ...TokenOption) StoreV2 {
 	return StoreV2{
 		db:         db,
-		TokenStore: NewTokenStore(db),
+		TokenStore: NewTokenStore(db, opts...),
 	}
 }
 
 func (s StoreV2) PersistRecentlyPlayed(
-	ctx context.Context, songs []PlayHistoryObject, userID int,
+	ctx context.Context, songs []PlayHistoryObject, listener Listener,
 ) ([]string, error) {
 	logger := zlog.Logger(ctx)
 
@@ -39,7 +39,7 @@ func (s StoreV2) PersistRecentlyPlayed(
 	persisted := make([]string, 0)
 	for _, song := range songs {
 		logger := logger.With(slog.String("track", song.Track.Name))
-		trackID, err := persistSong(ctx, tx, song, userID)
+		trackID, err := persistSong(ctx, tx, song, listener)
 		if err != nil {
 			logger.Error("error persisting song", "error", err)
 			return nil, zql.Rollback(tx, err)
@@ -56,7 +56,7 @@ type NameWithTime struct {
 }
 
 func (s StoreV2) GetRecentlyPlayed(
-	ctx context.Context, userID int, start, end time.Time,
+	ctx context.Context, listener Listener, start, end time.Time,
 ) ([]NameWithTime, error) {
 	logger := zlog.Logger(ctx)
 
@@ -65,8 +65,9 @@ SELECT played_at, spotify_tracks.name
 FROM spotify_played_tracks
 JOIN spotify_tracks on spotify_tracks.id = spotify_played_tracks.track_id
 WHERE user_id=$1 
-	AND spotify_played_tracks.played_at BETWEEN $2 AND $3`,
-		userID, start, end)
+	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND ($4 = 0 OR spotify_played_tracks.account_id = $4)`,
+		listener.UserID, start, end, listener.AccountID)
 	if err != nil {
 		logger.Error("error querying for rows", "error", err)
 		return nil, err
@@ -87,7 +88,7 @@ WHERE user_id=$1
 }
 
 func (s StoreV2) GetRecentlyPlayedByArtist(
-	ctx context.Context, userID int, start, end time.Time,
+	ctx context.Context, listener Listener, start, end time.Time,
 ) ([]NameWithListens, error) {
 	logger := zlog.Logger(ctx)
 
@@ -99,9 +100,10 @@ JOIN spotify_credits on spotify_credits.track_id = spotify_tracks.id
 JOIN spotify_artists on spotify_artists.id = spotify_credits.artist_id
 WHERE spotify_played_tracks.user_id = $1 
 	AND spotify_played_tracks.played_at BETWEEN $2 AND $3
+	AND ($4 = 0 OR spotify_played_tracks.account_id = $4)
 GROUP BY artist_name
 ORDER BY num_listens DESC`,
-		userID, start, end)
+		listener.UserID, start, end, listener.AccountID)
 	if err != nil {
 		logger.Error("error querying for rows", "error", err)
 		return nil, err
@@ -126,47 +128,41 @@ type NameWithListens struct {
 	Listens int    `json:"listens"`
 }
 
-func (s StoreV2) GetRecentlyPlayedForArtist(
-	ctx context.Context, userID int, artist string, start, end time.Time,
-) ([]NameWithListens, error) {
-	logger := zlog.Logger(ctx)
+// persistSong persists a played track to our database, along with all other rows that are necessary
+func persistSong(ctx context.Context, tx *sql.Tx, song PlayHistoryObject, listener Listener) (string, error) {
+	if err := persistTrack(ctx, tx, song.Track); err != nil {
+		return "", err
+	}
 
-	rows, err := s.db.QueryContext(ctx, `
-SELECT spotify_played_tracks.name as track_name, COUNT(spotify_played_tracks.played_at) as num_listens 
-FROM spotify_played_tracks
-JOIN spotify_tracks on spotify_tracks.id = spotify_played_tracks.track_id
-JOIN spotify_credits on spotify_credits.track_id = spotify_tracks.id
-JOIN spotify_artists on spotify_artists.id = spotify_credits.artist_id
-WHERE spotify_played_tracks.user_id = $1 
-	AND spotify_artists.name = $2
-	AND spotify_played_tracks.played_at BETWEEN $3 AND $4
-GROUP BY track_name
-ORDER BY num_listens DESC`,
-		userID, artist, start, end)
+	// FINALLY, make the play history
+	contextBlob, err := song.ContextBlob()
 	if err != nil {
-		logger.Error("error querying for rows", "error", err)
-		return nil, err
+		return "", fmt.Errorf("error encoding context blob: %w", err)
 	}
 
-	songs := make([]NameWithListens, 0)
-	for rows.Next() {
-		var s NameWithListens
-		if err = rows.Scan(&s.Name, &s.Listens); err != nil {
-			return nil, err
-		}
-		songs = append(songs, s)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+	var trackID string
+	err = tx.QueryRowContext(ctx, `
+INSERT INTO spotify_played_tracks 
+(user_id, played_at, track_id, context_blob, account_id)
+VALUES
+($1, $2, $3, $4, $5)
+ON CONFLICT
+	DO NOTHING
+RETURNING track_id`,
+		listener.UserID, song.PlayedAt, song.Track.ID, contextBlob, listener.nullAccount()).
+		Scan(&trackID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		// song is already persisted, so RETURNING will provide no rows due to ON CONFLICT
+		return song.Track.ID, nil
 	}
-	return songs, nil
+	return trackID, err
 }
 
-// persistSong persists a played track to our database, along with all other rows that are necessary
-func persistSong(ctx context.Context, tx *sql.Tx, song PlayHistoryObject, userID int) (string, error) {
-
+// persistTrack makes sure the track exists, along with its album, artists and credits
+func persistTrack(ctx context.Context, tx *sql.Tx, track TrackObject) error {
 	// first, make sure album exists
-	album := song.Track.Album
+	album := track.Album
 	_, err := tx.ExecContext(ctx, `
 INSERT INTO spotify_albums
 (id, name, href, uri, external_url, type)
@@ -176,7 +172,10 @@ ON CONFLICT
 	DO NOTHING`,
 		album.ID, album.Name, album.Href, album.URI, album.ExternalURLs.Spotify, album.Type)
 	if err != nil {
-		return "", fmt.Errorf("error inserting album: %w", err)
+		return fmt.Errorf("error inserting album: %w", err)
+	}
+	if err = persistImages(ctx, tx, ImageAlbum, album.ID, album.Images); err != nil {
+		return err
 	}
 
 	// then, make tracks
@@ -187,14 +186,14 @@ VALUES
 ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 ON CONFLICT
 	DO NOTHING`,
-		song.Track.ID, song.Track.Name, song.Track.Href, song.Track.URI, song.Track.ExternalURLs.Spotify,
-		song.Track.Album.ID, song.Track.DurationMS, song.Track.Explicit, song.Track.Popularity)
+		track.ID, track.Name, track.Href, track.URI, track.ExternalURLs.Spotify,
+		track.Album.ID, track.DurationMS, track.Explicit, track.Popularity)
 	if err != nil {
-		return "", fmt.Errorf("error inserting track: %w", err)
+		return fmt.Errorf("error inserting track: %w", err)
 	}
 
 	// THEN, make artists and their credits!
-	for _, artist := range song.Track.Artists {
+	for _, artist := range track.Artists {
 		// TODO(zeke): verify genres works!
 		// make artists
 		_, err = tx.ExecContext(ctx, `
@@ -207,7 +206,7 @@ ON CONFLICT
 			artist.ID, artist.Name, artist.Href, artist.URI, artist.ExternalURLs.Spotify,
 			artist.Genres, artist.Popularity)
 		if err != nil {
-			return "", fmt.Errorf("error inserting artist [%v]: %w", artist.Name, err)
+			return fmt.Errorf("error inserting artist [%v]: %w", artist.Name, err)
 		}
 
 		// make credits
@@ -217,33 +216,10 @@ INSERT INTO spotify_credits
 VALUES
 ($1, $2)
 ON CONFLICT
-	DO NOTHING `, song.Track.ID, artist.ID)
+	DO NOTHING `, track.ID, artist.ID)
 		if err != nil {
-			return "", fmt.Errorf("error inserting credit for artist [%v]: %w", artist.Name, err)
+			return fmt.Errorf("error inserting credit for artist [%v]: %w", artist.Name, err)
 		}
 	}
-
-	// FINALLY, make the play history
-	contextBlob, err := song.ContextBlob()
-	if err != nil {
-		return "", fmt.Errorf("error encoding context blob: %w", err)
-	}
-
-	var trackID string
-	err = tx.QueryRowContext(ctx, `
-INSERT INTO spotify_played_tracks 
-(user_id, played_at, track_id, context_blob)
-VALUES
-($1, $2, $3, $4)
-ON CONFLICT
-	DO NOTHING
-RETURNING track_id`,
-		userID, song.PlayedAt, song.Track.ID, contextBlob).
-		Scan(&trackID)
-
-	if errors.Is(err, sql.ErrNoRows) {
-		// song is already persisted, so RETURNING will provide no rows due to ON CONFLICT
-		return song.Track.ID, nil
-	}
-	return trackID, err
+	return nil
 }
@@ -26,7 +26,7 @@ func TestTransferSpotifySongs(t *testing.T) {
 	songs, err := storeV1.GetAll(ctx, hardcodedID)
 	assert.NoError(t, err)
 
-	ids, err := storeV2.PersistRecentlyPlayed(ctx, songs, hardcodedID)
+	ids, err := storeV2.PersistRecentlyPlayed(ctx, songs, Listener{UserID: hardcodedID, AccountID: hardcodedID})
 	assert.NoError(t, err)
 	assert.True(t, len(ids) > 0)
 }
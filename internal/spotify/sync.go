@@ -0,0 +1,200 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+)
+
+// maximum number of pages walked in either direction during a single sync,
+// in case spotify keeps handing back cursors.
+const maxSyncPages = 10
+
+// Gap is a period where plays were likely lost, since spotify only
+// keeps a limited window of recently played tracks.
+type Gap struct {
+	// AccountID is only set when loaded, persisting takes the account from the listener
+	AccountID  int       `json:"account_id"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+type recentlyPlayedPager interface {
+	GetRecentlyPlayedPage(ctx context.Context, token AccessToken, cursor Cursor) (ApiResponse, error)
+}
+
+// syncRecentlyPlayed fetches every play after last that spotify still has, oldest first.
+//
+// it walks forward from last with the `after` cursor. If the first page was full then
+// the window may have been overrun, so it walks backward with the `before` cursor trying to reach last.
+// If that still can't reach last, the hole between last and the oldest play we got is returned as a Gap.
+func syncRecentlyPlayed(
+	ctx context.Context, pager recentlyPlayedPager, token AccessToken, last time.Time,
+) ([]PlayHistoryObject, *Gap, error) {
+	var (
+		items   = make([]PlayHistoryObject, 0)
+		seen    = make(map[int64]bool)
+		reached = false
+	)
+	collect := func(page []PlayHistoryObject) int {
+		n := 0
+		for _, item := range page {
+			if !item.PlayedAt.After(last) {
+				reached = true
+				continue
+			} else if seen[item.PlayedAt.UnixMilli()] {
+				continue
+			}
+			seen[item.PlayedAt.UnixMilli()] = true
+			items = append(items, item)
+			n++
+		}
+		return n
+	}
+
+	resp, err := pager.GetRecentlyPlayedPage(ctx, token, Cursor{After: last})
+	if err != nil {
+		return nil, nil, err
+	}
+	overrun := len(resp.Items) >= recentlyPlayedLimit
+	collect(resp.Items)
+
+	for i := 1; i < maxSyncPages && len(resp.Items) >= recentlyPlayedLimit && resp.Next != ""; i++ {
+		after, ok := resp.AfterCursor()
+		if !ok {
+			break
+		}
+		if resp, err = pager.GetRecentlyPlayedPage(ctx, token, Cursor{After: after}); err != nil {
+			return nil, nil, err
+		}
+		if collect(resp.Items) == 0 {
+			break
+		}
+	}
+
+	slices.SortFunc(items, func(a, b PlayHistoryObject) int {
+		return a.PlayedAt.Compare(b.PlayedAt)
+	})
+	if last.IsZero() || len(items) == 0 || !overrun {
+		return items, nil, nil
+	}
+
+	for i := 0; i < maxSyncPages && !reached; i++ {
+		resp, err = pager.GetRecentlyPlayedPage(ctx, token, Cursor{Before: items[0].PlayedAt})
+		if err != nil {
+			return nil, nil, err
+		}
+		n := collect(resp.Items)
+		slices.SortFunc(items, func(a, b PlayHistoryObject) int {
+			return a.PlayedAt.Compare(b.PlayedAt)
+		})
+		if n == 0 {
+			break
+		}
+	}
+
+	if reached {
+		return items, nil, nil
+	}
+	return items, &Gap{
+		Start:      last,
+		End:        items[0].PlayedAt,
+		DetectedAt: time.Now().UTC(),
+	}, nil
+}
+
+type SyncStore struct {
+	db *sql.DB
+}
+
+func NewSyncStore(db *sql.DB) SyncStore {
+	return SyncStore{
+		db: db,
+	}
+}
+
+// LastPlayedAt returns the most recent play persisted for the listener, or the zero time if there are none
+func (s SyncStore) LastPlayedAt(ctx context.Context, listener Listener) (time.Time, error) {
+	logger := zlog.Logger(ctx)
+
+	var last sql.NullTime
+	if err := s.db.QueryRowContext(ctx, `
+SELECT MAX(played_at)
+FROM spotify_played_tracks
+WHERE user_id=$1
+	AND ($2 = 0 OR account_id = $2)`, listener.UserID, listener.AccountID).Scan(&last); err != nil {
+		logger.Error("error querying for last played", "error", err)
+		return time.Time{}, err
+	}
+	return last.Time, nil
+}
+
+// PersistGap records a gap in the coverage of the listener's account, which must be set
+func (s SyncStore) PersistGap(ctx context.Context, listener Listener, gap Gap) error {
+	logger := zlog.Logger(ctx)
+
+	if _, err := s.db.ExecContext(ctx, `
+INSERT INTO spotify_coverage_gaps
+(user_id, account_id, gap_start, gap_end, created_at)
+VALUES
+($1, $2, $3, $4, $5)
+ON CONFLICT (account_id, gap_start)
+	DO UPDATE SET
+	gap_end=excluded.gap_end`,
+		listener.UserID, listener.AccountID, gap.Start, gap.End, gap.DetectedAt); err != nil {
+		logger.Error("error persisting coverage gap", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s SyncStore) GetGaps(ctx context.Context, listener Listener) ([]Gap, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT account_id, gap_start, gap_end, created_at
+FROM spotify_coverage_gaps
+WHERE user_id=$1
+	AND ($2 = 0 OR account_id = $2)
+ORDER BY gap_start DESC`, listener.UserID, listener.AccountID)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	gaps := make([]Gap, 0)
+	for rows.Next() {
+		var g Gap
+		if err = rows.Scan(&g.AccountID, &g.Start, &g.End, &g.DetectedAt); err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, g)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return gaps, nil
+}
+
+func (svc Controller) getGaps(c *gin.Context, listener Listener, logger *slog.Logger) {
+	gaps, err := svc.Sync.GetGaps(c.Request.Context(), listener)
+	if err != nil {
+		logger.Error("error loading coverage gaps", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"gaps": gaps,
+	})
+}
@@ -0,0 +1,95 @@
+package spotify
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePager mimics spotify only keeping a fixed window of plays, newest first
+type fakePager struct {
+	plays []PlayHistoryObject
+}
+
+func (f fakePager) GetRecentlyPlayedPage(
+	_ context.Context, _ AccessToken, cursor Cursor,
+) (ApiResponse, error) {
+	page := make([]PlayHistoryObject, 0)
+	for i := len(f.plays) - 1; i >= 0 && len(page) < recentlyPlayedLimit; i-- {
+		p := f.plays[i]
+		if !cursor.After.IsZero() && !p.PlayedAt.After(cursor.After) {
+			continue
+		} else if !cursor.Before.IsZero() && !p.PlayedAt.Before(cursor.Before) {
+			continue
+		}
+		page = append(page, p)
+	}
+
+	var resp ApiResponse
+	resp.Items = page
+	if len(page) > 0 {
+		resp.Next = "next"
+		resp.Cursors.After = strconv.FormatInt(page[0].PlayedAt.UnixMilli(), 10)
+		resp.Cursors.Before = strconv.FormatInt(page[len(page)-1].PlayedAt.UnixMilli(), 10)
+	}
+	return resp, nil
+}
+
+func playsBetween(start time.Time, n int) []PlayHistoryObject {
+	plays := make([]PlayHistoryObject, 0, n)
+	for i := range n {
+		plays = append(plays, PlayHistoryObject{
+			PlayedAt: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	return plays
+}
+
+func TestSyncRecentlyPlayed(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 2, 10, 17, 0, 0, 0, time.UTC)
+
+	t.Run("no history", func(t *testing.T) {
+		pager := fakePager{plays: playsBetween(start, 10)}
+		items, gap, err := syncRecentlyPlayed(ctx, pager, AccessToken{}, time.Time{})
+		assert.NoError(t, err)
+		assert.Nil(t, gap)
+		assert.Len(t, items, 10)
+		assert.True(t, items[0].PlayedAt.Before(items[9].PlayedAt))
+	})
+
+	t.Run("resumes from last", func(t *testing.T) {
+		plays := playsBetween(start, 10)
+		pager := fakePager{plays: plays}
+		items, gap, err := syncRecentlyPlayed(ctx, pager, AccessToken{}, plays[4].PlayedAt)
+		assert.NoError(t, err)
+		assert.Nil(t, gap)
+		assert.Len(t, items, 5)
+	})
+
+	t.Run("follows cursors", func(t *testing.T) {
+		plays := playsBetween(start, 120)
+		pager := fakePager{plays: plays}
+		items, gap, err := syncRecentlyPlayed(ctx, pager, AccessToken{}, plays[9].PlayedAt)
+		assert.NoError(t, err)
+		assert.Nil(t, gap)
+		assert.Len(t, items, 110)
+	})
+
+	t.Run("detects gap", func(t *testing.T) {
+		plays := playsBetween(start, 120)
+		last := plays[9].PlayedAt
+		// spotify forgot everything but the most recent plays
+		pager := fakePager{plays: plays[60:]}
+		items, gap, err := syncRecentlyPlayed(ctx, pager, AccessToken{}, last)
+		assert.NoError(t, err)
+		assert.Len(t, items, 60)
+		if assert.NotNil(t, gap) {
+			assert.Equal(t, last, gap.Start)
+			assert.Equal(t, plays[60].PlayedAt, gap.End)
+		}
+	})
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/zestze/zest-backend/internal/zcrypt"
 	"github.com/zestze/zest-backend/internal/zlog"
 )
 
@@ -43,49 +46,177 @@ func (at AccessToken) Expired() bool {
 	return time.Now().Add(time.Minute).After(at.ExpiresAt)
 }
 
+// HasScope checks if the space separated scopes granted to the token include scope
+func (at AccessToken) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(at.Scope), scope)
+}
+
 type TokenStore struct {
-	db *sql.DB
+	db      *sql.DB
+	keyring zcrypt.Keyring
+}
+
+type TokenOption func(*TokenStore)
+
+// WithKeyring sets the keyring used to encrypt tokens at rest.
+// without one, tokens can't be persisted.
+func WithKeyring(keyring zcrypt.Keyring) TokenOption {
+	return func(s *TokenStore) {
+		s.keyring = keyring
+	}
 }
 
-func NewTokenStore(db *sql.DB) TokenStore {
-	return TokenStore{
+func NewTokenStore(db *sql.DB, opts ...TokenOption) TokenStore {
+	s := TokenStore{
 		db: db,
 	}
+	for _, o := range opts {
+		o(&s)
+	}
+	return s
 }
 
-func (s TokenStore) PersistToken(ctx context.Context, token AccessToken, userID int) error {
+// PersistToken stores the token for the listener's account, which must be set
+func (s TokenStore) PersistToken(ctx context.Context, token AccessToken, listener Listener) error {
 	logger := zlog.Logger(ctx)
+	if listener.AccountID == 0 {
+		return ErrNoAccount
+	}
+
+	keyID, access, err := s.keyring.Seal(token.Access)
+	if err != nil {
+		logger.Error("error encrypting access token", "error", err)
+		return err
+	}
+	_, refresh, err := s.keyring.Seal(token.Refresh)
+	if err != nil {
+		logger.Error("error encrypting refresh token", "error", err)
+		return err
+	}
 
 	if _, err := s.db.ExecContext(ctx,
 		`INSERT INTO spotify_tokens
-		(user_id, access_token, token_type, scope, expires_at, refresh_token)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (user_id) 
+		(account_id, user_id, access_token, token_type, scope, expires_at, refresh_token, key_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (account_id) 
 			DO UPDATE SET
 			access_token=excluded.access_token,
 			refresh_token=excluded.refresh_token,
-			expires_at=excluded.expires_at`,
-		userID, token.Access, token.Type, token.Scope,
-		token.ExpiresAt, token.Refresh); err != nil {
+			expires_at=excluded.expires_at,
+			key_id=excluded.key_id,
+			scope=excluded.scope,
+			token_type=excluded.token_type`,
+		listener.AccountID, listener.UserID, access, token.Type, token.Scope,
+		token.ExpiresAt, refresh, keyID); err != nil {
 		logger.Error("error persisting spotify tokens", "error", err)
 		return err
 	}
 	return nil
 }
 
-func (s TokenStore) GetToken(ctx context.Context, userID int) (AccessToken, error) {
+// GetToken loads the token for the listener's account, which must be set
+func (s TokenStore) GetToken(ctx context.Context, listener Listener) (AccessToken, error) {
 	logger := zlog.Logger(ctx)
+	if listener.AccountID == 0 {
+		return AccessToken{}, ErrNoAccount
+	}
 
-	var token AccessToken
+	var (
+		token AccessToken
+		keyID sql.NullString
+	)
 	err := s.db.QueryRowContext(ctx,
-		`SELECT access_token, token_type, scope, expires_at, refresh_token
+		`SELECT access_token, token_type, scope, expires_at, refresh_token, key_id
 		FROM spotify_tokens
-		WHERE user_id=$1`, userID).
+		WHERE account_id=$1 AND user_id=$2`, listener.AccountID, listener.UserID).
 		Scan(&token.Access, &token.Type, &token.Scope,
-			&token.ExpiresAt, &token.Refresh)
+			&token.ExpiresAt, &token.Refresh, &keyID)
 
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		logger.Error("encountered internal error when scanning spotify auth", "error", err)
+		return token, err
+	} else if err != nil {
+		return token, err
+	}
+
+	// rows without a key id were persisted before encryption, and are still plaintext
+	if !keyID.Valid {
+		return token, nil
+	}
+	if token.Access, err = s.keyring.Open(keyID.String, token.Access); err != nil {
+		logger.Error("error decrypting access token", "error", err)
+		return AccessToken{}, err
+	}
+	if token.Refresh, err = s.keyring.Open(keyID.String, token.Refresh); err != nil {
+		logger.Error("error decrypting refresh token", "error", err)
+		return AccessToken{}, err
+	}
+	return token, nil
+}
+
+// Rotate re-encrypts every token not already under the keyring's current key,
+// returning the number of rows updated.
+//
+// rows are updated one at a time and only if unchanged since being read,
+// so this is safe to run while the server is refreshing tokens.
+func (s TokenStore) Rotate(ctx context.Context) (int, error) {
+	logger := zlog.Logger(ctx)
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT account_id, access_token, refresh_token, key_id
+		FROM spotify_tokens
+		WHERE key_id IS NULL OR key_id <> $1`, s.keyring.CurrentID())
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return 0, err
+	}
+	defer rows.Close()
+
+	type sealedRow struct {
+		accountID       int
+		access, refresh string
+		keyID           sql.NullString
+	}
+	toRotate := make([]sealedRow, 0)
+	for rows.Next() {
+		var r sealedRow
+		if err = rows.Scan(&r.accountID, &r.access, &r.refresh, &r.keyID); err != nil {
+			return 0, err
+		}
+		toRotate = append(toRotate, r)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, r := range toRotate {
+		keyID, access, err := s.keyring.Reseal(r.keyID.String, r.access)
+		if err != nil {
+			logger.Error("error resealing access token", "account_id", r.accountID, "error", err)
+			return rotated, err
+		}
+		_, refresh, err := s.keyring.Reseal(r.keyID.String, r.refresh)
+		if err != nil {
+			logger.Error("error resealing refresh token", "account_id", r.accountID, "error", err)
+			return rotated, err
+		}
+
+		res, err := s.db.ExecContext(ctx,
+			`UPDATE spotify_tokens
+			SET access_token=$1, refresh_token=$2, key_id=$3
+			WHERE account_id=$4 AND access_token=$5 AND refresh_token=$6`,
+			access, refresh, keyID, r.accountID, r.access, r.refresh)
+		if err != nil {
+			logger.Error("error updating token", "account_id", r.accountID, "error", err)
+			return rotated, err
+		}
+		// if zero, the token was refreshed (and so re-encrypted) underneath us
+		n, err := res.RowsAffected()
+		if err != nil {
+			return rotated, err
+		}
+		rotated += int(n)
 	}
-	return token, err
+	return rotated, nil
 }
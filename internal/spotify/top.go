@@ -0,0 +1,320 @@
+package spotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/zestze/zest-backend/internal/zgin"
+	"github.com/zestze/zest-backend/internal/zlog"
+	"github.com/zestze/zest-backend/internal/zql"
+)
+
+const (
+	ScopeTopRead = "user-top-read"
+
+	TopArtists = "artists"
+	TopTracks  = "tracks"
+
+	// time ranges spotify computes top items over
+	TermShort  = "short_term"
+	TermMedium = "medium_term"
+	TermLong   = "long_term"
+
+	topItemsLimit = 50
+)
+
+var (
+	topKinds = []string{TopArtists, TopTracks}
+	topTerms = []string{TermShort, TermMedium, TermLong}
+)
+
+// termDays approximates the window spotify computes each time range over,
+// so that our own ranks cover about the same stretch of history
+func termDays(term string) (int, error) {
+	switch term {
+	case TermShort:
+		return 28, nil
+	case TermMedium:
+		return 182, nil
+	case TermLong:
+		return 365, nil
+	default:
+		return 0, fmt.Errorf("time_range must be one of %v, %v or %v", TermShort, TermMedium, TermLong)
+	}
+}
+
+// see: https://developer.spotify.com/documentation/web-api/reference/get-users-top-artists-and-tracks
+func (c Client) GetTopItems(
+	ctx context.Context, token AccessToken, kind, term string,
+) ([]Identifier, error) {
+	var page struct {
+		Items []Identifier `json:"items"`
+	}
+	q := url.Values{
+		"time_range": {term},
+		"limit":      {strconv.Itoa(topItemsLimit)},
+	}
+	if _, err := c.get(ctx, token, "/me/top/"+kind, q, &page); err != nil {
+		return nil, err
+	}
+	return page.Items, nil
+}
+
+// TopSnapshot is spotify's ranking of an account's top artists or tracks over one time range, on one day
+type TopSnapshot struct {
+	Kind    string
+	Term    string
+	TakenOn string
+	Items   []Identifier
+}
+
+// RankPoint is where an item ranked on one day, by spotify and by our own play counts.
+// ranks are nil if the item wasn't ranked.
+type RankPoint struct {
+	Date        string `json:"date"`
+	SpotifyRank *int   `json:"spotify_rank"`
+	ZestRank    *int   `json:"zest_rank"`
+	Plays       int    `json:"plays"`
+}
+
+// TopStore keeps daily snapshots of spotify's top items for each account
+type TopStore struct {
+	db *sql.DB
+}
+
+func NewTopStore(db *sql.DB) TopStore {
+	return TopStore{
+		db: db,
+	}
+}
+
+// PersistSnapshots stores the listener's snapshots, which must be for their account.
+// taking a snapshot again on the same day replaces it.
+func (s TopStore) PersistSnapshots(
+	ctx context.Context, listener Listener, snapshots []TopSnapshot, takenAt time.Time,
+) error {
+	logger := zlog.Logger(ctx)
+	if listener.AccountID == 0 {
+		return ErrNoAccount
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error("error beginning transaction", "error", err)
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if _, err = tx.ExecContext(ctx, `
+DELETE FROM spotify_top_items
+WHERE account_id = $1 AND kind = $2 AND time_range = $3 AND taken_on = $4`,
+			listener.AccountID, snapshot.Kind, snapshot.Term, snapshot.TakenOn); err != nil {
+			logger.Error("error clearing snapshot", "error", err)
+			return zql.Rollback(tx, err)
+		}
+
+		for i, item := range snapshot.Items {
+			if _, err = tx.ExecContext(ctx, `
+INSERT INTO spotify_top_items
+(user_id, account_id, kind, time_range, taken_on, taken_at, rank, item_id, name)
+VALUES
+($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				listener.UserID, listener.AccountID, snapshot.Kind, snapshot.Term, snapshot.TakenOn,
+				takenAt, i+1, item.ID, item.Name); err != nil {
+				logger.Error("error persisting top item", "kind", snapshot.Kind, "name", item.Name, "error", err)
+				return zql.Rollback(tx, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// GetArtistRanks returns the artist's rank on every day there's a snapshot in the range, oldest first.
+// zest ranks are by plays over the term's window up to when each snapshot was taken.
+// when merging accounts, the artist's best rank across them is used.
+func (s TopStore) GetArtistRanks(
+	ctx context.Context, listener Listener, artistID, term string, start, end time.Time,
+) ([]RankPoint, error) {
+	logger := zlog.Logger(ctx)
+	days, err := termDays(term)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH snapshots AS (
+	SELECT taken_on, MAX(taken_at) AS taken_at
+	FROM spotify_top_items
+	WHERE user_id = $1
+		AND ($2 = 0 OR account_id = $2)
+		AND kind = $3 AND time_range = $4
+		AND taken_at BETWEEN $5 AND $6
+	GROUP BY taken_on
+)
+SELECT snapshots.taken_on, spotify.rank, zest.rank, COALESCE(zest.plays, 0)
+FROM snapshots
+LEFT JOIN (
+	SELECT taken_on, MIN(rank) AS rank
+	FROM spotify_top_items
+	WHERE user_id = $1
+		AND ($2 = 0 OR account_id = $2)
+		AND kind = $3 AND time_range = $4
+		AND item_id = $7
+	GROUP BY taken_on
+) spotify ON spotify.taken_on = snapshots.taken_on
+LEFT JOIN LATERAL (
+	SELECT ranked.rank, ranked.plays
+	FROM (
+		SELECT spotify_credits.artist_id, COUNT(*) AS plays,
+			RANK() OVER (ORDER BY COUNT(*) DESC) AS rank
+		FROM spotify_played_tracks
+		JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+		WHERE spotify_played_tracks.user_id = $1
+			AND ($2 = 0 OR spotify_played_tracks.account_id = $2)
+			AND spotify_played_tracks.played_at > snapshots.taken_at - $8 * interval '1 day'
+			AND spotify_played_tracks.played_at <= snapshots.taken_at
+		GROUP BY spotify_credits.artist_id
+	) ranked
+	WHERE ranked.artist_id = $7
+) zest ON true
+ORDER BY snapshots.taken_on`,
+		listener.UserID, listener.AccountID, TopArtists, term, start, end, artistID, days)
+	if err != nil {
+		logger.Error("error querying for rows", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]RankPoint, 0)
+	for rows.Next() {
+		var (
+			p                     RankPoint
+			takenOn               time.Time
+			spotifyRank, zestRank sql.NullInt64
+		)
+		if err = rows.Scan(&takenOn, &spotifyRank, &zestRank, &p.Plays); err != nil {
+			return nil, err
+		}
+		p.Date = takenOn.Format(time.DateOnly)
+		p.SpotifyRank = nullRank(spotifyRank)
+		p.ZestRank = nullRank(zestRank)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func nullRank(rank sql.NullInt64) *int {
+	if !rank.Valid {
+		return nil
+	}
+	r := int(rank.Int64)
+	return &r
+}
+
+// snapshotTop takes today's snapshot of every kind and time range for the account
+func (svc Controller) snapshotTop(ctx context.Context, listener Listener, now time.Time) error {
+	token, err := svc.fetchToken(ctx, listener)
+	if err != nil {
+		return err
+	} else if !token.HasScope(ScopeTopRead) {
+		return ErrMissingScope
+	}
+
+	loc, err := svc.Users.GetLocation(ctx, listener.UserID)
+	if err != nil {
+		return err
+	}
+	takenOn := now.In(loc).Format(time.DateOnly)
+
+	snapshots := make([]TopSnapshot, 0, len(topKinds)*len(topTerms))
+	for _, kind := range topKinds {
+		for _, term := range topTerms {
+			items, err := svc.Client.GetTopItems(ctx, token, kind, term)
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, TopSnapshot{Kind: kind, Term: term, TakenOn: takenOn, Items: items})
+		}
+	}
+	return svc.Top.PersistSnapshots(ctx, listener, snapshots, now)
+}
+
+// takeTopSnapshots is meant to be hit once a day, but is safe to hit more often
+func (svc Controller) takeTopSnapshots(c *gin.Context, listener Listener, logger *slog.Logger) {
+	ctx := c.Request.Context()
+	accounts, err := svc.Accounts.GetAccounts(ctx, listener)
+	if err != nil {
+		logger.Error("error loading spotify accounts", "error", err)
+		zgin.InternalError(c)
+		return
+	} else if len(accounts) == 0 {
+		accountNotFound(c)
+		return
+	}
+
+	now := time.Now()
+	for _, account := range accounts {
+		l := Listener{UserID: listener.UserID, AccountID: account.ID}
+		err = svc.snapshotTop(ctx, l, now)
+		if errors.Is(err, ErrMissingScope) {
+			c.IndentedJSON(http.StatusForbidden, gin.H{
+				"error":      "token is missing scope " + ScopeTopRead,
+				"account_id": account.ID,
+			})
+			return
+		} else if err != nil {
+			logger.Error("error taking top snapshot", "account_id", account.ID, "error", err)
+			zgin.InternalError(c)
+			return
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"accounts": len(accounts),
+		"taken_at": now,
+	})
+}
+
+func (svc Controller) getArtistRanks(c *gin.Context, listener Listener, logger *slog.Logger) {
+	var opts struct {
+		Options
+		Term string `form:"time_range"`
+	}
+	opts.Term = TermMedium
+	if err := c.BindQuery(&opts); err != nil {
+		zgin.BadRequest(c, "please provide correct query params")
+		return
+	} else if _, err = termDays(opts.Term); err != nil {
+		zgin.BadRequest(c, err.Error())
+		return
+	}
+
+	r, ok := svc.resolveStatsRange(c, listener.UserID, logger, opts.Options)
+	if !ok {
+		return
+	}
+
+	points, err := svc.Top.GetArtistRanks(c.Request.Context(), listener, c.Param("id"), opts.Term, r.Start, r.End)
+	if err != nil {
+		logger.Error("error loading artist ranks", "error", err)
+		zgin.InternalError(c)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"artist_id":  c.Param("id"),
+		"time_range": opts.Term,
+		"start":      r.Start,
+		"end":        r.End,
+		"ranks":      points,
+	})
+}
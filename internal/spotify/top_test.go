@@ -0,0 +1,22 @@
+package spotify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTermDays(t *testing.T) {
+	assert := assert.New(t)
+
+	previous := 0
+	for _, term := range topTerms {
+		days, err := termDays(term)
+		assert.NoError(err)
+		assert.Greater(days, previous, term)
+		previous = days
+	}
+
+	_, err := termDays("forever")
+	assert.Error(err)
+}
@@ -167,6 +167,87 @@ func (svc Controller) Refresh(c *gin.Context) {
 	})
 }
 
+// RegisterSettings adds routes for the logged in user to manage their settings
+func (svc Controller) RegisterSettings(r gin.IRouter, auth gin.HandlerFunc) {
+	g := r.Group("/user")
+	g.Use(auth)
+	g.GET("/settings", svc.getSettings)
+	g.PATCH("/settings", svc.updateSettings)
+}
+
+func (svc Controller) getSettings(c *gin.Context) {
+	logger := zlog.Logger(c)
+
+	settings, err := svc.Store.GetSettings(c.Request.Context(), c.GetInt(UserIdKey))
+	if err != nil {
+		logger.Error("error loading settings", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"settings": settings,
+	})
+}
+
+// SettingsUpdate only changes the fields that are provided
+type SettingsUpdate struct {
+	Timezone    *string `json:"timezone"`
+	PublicBadge *bool   `json:"public_badge"`
+}
+
+func (svc Controller) updateSettings(c *gin.Context) {
+	logger := zlog.Logger(c)
+
+	var update SettingsUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		logger.Error("error binding body for settings", "error", err)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{
+			"error": "please provide settings correctly",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := c.GetInt(UserIdKey)
+	settings, err := svc.Store.GetSettings(ctx, userID)
+	if err != nil {
+		logger.Error("error loading settings", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	if update.Timezone != nil {
+		// also rejects "Local", which would depend on wherever the server runs
+		if _, err := time.LoadLocation(*update.Timezone); err != nil || *update.Timezone == "Local" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{
+				"error": "timezone must be an IANA timezone name, such as America/New_York",
+			})
+			return
+		}
+		settings.Timezone = *update.Timezone
+	}
+	if update.PublicBadge != nil {
+		settings.PublicBadge = *update.PublicBadge
+	}
+
+	if err = svc.Store.PersistSettings(ctx, userID, settings); err != nil {
+		logger.Error("error persisting settings", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{
+			"error": "internal error",
+		})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"settings": settings,
+	})
+}
+
 // can use c.SetCookie but it's just an annoying wrapper for this direct call
 // might add more fields later
 func (svc Controller) setCookie(c *gin.Context, value string, expiresAt time.Time) {
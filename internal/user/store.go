@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"log/slog"
+	"time"
 
 	"github.com/zestze/zest-backend/internal/zlog"
 )
@@ -61,6 +62,70 @@ func (s Store) PersistUser(ctx context.Context, username, password string, salt
 	return id, nil
 }
 
+// Settings are per user preferences that can be changed after signing up
+type Settings struct {
+	// Timezone is an IANA timezone name, used for interpreting dates and bucketing by day
+	Timezone string `json:"timezone"`
+	// PublicBadge opts in to a public badge of what the user has been listening to
+	PublicBadge bool `json:"public_badge"`
+}
+
+func (s Store) GetSettings(ctx context.Context, userID ID) (Settings, error) {
+	logger := zlog.Logger(ctx)
+
+	var settings Settings
+	err := s.db.QueryRowContext(ctx,
+		`SELECT timezone, public_badge
+		FROM users
+		WHERE id=$1`, userID).
+		Scan(&settings.Timezone, &settings.PublicBadge)
+	if err != nil {
+		logger.Error("error scanning user settings", "error", err)
+	}
+	return settings, err
+}
+
+// GetPublicSettings loads the settings of the user with the given username, for public pages.
+// returns sql.ErrNoRows if there's no such user.
+func (s Store) GetPublicSettings(ctx context.Context, username string) (ID, Settings, error) {
+	var (
+		userID   ID
+		settings Settings
+	)
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, timezone, public_badge
+		FROM users
+		WHERE username=$1`, username).
+		Scan(&userID, &settings.Timezone, &settings.PublicBadge)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		zlog.Logger(ctx).Error("error scanning user settings", "error", err)
+	}
+	return userID, settings, err
+}
+
+func (s Store) PersistSettings(ctx context.Context, userID ID, settings Settings) error {
+	logger := zlog.Logger(ctx)
+
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE users
+		SET timezone=$1, public_badge=$2
+		WHERE id=$3`,
+		settings.Timezone, settings.PublicBadge, userID); err != nil {
+		logger.Error("error persisting user settings", "error", err)
+		return err
+	}
+	return nil
+}
+
+// GetLocation loads the user's timezone, for interpreting dates the user provides
+func (s Store) GetLocation(ctx context.Context, userID ID) (*time.Location, error) {
+	settings, err := s.GetSettings(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(settings.Timezone)
+}
+
 func (s Store) Reset(ctx context.Context) error {
 	logger := zlog.Logger(ctx)
 
@@ -71,6 +136,8 @@ func (s Store) Reset(ctx context.Context) error {
 		username   TEXT UNIQUE,
 		password   TEXT UNIQUE,
 		salt       INTEGER UNIQUE,
+		timezone   TEXT NOT NULL DEFAULT 'UTC',
+		public_badge BOOLEAN NOT NULL DEFAULT FALSE,
 		created_at INTEGER
 	);`); err != nil {
 		logger.Error("error running reset sql", "error", err)
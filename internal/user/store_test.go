@@ -2,6 +2,7 @@ package user
 
 import (
 	"context"
+	"database/sql"
 	"os"
 	"testing"
 
@@ -32,4 +33,23 @@ func TestStore(t *testing.T) {
 	assert.Equal("zeke", user.Username)
 	assert.Equal(1, user.ID)
 
+	settings, err := store.GetSettings(ctx, user.ID)
+	assert.NoError(err)
+	assert.Equal("UTC", settings.Timezone)
+	assert.False(settings.PublicBadge)
+
+	settings.Timezone = "America/New_York"
+	settings.PublicBadge = true
+	assert.NoError(store.PersistSettings(ctx, user.ID, settings))
+
+	userID, public, err := store.GetPublicSettings(ctx, "zeke")
+	assert.NoError(err)
+	assert.Equal(user.ID, userID)
+	assert.Equal(settings, public)
+	_, _, err = store.GetPublicSettings(ctx, "nobody")
+	assert.ErrorIs(err, sql.ErrNoRows)
+
+	loc, err := store.GetLocation(ctx, user.ID)
+	assert.NoError(err)
+	assert.Equal("America/New_York", loc.String())
 }
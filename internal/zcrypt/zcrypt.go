@@ -0,0 +1,261 @@
+// Package zcrypt provides envelope encryption for secrets we store at rest,
+// such as third party oauth tokens.
+//
+// each value is encrypted with a fresh data key, and that data key is encrypted ("wrapped")
+// with a master key from the Keyring. The id of the master key is stored alongside the value,
+// so that master keys can be rotated by adding a new key, making it current,
+// and resealing every stored value before removing the old key.
+package zcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// KeySize is the size of master and data keys, AES-256
+	KeySize = 32
+
+	KeysEnv      = "ZEST_MASTER_KEYS"
+	CurrentEnv   = "ZEST_MASTER_KEY_ID"
+	KeyFileEnv   = "ZEST_MASTER_KEY_FILE"
+	defaultFile  = "secrets/master_keys.json"
+	sealedPrefix = "v1:"
+)
+
+var (
+	ErrNoKeys       = errors.New("no master keys configured")
+	ErrUnknownKey   = errors.New("unknown master key id")
+	ErrInvalidKey   = errors.New("master key must be 32 bytes")
+	ErrMalformed    = errors.New("malformed sealed value")
+	ErrNotSealed    = errors.New("value is not sealed")
+	ErrNoCurrentKey = errors.New("current master key id is not in keyring")
+)
+
+// Keyring holds master keys by id, and which one new values are sealed with.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewKeyring(current string, keys map[string][]byte) (Keyring, error) {
+	if len(keys) == 0 {
+		return Keyring{}, ErrNoKeys
+	}
+	for id, key := range keys {
+		if len(key) != KeySize {
+			return Keyring{}, fmt.Errorf("key [%v]: %w", id, ErrInvalidKey)
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return Keyring{}, ErrNoCurrentKey
+	}
+	return Keyring{
+		current: current,
+		keys:    keys,
+	}, nil
+}
+
+// LoadKeyring loads master keys from the environment if set, otherwise from a key file.
+//
+// the env format is a comma separated list of `id=base64key` in ZEST_MASTER_KEYS,
+// with ZEST_MASTER_KEY_ID naming the current key.
+// the file format is `{"current": "id", "keys": {"id": "base64key"}}`
+// and is read from ZEST_MASTER_KEY_FILE, or secrets/master_keys.json by default.
+func LoadKeyring() (Keyring, error) {
+	if raw, ok := os.LookupEnv(KeysEnv); ok {
+		return parseEnv(raw, os.Getenv(CurrentEnv))
+	}
+
+	fname := defaultFile
+	if f, ok := os.LookupEnv(KeyFileEnv); ok {
+		fname = f
+	}
+	return loadFile(fname)
+}
+
+func parseEnv(raw, current string) (Keyring, error) {
+	encoded := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" {
+			return Keyring{}, fmt.Errorf("invalid entry in %v, expected id=key", KeysEnv)
+		}
+		encoded[id] = key
+	}
+	return decodeKeys(current, encoded)
+}
+
+func loadFile(fname string) (Keyring, error) {
+	bs, err := os.ReadFile(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Keyring{}, ErrNoKeys
+	} else if err != nil {
+		return Keyring{}, err
+	}
+
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err = jsoniter.Unmarshal(bs, &file); err != nil {
+		return Keyring{}, err
+	}
+	return decodeKeys(file.Current, file.Keys)
+}
+
+func decodeKeys(current string, encoded map[string]string) (Keyring, error) {
+	keys := make(map[string][]byte, len(encoded))
+	for id, v := range encoded {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return Keyring{}, fmt.Errorf("error decoding key [%v]: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return NewKeyring(current, keys)
+}
+
+// GenerateKey returns a new random master key, base64 encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (k Keyring) CurrentID() string {
+	return k.current
+}
+
+// Seal encrypts plaintext under the current master key,
+// returning the id of the key used and the sealed value.
+func (k Keyring) Seal(plaintext string) (string, string, error) {
+	kek, ok := k.keys[k.current]
+	if !ok {
+		return "", "", ErrNoKeys
+	}
+
+	dek := make([]byte, KeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return "", "", err
+	}
+
+	wrapped, err := encrypt(kek, dek)
+	if err != nil {
+		return "", "", err
+	}
+	ciphertext, err := encrypt(dek, []byte(plaintext))
+	if err != nil {
+		return "", "", err
+	}
+
+	enc := base64.RawStdEncoding
+	return k.current, sealedPrefix +
+		enc.EncodeToString(wrapped) + "." + enc.EncodeToString(ciphertext), nil
+}
+
+// Open decrypts a value produced by Seal with the master key keyID
+func (k Keyring) Open(keyID, sealed string) (string, error) {
+	kek, ok := k.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("key [%v]: %w", keyID, ErrUnknownKey)
+	}
+
+	body, ok := strings.CutPrefix(sealed, sealedPrefix)
+	if !ok {
+		return "", ErrNotSealed
+	}
+	rawWrapped, rawCiphertext, ok := strings.Cut(body, ".")
+	if !ok {
+		return "", ErrMalformed
+	}
+
+	enc := base64.RawStdEncoding
+	wrapped, err := enc.DecodeString(rawWrapped)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	ciphertext, err := enc.DecodeString(rawCiphertext)
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	dek, err := decrypt(kek, wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := decrypt(dek, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Reseal re-encrypts a sealed value under the current master key.
+// values with an empty keyID are treated as legacy plaintext and sealed as-is.
+func (k Keyring) Reseal(keyID, sealed string) (string, string, error) {
+	plaintext := sealed
+	if keyID != "" {
+		var err error
+		if plaintext, err = k.Open(keyID, sealed); err != nil {
+			return "", "", err
+		}
+	}
+	return k.Seal(plaintext)
+}
+
+// encrypt seals with AES-GCM, prefixing the nonce to the returned ciphertext
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ForTesting returns a keyring with a single random key, for unit tests.
+func ForTesting() Keyring {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return Keyring{
+		current: "test",
+		keys:    map[string][]byte{"test": key},
+	}
+}
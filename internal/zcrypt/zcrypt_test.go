@@ -0,0 +1,99 @@
+package zcrypt
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyring(t *testing.T, current string, ids ...string) Keyring {
+	t.Helper()
+	encoded := make(map[string]string)
+	for _, id := range ids {
+		key, err := GenerateKey()
+		assert.NoError(t, err)
+		encoded[id] = key
+	}
+	k, err := decodeKeys(current, encoded)
+	assert.NoError(t, err)
+	return k
+}
+
+func TestSealAndOpen(t *testing.T) {
+	assert := assert.New(t)
+	k := testKeyring(t, "a", "a")
+
+	keyID, sealed, err := k.Seal("refresh-token")
+	assert.NoError(err)
+	assert.Equal("a", keyID)
+	assert.NotContains(sealed, "refresh-token")
+
+	opened, err := k.Open(keyID, sealed)
+	assert.NoError(err)
+	assert.Equal("refresh-token", opened)
+
+	// sealing twice shouldn't produce the same value
+	_, sealed2, err := k.Seal("refresh-token")
+	assert.NoError(err)
+	assert.NotEqual(sealed, sealed2)
+
+	_, err = k.Open("b", sealed)
+	assert.ErrorIs(err, ErrUnknownKey)
+
+	_, err = k.Open(keyID, "refresh-token")
+	assert.ErrorIs(err, ErrNotSealed)
+
+	_, err = k.Open(keyID, sealed[:len(sealed)-4]+"AAAA")
+	assert.Error(err)
+}
+
+func TestReseal(t *testing.T) {
+	assert := assert.New(t)
+	old := testKeyring(t, "a", "a")
+	_, sealed, err := old.Seal("access-token")
+	assert.NoError(err)
+
+	// rotating: both keys available, with the new one current
+	rotated, err := NewKeyring("b", map[string][]byte{
+		"a": old.keys["a"],
+		"b": testKeyring(t, "b", "b").keys["b"],
+	})
+	assert.NoError(err)
+
+	keyID, resealed, err := rotated.Reseal("a", sealed)
+	assert.NoError(err)
+	assert.Equal("b", keyID)
+
+	opened, err := rotated.Open(keyID, resealed)
+	assert.NoError(err)
+	assert.Equal("access-token", opened)
+
+	// legacy plaintext has no key id
+	keyID, resealed, err = rotated.Reseal("", "plaintext-token")
+	assert.NoError(err)
+	opened, err = rotated.Open(keyID, resealed)
+	assert.NoError(err)
+	assert.Equal("plaintext-token", opened)
+}
+
+func TestParseEnv(t *testing.T) {
+	assert := assert.New(t)
+	key, err := GenerateKey()
+	assert.NoError(err)
+
+	k, err := parseEnv("old="+key+", new="+key, "new")
+	assert.NoError(err)
+	assert.Equal("new", k.CurrentID())
+	assert.Len(k.keys, 2)
+
+	_, err = parseEnv("old="+key, "missing")
+	assert.ErrorIs(err, ErrNoCurrentKey)
+
+	short := base64.StdEncoding.EncodeToString([]byte("too short"))
+	_, err = parseEnv("old="+short, "old")
+	assert.ErrorIs(err, ErrInvalidKey)
+
+	_, err = parseEnv("garbage", "old")
+	assert.Error(err)
+}
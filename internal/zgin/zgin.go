@@ -1,8 +1,10 @@
 package zgin
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/zestze/zest-backend/internal/user"
@@ -30,3 +32,22 @@ func BadRequest(c *gin.Context, message string) {
 		"error": message,
 	})
 }
+
+// ParseTime parses raw as an RFC 3339 timestamp, or failing that as a date in loc.
+// dates resolve to the first moment of the day, or the last moment if endOfDay is set,
+// so that a date range is inclusive of the whole end date.
+func ParseTime(raw string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation(time.DateOnly, raw, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time must be formatted as %v or %v", time.RFC3339, time.DateOnly)
+	}
+	if endOfDay {
+		// postgres only stores microseconds
+		t = t.AddDate(0, 0, 1).Add(-time.Microsecond)
+	}
+	return t, nil
+}
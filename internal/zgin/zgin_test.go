@@ -0,0 +1,30 @@
+package zgin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTime(t *testing.T) {
+	assert := assert.New(t)
+	loc, err := time.LoadLocation("America/New_York")
+	assert.NoError(err)
+
+	// explicit timestamps ignore the location
+	ts, err := ParseTime("2024-02-10T17:00:00Z", loc, true)
+	assert.NoError(err)
+	assert.True(ts.Equal(time.Date(2024, 2, 10, 17, 0, 0, 0, time.UTC)))
+
+	start, err := ParseTime("2024-02-10", loc, false)
+	assert.NoError(err)
+	assert.True(start.Equal(time.Date(2024, 2, 10, 5, 0, 0, 0, time.UTC)))
+
+	end, err := ParseTime("2024-02-10", loc, true)
+	assert.NoError(err)
+	assert.True(end.Equal(time.Date(2024, 2, 11, 4, 59, 59, 999999000, time.UTC)))
+
+	_, err = ParseTime("last tuesday", loc, false)
+	assert.Error(err)
+}
@@ -0,0 +1,76 @@
+-- moves existing spotify data onto per-user accounts.
+-- run this before applying schema.sql, since tokens and gaps can't be keyed
+-- by account until the accounts exist.
+--
+-- every user with a token gets an account, which existing tokens, plays and gaps are moved onto.
+-- spotify ids are filled in the next time each account is refreshed.
+BEGIN;
+
+CREATE TABLE spotify_accounts(
+    id serial PRIMARY KEY,
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE NOT NULL,
+    spotify_id text,
+    display_name text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (user_id, spotify_id)
+);
+
+INSERT INTO spotify_accounts (user_id)
+SELECT user_id
+FROM spotify_tokens
+ORDER BY user_id;
+
+-- tokens
+ALTER TABLE spotify_tokens
+    ADD COLUMN account_id int REFERENCES spotify_accounts(id) ON DELETE CASCADE;
+UPDATE spotify_tokens
+SET account_id = spotify_accounts.id
+FROM spotify_accounts
+WHERE spotify_accounts.user_id = spotify_tokens.user_id;
+ALTER TABLE spotify_tokens DROP CONSTRAINT spotify_tokens_pkey;
+ALTER TABLE spotify_tokens ALTER COLUMN account_id SET NOT NULL;
+ALTER TABLE spotify_tokens ADD PRIMARY KEY (account_id);
+
+-- plays. imported plays weren't played on an account, so stay NULL
+ALTER TABLE spotify_songs
+    ADD COLUMN account_id int REFERENCES spotify_accounts(id) ON DELETE SET NULL;
+UPDATE spotify_songs
+SET account_id = spotify_accounts.id
+FROM spotify_accounts
+WHERE spotify_accounts.user_id = spotify_songs.user_id;
+
+ALTER TABLE spotify_played_tracks
+    ADD COLUMN account_id int REFERENCES spotify_accounts(id) ON DELETE SET NULL;
+UPDATE spotify_played_tracks
+SET account_id = spotify_accounts.id
+FROM spotify_accounts
+WHERE spotify_accounts.user_id = spotify_played_tracks.user_id
+    AND spotify_played_tracks.source = 'spotify';
+
+-- gaps. without a token there was nothing to sync, so gaps can't exist without an account
+ALTER TABLE spotify_coverage_gaps
+    ADD COLUMN account_id int REFERENCES spotify_accounts(id) ON DELETE CASCADE;
+UPDATE spotify_coverage_gaps
+SET account_id = spotify_accounts.id
+FROM spotify_accounts
+WHERE spotify_accounts.user_id = spotify_coverage_gaps.user_id;
+DELETE FROM spotify_coverage_gaps WHERE account_id IS NULL;
+ALTER TABLE spotify_coverage_gaps DROP CONSTRAINT spotify_coverage_gaps_pkey;
+ALTER TABLE spotify_coverage_gaps ALTER COLUMN account_id SET NOT NULL;
+ALTER TABLE spotify_coverage_gaps ADD PRIMARY KEY (account_id, gap_start);
+
+-- new columns can only be appended to a view in place
+CREATE OR REPLACE VIEW spotify_first_listens AS
+SELECT user_id, 'track' AS kind, track_id AS id, MIN(played_at) AS first_played_at,
+    (array_agg(account_id ORDER BY played_at))[1] AS account_id
+FROM spotify_played_tracks
+GROUP BY user_id, track_id
+UNION ALL
+SELECT spotify_played_tracks.user_id, 'artist', spotify_credits.artist_id, MIN(spotify_played_tracks.played_at),
+    (array_agg(spotify_played_tracks.account_id ORDER BY spotify_played_tracks.played_at))[1]
+FROM spotify_played_tracks
+JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+GROUP BY spotify_played_tracks.user_id, spotify_credits.artist_id;
+
+COMMIT;
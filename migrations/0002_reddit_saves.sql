@@ -0,0 +1,48 @@
+-- splits reddit posts into things shared across users, and each user's saves of them.
+-- run this before applying schema.sql, since reddit_posts is dropped from it.
+--
+-- every existing post was saved by the user it's attributed to, which is the only
+-- record of who saved it. when the sync first saw it stands in for when it was saved.
+BEGIN;
+
+CREATE TABLE reddit_things(
+    name text PRIMARY KEY, -- thing type + id, e.g. t3_abc123
+    permalink text NOT NULL,
+    subreddit text NOT NULL,
+    title text,
+    num_comments int,
+    upvote_ratio real,
+    ups int,
+    score int,
+    total_awards_received int,
+    suggested_sort text,
+    link_title text,
+    body text,
+    created_utc real, -- seeconds since the epoch
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE reddit_saves(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE NOT NULL,
+    name text REFERENCES reddit_things(name)
+        ON DELETE CASCADE NOT NULL,
+    -- when the save was first synced, reddit doesn't say when it was saved
+    saved_seen_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, name)
+);
+
+INSERT INTO reddit_things
+    (name, permalink, subreddit, title, num_comments, upvote_ratio, ups, score,
+    total_awards_received, suggested_sort, link_title, body, created_utc, created_at)
+SELECT name, permalink, subreddit, title, num_comments, upvote_ratio, ups, score,
+    total_awards_received, suggested_sort, link_title, body, created_utc, created_at
+FROM reddit_posts;
+
+INSERT INTO reddit_saves (user_id, name, saved_seen_at)
+SELECT user_id, name, created_at
+FROM reddit_posts;
+
+DROP TABLE reddit_posts;
+
+COMMIT;
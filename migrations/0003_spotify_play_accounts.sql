@@ -0,0 +1,18 @@
+-- lets plays on different accounts of the same user happen at the same moment.
+-- plays were unique per user and played_at, so the second account's play was dropped.
+--
+-- plays without an account are still deduplicated against each other, which is why
+-- NULLS NOT DISTINCT is used, and why this needs postgres 15 or later.
+BEGIN;
+
+ALTER TABLE spotify_played_tracks DROP CONSTRAINT spotify_played_tracks_pkey;
+ALTER TABLE spotify_played_tracks
+    ADD CONSTRAINT spotify_played_tracks_user_id_account_id_played_at_key
+    UNIQUE NULLS NOT DISTINCT (user_id, account_id, played_at);
+
+ALTER TABLE spotify_songs DROP CONSTRAINT spotify_songs_pkey;
+ALTER TABLE spotify_songs
+    ADD CONSTRAINT spotify_songs_user_id_account_id_played_at_key
+    UNIQUE NULLS NOT DISTINCT (user_id, account_id, played_at);
+
+COMMIT;
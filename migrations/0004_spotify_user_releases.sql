@@ -0,0 +1,29 @@
+-- tracks which releases each user has seen, rather than only when a release was first
+-- seen by anyone. otherwise only the first user to poll an artist was told about a release.
+-- run this before applying schema.sql, since back_catalogue moves off spotify_releases.
+--
+-- every user tracking an artist is taken to have seen its releases when they were first seen.
+BEGIN;
+
+CREATE TABLE spotify_user_releases(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    artist_id text NOT NULL,
+    album_id text NOT NULL,
+    seen_at timestamptz NOT NULL DEFAULT now(),
+    back_catalogue boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (user_id, artist_id, album_id),
+    FOREIGN KEY (artist_id, album_id) REFERENCES spotify_releases(artist_id, album_id)
+        ON DELETE CASCADE
+);
+
+INSERT INTO spotify_user_releases (user_id, artist_id, album_id, seen_at, back_catalogue)
+SELECT spotify_release_artists.user_id, spotify_releases.artist_id, spotify_releases.album_id,
+    spotify_releases.first_seen_at, spotify_releases.back_catalogue
+FROM spotify_releases
+JOIN spotify_release_artists ON spotify_release_artists.artist_id = spotify_releases.artist_id;
+
+ALTER TABLE spotify_releases DROP COLUMN back_catalogue;
+
+COMMIT;
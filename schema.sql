@@ -1,17 +1,30 @@
+-- needed for fuzzy searching names with similarity() and %
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE TABLE users(
     id serial PRIMARY KEY,
     username text UNIQUE NOT NULL,
     password text UNIQUE NOT NULL,
     salt int NOT NULL,
+    -- IANA timezone name, used for dates and day bucketing
+    timezone text NOT NULL DEFAULT 'UTC',
+    -- opts in to a public badge of what the user has been listening to
+    public_badge boolean NOT NULL DEFAULT false,
     created_at timestamptz NOT NULL DEFAULT now()
 );
 
-CREATE TABLE reddit_posts(
-    id serial PRIMARY KEY,
-    name  text UNIQUE NOT NULL,
-    user_id int REFERENCES users(id) 
-        ON DELETE CASCADE
-        NOT NULL,
+-- tokens for submitting listens through the listenbrainz compatible api
+CREATE TABLE listen_tokens(
+    user_id int PRIMARY KEY REFERENCES users(id)
+        ON DELETE CASCADE NOT NULL,
+    -- sha256 of the token, which is only shown when issued
+    token_hash text UNIQUE NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- posts and comments, shared by every user who has saved them
+CREATE TABLE reddit_things(
+    name text PRIMARY KEY, -- thing type + id, e.g. t3_abc123
     permalink text NOT NULL,
     subreddit text NOT NULL,
     title text,
@@ -27,6 +40,36 @@ CREATE TABLE reddit_posts(
     created_at timestamptz NOT NULL DEFAULT now()
 );
 
+CREATE TABLE reddit_saves(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE NOT NULL,
+    name text REFERENCES reddit_things(name)
+        ON DELETE CASCADE NOT NULL,
+    -- when the save was first synced, reddit doesn't say when it was saved
+    saved_seen_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, name)
+);
+
+-- a user's linked reddit account, granted through the oauth code flow
+CREATE TABLE reddit_tokens(
+    user_id int PRIMARY KEY REFERENCES users(id)
+        ON DELETE CASCADE NOT NULL,
+    username text NOT NULL,
+    refresh_token text NOT NULL,
+    scope text,
+    -- id of the master key the refresh token is sealed with
+    key_id text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- single use states handed out when a user starts linking a reddit account
+CREATE TABLE reddit_oauth_states(
+    state text PRIMARY KEY,
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE NOT NULL,
+    expires_at timestamptz NOT NULL
+);
+
 
 CREATE TYPE metacritic_medium AS ENUM ('switch', 'tv', 'movie', 'pc');
 
@@ -42,14 +85,30 @@ CREATE TABLE metacritic_posts(
 );
 
 
+-- spotify accounts linked to each user, so that one user can have several
+CREATE TABLE spotify_accounts(
+    id serial PRIMARY KEY,
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE NOT NULL,
+    -- id from spotify's /me, NULL for accounts linked before it was recorded
+    spotify_id text,
+    display_name text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (user_id, spotify_id)
+);
+
 CREATE TABLE spotify_tokens(
-    user_id int PRIMARY KEY REFERENCES users(id) 
+    account_id int PRIMARY KEY REFERENCES spotify_accounts(id)
+        ON DELETE CASCADE NOT NULL,
+    user_id int REFERENCES users(id)
         ON DELETE CASCADE NOT NULL,
     access_token text NOT NULL,
     token_type text,
     scope text,
     expires_at timestamptz NOT NULL,
-    refresh_token text NOT NULL
+    refresh_token text NOT NULL,
+    -- id of the master key the tokens are sealed with, NULL for legacy plaintext rows
+    key_id text
 );
 
 CREATE TABLE spotify_songs(
@@ -65,8 +124,11 @@ CREATE TABLE spotify_songs(
     artist_id text NOT NULL,
     artist_name text NOT NULL,
     context_blob json,
+    account_id int REFERENCES spotify_accounts(id)
+        ON DELETE SET NULL,
     created_at timestamptz NOT NULL DEFAULT now(),
-    PRIMARY KEY (user_id, played_at)
+    -- accounts can play at the same moment, and plays without one are still deduplicated
+    UNIQUE NULLS NOT DISTINCT (user_id, account_id, played_at)
 );
 
 -- TODO(zeke): ignoring artists listed in albums for now
@@ -77,7 +139,9 @@ CREATE TABLE spotify_albums(
     href text NOT NULL,
     uri text NOT NULL,
     external_url text NOT NULL,
-    type text NOT NULL
+    type text NOT NULL,
+    -- when the track list was cached, so albums without tracks aren't fetched again
+    tracks_listed_at timestamptz
 );
 
 CREATE TABLE spotify_tracks(
@@ -101,9 +165,21 @@ CREATE TABLE spotify_artists(
     uri text NOT NULL,
     external_url text NOT NULL,
     genres text[],
-    popularity int
+    popularity int,
+    -- when the artist's discography was last polled for new releases, NULL if never
+    releases_polled_at timestamptz,
+    -- when the artist's images were looked up, since plays only include artists without images
+    images_fetched_at timestamptz
 );
 
+-- indexes for searching over listening history
+CREATE INDEX spotify_albums_name_fts ON spotify_albums USING gin (to_tsvector('simple', name));
+CREATE INDEX spotify_albums_name_trgm ON spotify_albums USING gin (name gin_trgm_ops);
+CREATE INDEX spotify_tracks_name_fts ON spotify_tracks USING gin (to_tsvector('simple', name));
+CREATE INDEX spotify_tracks_name_trgm ON spotify_tracks USING gin (name gin_trgm_ops);
+CREATE INDEX spotify_artists_name_fts ON spotify_artists USING gin (to_tsvector('simple', name));
+CREATE INDEX spotify_artists_name_trgm ON spotify_artists USING gin (name gin_trgm_ops);
+
 -- association table
 CREATE TABLE spotify_credits(
     track_id text references spotify_tracks(id)
@@ -124,8 +200,251 @@ CREATE TABLE spotify_played_tracks(
         ON DELETE CASCADE
         NOT NULL,
     context_blob json,
+    -- where the play came from, such as spotify or an imported lastfm scrobble
+    source text NOT NULL DEFAULT 'spotify',
+    -- the account it was played on, NULL for imported plays and unlinked accounts
+    account_id int REFERENCES spotify_accounts(id)
+        ON DELETE SET NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    -- accounts can play at the same moment, and plays without one are still deduplicated
+    UNIQUE NULLS NOT DISTINCT (user_id, account_id, played_at)
+);
+
+CREATE INDEX spotify_played_tracks_user_track ON spotify_played_tracks (user_id, track_id, played_at);
+
+-- when each user first heard each track and artist, and on which account.
+-- a plain view so that imports of older history are reflected immediately
+CREATE VIEW spotify_first_listens AS
+SELECT user_id, 'track' AS kind, track_id AS id, MIN(played_at) AS first_played_at,
+    (array_agg(account_id ORDER BY played_at))[1] AS account_id
+FROM spotify_played_tracks
+GROUP BY user_id, track_id
+UNION ALL
+SELECT spotify_played_tracks.user_id, 'artist', spotify_credits.artist_id, MIN(spotify_played_tracks.played_at),
+    (array_agg(spotify_played_tracks.account_id ORDER BY spotify_played_tracks.played_at))[1]
+FROM spotify_played_tracks
+JOIN spotify_credits ON spotify_credits.track_id = spotify_played_tracks.track_id
+GROUP BY spotify_played_tracks.user_id, spotify_credits.artist_id;
+
+-- imported plays that couldn't be matched to a stored track, kept for review
+CREATE TABLE spotify_unmatched_scrobbles(
+    id serial PRIMARY KEY,
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    played_at timestamptz NOT NULL,
+    artist_name text NOT NULL,
+    track_name text NOT NULL,
+    album_name text,
+    source text NOT NULL,
     created_at timestamptz NOT NULL DEFAULT now(),
-    PRIMARY KEY (user_id, played_at)
+    UNIQUE (user_id, played_at, artist_name, track_name)
+);
+
+-- periods where recently played was likely overrun between refreshes
+CREATE TABLE spotify_coverage_gaps(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    account_id int REFERENCES spotify_accounts(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    gap_start timestamptz NOT NULL,
+    gap_end timestamptz NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (account_id, gap_start)
+);
+
+-- playlists that plays came from, so that contexts can be named, and playlists in users' libraries.
+-- playlists spotify won't show us are kept with an empty name
+CREATE TABLE spotify_playlists(
+    id text PRIMARY KEY,
+    name text NOT NULL,
+    href text NOT NULL,
+    uri text NOT NULL,
+    external_url text NOT NULL,
+    owner_id text NOT NULL,
+    owner_name text NOT NULL,
+    -- the version of the track list we have, NULL if we only know the name
+    snapshot_id text,
+    fetched_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- the playlists in each account's library
+CREATE TABLE spotify_account_playlists(
+    account_id int REFERENCES spotify_accounts(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    playlist_id text REFERENCES spotify_playlists(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    PRIMARY KEY (account_id, playlist_id)
+);
+
+-- the track list of each playlist as of its latest snapshot
+CREATE TABLE spotify_playlist_tracks(
+    playlist_id text REFERENCES spotify_playlists(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    position int NOT NULL,
+    track_id text REFERENCES spotify_tracks(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    added_at timestamptz,
+    added_by text NOT NULL,
+    PRIMARY KEY (playlist_id, position)
+);
+
+-- every version of a playlist we've synced
+CREATE TABLE spotify_playlist_snapshots(
+    playlist_id text REFERENCES spotify_playlists(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    snapshot_id text NOT NULL,
+    previous_snapshot_id text,
+    tracks int NOT NULL,
+    synced_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (playlist_id, snapshot_id)
+);
+
+-- tracks added to and removed from each playlist, by the snapshot they were first seen in
+CREATE TABLE spotify_playlist_changes(
+    id serial PRIMARY KEY,
+    playlist_id text NOT NULL,
+    snapshot_id text NOT NULL,
+    track_id text REFERENCES spotify_tracks(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    -- one of added or removed
+    change text NOT NULL,
+    FOREIGN KEY (playlist_id, snapshot_id) REFERENCES spotify_playlist_snapshots(playlist_id, snapshot_id)
+        ON DELETE CASCADE
+);
+
+-- tracks in each account's Liked Songs. unliked tracks are kept with when they were removed
+CREATE TABLE spotify_saved_tracks(
+    account_id int REFERENCES spotify_accounts(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    track_id text REFERENCES spotify_tracks(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    added_at timestamptz NOT NULL,
+    removed_at timestamptz,
+    synced_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (account_id, track_id)
+);
+
+-- artists polled for new releases on each user's behalf, either followed or played a lot
+CREATE TABLE spotify_release_artists(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    artist_id text REFERENCES spotify_artists(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    -- one of followed or played
+    reason text NOT NULL,
+    PRIMARY KEY (user_id, artist_id)
+);
+
+-- albums and singles by polled artists, shared between users
+CREATE TABLE spotify_releases(
+    artist_id text REFERENCES spotify_artists(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    album_id text NOT NULL,
+    name text NOT NULL,
+    type text NOT NULL,
+    release_date text NOT NULL,
+    release_date_precision text NOT NULL,
+    released_at date NOT NULL,
+    total_tracks int NOT NULL,
+    href text NOT NULL,
+    uri text NOT NULL,
+    external_url text NOT NULL,
+    first_seen_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (artist_id, album_id)
+);
+
+-- releases each user has been shown. releases already out when the user's artist was first
+-- polled on their behalf are back catalogue, and never count as new
+CREATE TABLE spotify_user_releases(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    artist_id text NOT NULL,
+    album_id text NOT NULL,
+    seen_at timestamptz NOT NULL DEFAULT now(),
+    back_catalogue boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (user_id, artist_id, album_id),
+    FOREIGN KEY (artist_id, album_id) REFERENCES spotify_releases(artist_id, album_id)
+        ON DELETE CASCADE
+);
+
+-- when each user last checked for new releases
+CREATE TABLE spotify_release_checks(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE
+        PRIMARY KEY,
+    checked_at timestamptz NOT NULL
+);
+
+-- daily snapshots of spotify's own top artists and tracks for each account, per time range
+CREATE TABLE spotify_top_items(
+    user_id int REFERENCES users(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    account_id int REFERENCES spotify_accounts(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    -- one of artists or tracks
+    kind text NOT NULL,
+    -- one of short_term, medium_term or long_term
+    time_range text NOT NULL,
+    -- the day the snapshot is for, in the user's timezone
+    taken_on date NOT NULL,
+    taken_at timestamptz NOT NULL,
+    rank int NOT NULL,
+    item_id text NOT NULL,
+    name text NOT NULL,
+    PRIMARY KEY (account_id, kind, time_range, taken_on, rank)
+);
+
+CREATE INDEX spotify_top_items_user_item ON spotify_top_items (user_id, kind, time_range, item_id);
+
+-- every size of album and artist images spotify has given us
+CREATE TABLE spotify_images(
+    -- one of album or artist
+    kind text NOT NULL,
+    id text NOT NULL,
+    url text NOT NULL,
+    -- zero if spotify didn't say
+    width int NOT NULL,
+    height int NOT NULL,
+    PRIMARY KEY (kind, id, url)
+);
+
+-- images downloaded from spotify's cdn, served by the image proxy
+CREATE TABLE spotify_image_cache(
+    url text PRIMARY KEY,
+    content_type text NOT NULL,
+    etag text NOT NULL,
+    body bytea NOT NULL,
+    fetched_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- full track lists of albums, which can include tracks that were never played
+CREATE TABLE spotify_album_tracks(
+    album_id text REFERENCES spotify_albums(id)
+        ON DELETE CASCADE
+        NOT NULL,
+    track_id text NOT NULL,
+    name text NOT NULL,
+    disc_number int NOT NULL,
+    track_number int NOT NULL,
+    duration_ms int NOT NULL,
+    PRIMARY KEY (album_id, track_id)
 );
 
 CREATE TABLE saved_metacritic_posts(